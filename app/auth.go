@@ -46,6 +46,11 @@ func requireAuth(next http.HandlerFunc, requireWrite bool) http.HandlerFunc {
 	}
 }
 
+func isAuthenticated(r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookie)
+	return err == nil && isCookieValid(cookie.Value)
+}
+
 func isCookieValid(token string) bool {
 	if options.Password == "" {
 		return false
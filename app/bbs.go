@@ -0,0 +1,517 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	bbsDefaultBoard   = "general"
+	bbsOwnerCookie    = "taz_bbs"
+	bbsNickCookie     = "taz_nick"
+	bbsTopicsPerPage  = 10
+	bbsSearchLimit    = 50
+	bbsMaxMessageSize = 1000
+	bbsMaxNameSize    = 32
+	bbsTimeFormat     = "2006-01-02 15:04:05"
+)
+
+var (
+	errBBSNotFound  = errors.New("message not found")
+	errBBSForbidden = errors.New("not allowed")
+	errBBSEmpty     = errors.New("message is empty")
+	errBBSOrphan    = errors.New("reply to a topic not received yet")
+	errBBSUnsigned  = errors.New("message not signed by its origin")
+)
+
+func normalizeBoardName(name string) string {
+	if board := normalizeSlug(name); board != "" {
+		return board
+	}
+	return bbsDefaultBoard
+}
+
+func isBBSAdmin(r *http.Request) bool {
+	return options.Password != "" && isAuthenticated(r)
+}
+
+func hashBBSOwner(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func getBBSOwner(r *http.Request) string {
+	if cookie, err := r.Cookie(bbsOwnerCookie); err == nil && cookie.Value != "" {
+		return hashBBSOwner(cookie.Value)
+	}
+	return ""
+}
+
+func ensureBBSOwner(w http.ResponseWriter, r *http.Request) string {
+	if owner := getBBSOwner(r); owner != "" {
+		return owner
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     bbsOwnerCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   10 * 365 * 24 * 3600,
+	})
+	return hashBBSOwner(token)
+}
+
+func getBBSNick(r *http.Request) string {
+	if cookie, err := r.Cookie(bbsNickCookie); err == nil {
+		if nick, err := url.QueryUnescape(cookie.Value); err == nil {
+			return nick
+		}
+	}
+	return ""
+}
+
+func resolveBBSAuthor(w http.ResponseWriter, r *http.Request, author string) string {
+	author = strings.TrimSpace(author)
+	author = truncateString(author, bbsMaxNameSize)
+	if author != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:   bbsNickCookie,
+			Value:  url.QueryEscape(author),
+			Path:   "/",
+			MaxAge: 10 * 365 * 24 * 3600,
+		})
+		return author
+	}
+	if nick := getBBSNick(r); nick != "" {
+		return nick
+	}
+	if isBBSAdmin(r) {
+		return "admin"
+	}
+	return "anonymous"
+}
+
+func canModifyBBSMessage(r *http.Request, msg BBSMessage) bool {
+	if isBBSAdmin(r) {
+		return true
+	}
+	owner := getBBSOwner(r)
+	return owner != "" && owner == msg.Owner
+}
+
+func newBBSView(r *http.Request, msg BBSMessage) BBSMessageView {
+	view := BBSMessageView{BBSMessage: msg, CanEdit: canModifyBBSMessage(r, msg)}
+	view.Owner = ""
+	return view
+}
+
+func loadBBSAttachments(views ...*BBSMessageView) error {
+	ids := make([]int64, len(views))
+	for i, v := range views {
+		ids[i] = v.ID
+	}
+	attachments, err := queryBBSAttachments(ids)
+	if err != nil {
+		return err
+	}
+	for _, v := range views {
+		v.Attachments = attachments[v.ID]
+	}
+	return nil
+}
+
+func createBBSMessage(w http.ResponseWriter, r *http.Request, input BBSMessage, files []*multipart.FileHeader) (BBSMessage, error) {
+	input.Message = strings.TrimSpace(input.Message)
+	input.Title = strings.TrimSpace(input.Title)
+	if input.Message == "" && len(files) == 0 {
+		return input, errBBSEmpty
+	}
+	input.Message = truncateString(input.Message, bbsMaxMessageSize)
+
+	msg, err := insertBBSMessage(BBSMessage{
+		Board:     normalizeBoardName(input.Board),
+		ParentID:  input.ParentID,
+		Title:     input.Title,
+		Author:    resolveBBSAuthor(w, r, input.Author),
+		Owner:     ensureBBSOwner(w, r),
+		Message:   input.Message,
+		CreatedAt: time.Now().Format(bbsTimeFormat),
+	})
+	if err != nil {
+		return input, err
+	}
+	if _, err := saveBBSAttachments(msg.ID, files); err != nil {
+		return msg, err
+	}
+	appLogger.Printf("BBS message %d posted by %s (%s) on board %s", msg.ID, r.RemoteAddr, msg.Author, msg.Board)
+	return msg, nil
+}
+
+func editBBSMessage(r *http.Request, id int64, title, message string) (BBSMessage, error) {
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return BBSMessage{}, errBBSEmpty
+	}
+	message = truncateString(message, bbsMaxMessageSize)
+
+	msg, err := getBBSMessage(id)
+	if err != nil {
+		return msg, err
+	}
+	if !canModifyBBSMessage(r, msg) {
+		return BBSMessage{}, errBBSForbidden
+	}
+	msg.Message = message
+	if msg.ParentID == 0 {
+		msg.Title = strings.TrimSpace(title)
+	}
+	msg.UpdatedAt = time.Now().Format(bbsTimeFormat)
+	if err := updateBBSMessage(msg); err != nil {
+		return BBSMessage{}, err
+	}
+	appLogger.Printf("BBS message %d edited by %s", id, r.RemoteAddr)
+	return msg, nil
+}
+
+func deleteBBSMessage(r *http.Request, id int64) (BBSMessage, error) {
+	msg, err := getBBSMessage(id)
+	if err != nil {
+		return msg, err
+	}
+	if !canModifyBBSMessage(r, msg) {
+		return BBSMessage{}, errBBSForbidden
+	}
+	attachments, err := removeBBSMessage(msg)
+	if err != nil {
+		return BBSMessage{}, err
+	}
+	removeBBSAttachments(attachments)
+	appLogger.Printf("BBS message %d deleted by %s", id, r.RemoteAddr)
+	return msg, nil
+}
+
+func listBBSTopics(r *http.Request, board string, page int) ([]BBSTopicView, int, error) {
+	topics, totalPages, err := queryBBSTopics(board, page)
+	if err != nil {
+		return nil, 0, err
+	}
+	views := make([]*BBSMessageView, len(topics))
+	for i := range topics {
+		topics[i].BBSMessageView = newBBSView(r, topics[i].BBSMessage)
+		views[i] = &topics[i].BBSMessageView
+	}
+	return topics, totalPages, loadBBSAttachments(views...)
+}
+
+func getBBSThread(r *http.Request, id int64) (*BBSThread, error) {
+	topic, err := getBBSMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	if topic.ParentID != 0 {
+		if topic, err = getBBSMessage(topic.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := queryBBSReplies(topic.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	thread := &BBSThread{Topic: newBBSView(r, topic), Replies: []BBSMessageView{}}
+	views := []*BBSMessageView{&thread.Topic}
+	for _, m := range replies {
+		thread.Replies = append(thread.Replies, newBBSView(r, m))
+	}
+	for i := range thread.Replies {
+		views = append(views, &thread.Replies[i])
+	}
+	return thread, loadBBSAttachments(views...)
+}
+
+func searchBBSMessages(r *http.Request, query, board string) ([]BBSMessageView, error) {
+	messages, err := queryBBSSearch(query, board, bbsSearchLimit)
+	if err != nil {
+		return nil, err
+	}
+	results := []BBSMessageView{}
+	views := make([]*BBSMessageView, len(messages))
+	for i, m := range messages {
+		results = append(results, newBBSView(r, m))
+		views[i] = &results[i]
+	}
+	return results, loadBBSAttachments(views...)
+}
+
+func bbsHandler(w http.ResponseWriter, r *http.Request) {
+	if options.BBSPath == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if r.Method == "POST" {
+		requireAuth(handleBBSPost, true)(w, r)
+		return
+	}
+	handleBBSGet(w, r)
+}
+
+func handleBBSGet(w http.ResponseWriter, r *http.Request) {
+	data := BBSPageData{
+		Title:       "BBS Messages",
+		Board:       normalizeBoardName(r.URL.Query().Get("board")),
+		Author:      getBBSNick(r),
+		CurrentPage: 1,
+		TotalPages:  1,
+	}
+
+	boards, err := queryBBSBoards()
+	if err != nil {
+		appLogger.Printf("Failed to read BBS: %v", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	data.Boards = boards
+
+	if t := r.URL.Query().Get("topic"); t != "" {
+		id, _ := strconv.ParseInt(t, 10, 64)
+		thread, err := getBBSThread(r, id)
+		if err != nil {
+			http.Redirect(w, r, "/bbs", http.StatusSeeOther)
+			return
+		}
+		data.Thread = thread
+		data.Board = thread.Topic.Board
+	} else if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		results, err := searchBBSMessages(r, q, "")
+		if err != nil {
+			appLogger.Printf("BBS search failed: %v", err)
+			http.Error(w, "Storage error", http.StatusInternalServerError)
+			return
+		}
+		data.Query = q
+		data.Results = results
+	} else {
+		if p := r.URL.Query().Get("page"); p != "" {
+			if parsedPage, err := strconv.Atoi(p); err == nil && parsedPage > 0 {
+				data.CurrentPage = parsedPage
+			}
+		}
+		topics, totalPages, err := listBBSTopics(r, data.Board, data.CurrentPage)
+		if err != nil {
+			appLogger.Printf("Failed to read BBS: %v", err)
+			http.Error(w, "Storage error", http.StatusInternalServerError)
+			return
+		}
+		data.Topics = topics
+		data.TotalPages = totalPages
+		data.CurrentPage = min(data.CurrentPage, totalPages)
+	}
+
+	data.HasPrevious = data.CurrentPage > 1
+	data.HasNext = data.CurrentPage < data.TotalPages
+	for i := 1; i <= data.TotalPages; i++ {
+		data.Pages = append(data.Pages, i)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "bbs.html", data)
+}
+
+func handleBBSPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(bbsMaxUploadMemory); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, "Error parsing form", http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	redirect := "/bbs?board=" + url.QueryEscape(normalizeBoardName(r.FormValue("board")))
+	if topic := r.FormValue("topic"); topic != "" {
+		redirect = "/bbs?topic=" + url.QueryEscape(topic)
+	}
+
+	var err error
+	switch r.FormValue("action") {
+	case "edit":
+		_, err = editBBSMessage(r, id, r.FormValue("title"), r.FormValue("message"))
+	case "delete":
+		var msg BBSMessage
+		msg, err = deleteBBSMessage(r, id)
+		if err == nil && msg.ParentID == 0 {
+			redirect = "/bbs?board=" + url.QueryEscape(msg.Board)
+		}
+	default:
+		parentID, _ := strconv.ParseInt(r.FormValue("parent_id"), 10, 64)
+		_, err = createBBSMessage(w, r, BBSMessage{
+			Board:    r.FormValue("board"),
+			ParentID: parentID,
+			Title:    r.FormValue("title"),
+			Author:   r.FormValue("author"),
+			Message:  r.FormValue("message"),
+		}, bbsFormFiles(r))
+	}
+
+	switch err {
+	case nil, errBBSEmpty:
+	case errBBSForbidden:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	case errBBSNotFound:
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	default:
+		appLogger.Printf("BBS storage error: %v", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+func bbsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/bbs/api/"), "/")
+	parts := strings.Split(path, "/")
+
+	if options.BBSPath == "" {
+		writeJSONError(w, http.StatusNotFound, "BBS disabled")
+		return
+	}
+
+	if r.Method != "GET" && options.Password != "" && !isAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	switch {
+	case path == "boards" && r.Method == "GET":
+		boards, err := queryBBSBoards()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+		writeJSON(w, http.StatusOK, boards)
+
+	case path == "topics" && r.Method == "GET":
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		page = max(page, 1)
+		board := normalizeBoardName(r.URL.Query().Get("board"))
+		topics, totalPages, err := listBBSTopics(r, board, page)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"board":       board,
+			"page":        min(page, totalPages),
+			"total_pages": totalPages,
+			"topics":      topics,
+		})
+
+	case path == "sync" && r.Method == "GET":
+		handleBBSSync(w, r)
+
+	case path == "search" && r.Method == "GET":
+		board := ""
+		if b := r.URL.Query().Get("board"); b != "" {
+			board = normalizeBoardName(b)
+		}
+		results, err := searchBBSMessages(r, r.URL.Query().Get("q"), board)
+		if err != nil {
+			writeBBSAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+
+	case len(parts) == 2 && parts[0] == "topics" && r.Method == "GET":
+		id, _ := strconv.ParseInt(parts[1], 10, 64)
+		thread, err := getBBSThread(r, id)
+		if err != nil {
+			writeBBSAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, thread)
+
+	case path == "messages" && r.Method == "POST":
+		var input BBSMessage
+		var files []*multipart.FileHeader
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			if err := r.ParseMultipartForm(bbsMaxUploadMemory); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid form")
+				return
+			}
+			parentID, _ := strconv.ParseInt(r.FormValue("parent_id"), 10, 64)
+			input = BBSMessage{
+				Board:    r.FormValue("board"),
+				ParentID: parentID,
+				Title:    r.FormValue("title"),
+				Author:   r.FormValue("author"),
+				Message:  r.FormValue("message"),
+			}
+			files = bbsFormFiles(r)
+		} else if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+		msg, err := createBBSMessage(w, r, input, files)
+		if err != nil {
+			writeBBSAPIError(w, err)
+			return
+		}
+		view := newBBSView(r, msg)
+		if err := loadBBSAttachments(&view); err != nil {
+			writeBBSAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, view)
+
+	case len(parts) == 2 && parts[0] == "messages" && (r.Method == "PUT" || r.Method == "DELETE"):
+		id, _ := strconv.ParseInt(parts[1], 10, 64)
+		var msg BBSMessage
+		var err error
+		if r.Method == "PUT" {
+			var input BBSMessage
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+				return
+			}
+			msg, err = editBBSMessage(r, id, input.Title, input.Message)
+		} else {
+			msg, err = deleteBBSMessage(r, id)
+		}
+		if err != nil {
+			writeBBSAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newBBSView(r, msg))
+
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown endpoint %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func writeBBSAPIError(w http.ResponseWriter, err error) {
+	switch err {
+	case errBBSNotFound:
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errBBSForbidden:
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case errBBSEmpty:
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		appLogger.Printf("BBS storage error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	bbsAttachmentsDir  = "bbs-attachments"
+	bbsMaxAttachments  = 10
+	bbsThumbnailSize   = 240
+	bbsMaxUploadMemory = 32 << 20
+	bbsMaxThumbPixels  = 50_000_000
+)
+
+var errBBSImageTooLarge = errors.New("image too large for a thumbnail")
+
+func bbsAttachmentDir(messageID int64) string {
+	return filepath.Join(options.RootPath, bbsAttachmentsDir, strconv.FormatInt(messageID, 10))
+}
+
+func bbsThumbnailPath(attachmentID int64) string {
+	return filepath.Join(options.SystemPath, "thumbs", strconv.FormatInt(attachmentID, 10)+".jpg")
+}
+
+func bbsFormFiles(r *http.Request) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	return r.MultipartForm.File["attachments"]
+}
+
+func bbsAttachmentName(name string) string {
+	name = filepath.Base(name)
+	if name == "." || name == "/" || strings.ContainsAny(name, `/\:*?"<>|`) {
+		return ""
+	}
+	return name
+}
+
+func saveBBSAttachments(messageID int64, files []*multipart.FileHeader) ([]BBSAttachment, error) {
+	if len(files) > bbsMaxAttachments {
+		files = files[:bbsMaxAttachments]
+	}
+	var saved []BBSAttachment
+	for _, fh := range files {
+		name := bbsAttachmentName(fh.Filename)
+		if name == "" {
+			continue
+		}
+		src, err := fh.Open()
+		if err != nil {
+			return saved, err
+		}
+		att, err := storeBBSAttachment(messageID, name, src)
+		src.Close()
+		if err != nil {
+			return saved, err
+		}
+		saved = append(saved, att)
+	}
+	return saved, nil
+}
+
+func storeBBSAttachment(messageID int64, name string, src io.Reader) (BBSAttachment, error) {
+	dir := bbsAttachmentDir(messageID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return BBSAttachment{}, err
+	}
+
+	reader := bufio.NewReader(src)
+	head, _ := reader.Peek(512)
+	mimeType := http.DetectContentType(head)
+
+	dst, name, err := createBBSAttachmentFile(dir, name)
+	if err != nil {
+		return BBSAttachment{}, err
+	}
+	size, err := io.Copy(dst, reader)
+	dst.Close()
+	if err != nil {
+		return BBSAttachment{}, err
+	}
+
+	rel := filepath.ToSlash(filepath.Join(bbsAttachmentsDir, strconv.FormatInt(messageID, 10), name))
+	att, err := insertBBSAttachment(BBSAttachment{
+		MessageID: messageID,
+		Name:      name,
+		Path:      rel,
+		Size:      size,
+		Mime:      mimeType,
+	})
+	if err != nil {
+		return att, err
+	}
+	if strings.HasPrefix(mimeType, "image/") {
+		if err := createThumbnail(filepath.Join(dir, name), bbsThumbnailPath(att.ID)); err != nil {
+			appLogger.Printf("BBS: failed to create thumbnail for %s: %v", rel, err)
+		}
+	}
+	return withAttachmentURLs(att), nil
+}
+
+// createBBSAttachmentFile creates name in dir, or name-2, name-3, ... when a
+// file of the same message already took it.
+func createBBSAttachmentFile(dir, name string) (*os.File, string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) || i > bbsMaxAttachments*10 {
+			return f, name, err
+		}
+	}
+}
+
+func withAttachmentURLs(att BBSAttachment) BBSAttachment {
+	att.URL = "/download/" + att.Path
+	att.SizeLabel = formatFileSize(att.Size)
+	att.IsImage = strings.HasPrefix(att.Mime, "image/")
+	if att.IsImage {
+		att.ThumbURL = fmt.Sprintf("/bbs/thumb/%d", att.ID)
+	}
+	return att
+}
+
+func removeBBSAttachments(attachments []BBSAttachment) {
+	dirs := make(map[int64]bool)
+	for _, att := range attachments {
+		os.Remove(bbsThumbnailPath(att.ID))
+		dirs[att.MessageID] = true
+	}
+	for id := range dirs {
+		if err := os.RemoveAll(bbsAttachmentDir(id)); err != nil {
+			appLogger.Printf("BBS: failed to remove attachments of %d: %v", id, err)
+		}
+	}
+}
+
+func createThumbnail(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Decoding allocates the whole bitmap, so a small file declaring a huge
+	// image is refused before that.
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > bbsMaxThumbPixels {
+		return errBBSImageTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	b := img.Bounds()
+	scale := max(float64(b.Dx()), float64(b.Dy())) / bbsThumbnailSize
+	if scale < 1 {
+		scale = 1
+	}
+	w, h := max(int(float64(b.Dx())/scale), 1), max(int(float64(b.Dy())/scale), 1)
+
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+int(float64(y)*scale), b.Min.Y+int(float64(y+1)*scale)
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+int(float64(x)*scale), b.Min.X+int(float64(x+1)*scale)
+			var r, g, bl, a, count uint64
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					count++
+				}
+			}
+			thumb.Set(x, y, color.RGBA64{uint16(r / count), uint16(g / count), uint16(bl / count), uint16(a / count)})
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, thumb, &jpeg.Options{Quality: 75}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func bbsThumbHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/bbs/thumb/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid thumbnail", http.StatusBadRequest)
+		return
+	}
+	path := bbsThumbnailPath(id)
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, path)
+}
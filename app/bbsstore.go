@@ -0,0 +1,735 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const bbsColumns = "id, uid, origin, board, parent_id, title, author, owner, message, created_at, updated_at"
+
+var bbsDB *sql.DB
+
+var bbsSchema = []string{
+	`CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY,
+		board TEXT NOT NULL,
+		parent_id INTEGER NOT NULL DEFAULT 0,
+		title TEXT NOT NULL DEFAULT '',
+		author TEXT NOT NULL DEFAULT '',
+		owner TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL DEFAULT '',
+		replies INTEGER NOT NULL DEFAULT 0,
+		last_activity TEXT NOT NULL DEFAULT '',
+		uid TEXT NOT NULL DEFAULT '',
+		origin TEXT NOT NULL DEFAULT '',
+		origin_seq INTEGER NOT NULL DEFAULT 0,
+		parent_uid TEXT NOT NULL DEFAULT '',
+		origin_key TEXT NOT NULL DEFAULT '',
+		signature TEXT NOT NULL DEFAULT ''
+	)`,
+	"CREATE INDEX IF NOT EXISTS messages_topics ON messages(board, parent_id, last_activity DESC, id DESC)",
+	"CREATE INDEX IF NOT EXISTS messages_thread ON messages(parent_id, id)",
+	`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+		title, message, author,
+		content='messages', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS messages_ai AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(rowid, title, message, author) VALUES (new.id, new.title, new.message, new.author);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_ad AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, title, message, author) VALUES ('delete', old.id, old.title, old.message, old.author);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_au AFTER UPDATE OF title, message, author ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, title, message, author) VALUES ('delete', old.id, old.title, old.message, old.author);
+		INSERT INTO messages_fts(rowid, title, message, author) VALUES (new.id, new.title, new.message, new.author);
+	END`,
+	`CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY,
+		message_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		path TEXT NOT NULL,
+		size INTEGER NOT NULL DEFAULT 0,
+		mime TEXT NOT NULL DEFAULT ''
+	)`,
+	"CREATE INDEX IF NOT EXISTS attachments_message ON attachments(message_id, id)",
+	"CREATE TABLE IF NOT EXISTS sync_state (origin TEXT PRIMARY KEY, seq INTEGER NOT NULL)",
+	`CREATE TABLE IF NOT EXISTS deleted_messages (
+		uid TEXT PRIMARY KEY,
+		origin TEXT NOT NULL,
+		origin_seq INTEGER NOT NULL,
+		origin_key TEXT NOT NULL DEFAULT '',
+		signature TEXT NOT NULL DEFAULT ''
+	)`,
+	"CREATE INDEX IF NOT EXISTS deleted_messages_origin ON deleted_messages(origin, origin_seq)",
+}
+
+var bbsSyncColumns = map[string]string{
+	"uid":        "TEXT NOT NULL DEFAULT ''",
+	"origin":     "TEXT NOT NULL DEFAULT ''",
+	"origin_seq": "INTEGER NOT NULL DEFAULT 0",
+	"parent_uid": "TEXT NOT NULL DEFAULT ''",
+	"origin_key": "TEXT NOT NULL DEFAULT ''",
+	"signature":  "TEXT NOT NULL DEFAULT ''",
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func openBBSStore() error {
+	legacy, err := readLegacyBBS(options.BBSPath)
+	if err != nil {
+		return err
+	}
+	if legacy != nil {
+		backup := options.BBSPath + ".jsonl"
+		if err := os.Rename(options.BBSPath, backup); err != nil {
+			return err
+		}
+		appLogger.Printf("BBS: migrating %d messages from %s", len(legacy), backup)
+	}
+
+	db, err := sql.Open("sqlite", options.BBSPath+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return err
+	}
+	for _, stmt := range bbsSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if legacy != nil {
+		if err := importLegacyBBS(db, legacy); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if err := migrateBBSSync(db); err != nil {
+		db.Close()
+		return err
+	}
+	bbsDB = db
+	return nil
+}
+
+func readLegacyBBS(path string) ([]BBSMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head, _ := r.Peek(16)
+	if bytes.HasPrefix(head, []byte("SQLite format 3")) {
+		return nil, nil
+	}
+
+	messages := []BBSMessage{}
+	line := 0
+	for {
+		data, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			line++
+			var msg BBSMessage
+			if json.Unmarshal(data, &msg) == nil {
+				if msg.ID == 0 {
+					msg.ID = int64(line)
+				}
+				messages = append(messages, msg)
+			}
+		}
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func importLegacyBBS(db *sql.DB, messages []BBSMessage) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO messages (id, board, parent_id, title, author, owner, message, created_at, updated_at, last_activity) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range messages {
+		board := m.Board
+		if board == "" {
+			board = bbsDefaultBoard
+		}
+		if _, err := stmt.Exec(m.ID, board, m.ParentID, m.Title, m.Author, m.Owner, m.Message, m.CreatedAt, m.UpdatedAt, m.CreatedAt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE messages SET
+		replies = (SELECT COUNT(*) FROM messages r WHERE r.parent_id = messages.id),
+		last_activity = MAX(created_at, COALESCE((SELECT MAX(created_at) FROM messages r WHERE r.parent_id = messages.id), ''))
+		WHERE parent_id = 0`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateBBSSync(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('messages')")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	for column, definition := range bbsSyncColumns {
+		if !existing[column] {
+			if _, err := db.Exec("ALTER TABLE messages ADD COLUMN " + column + " " + definition); err != nil {
+				return err
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		"UPDATE messages SET origin = ?1, origin_seq = id, uid = ?1 || '-' || id WHERE uid = ''",
+		"UPDATE messages SET parent_uid = COALESCE((SELECT p.uid FROM messages p WHERE p.id = messages.parent_id), '') WHERE parent_id != 0 AND parent_uid = ''",
+		"INSERT INTO sync_state (origin, seq) SELECT ?1, MAX(origin_seq) FROM messages WHERE origin = ?1 AND origin_seq > 0 HAVING COUNT(*) > 0 ON CONFLICT(origin) DO UPDATE SET seq = MAX(seq, excluded.seq)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS messages_uid ON messages(uid)",
+		"CREATE INDEX IF NOT EXISTS messages_origin ON messages(origin, origin_seq)",
+	} {
+		if _, err := tx.Exec(stmt, nodeID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func scanBBSMessage(row rowScanner) (BBSMessage, error) {
+	var m BBSMessage
+	err := row.Scan(&m.ID, &m.UID, &m.Origin, &m.Board, &m.ParentID, &m.Title, &m.Author, &m.Owner, &m.Message, &m.CreatedAt, &m.UpdatedAt)
+	return m, err
+}
+
+func getBBSMessage(id int64) (BBSMessage, error) {
+	m, err := scanBBSMessage(bbsDB.QueryRow("SELECT "+bbsColumns+" FROM messages WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return m, errBBSNotFound
+	}
+	return m, err
+}
+
+func insertBBSMessage(msg BBSMessage) (BBSMessage, error) {
+	tx, err := bbsDB.Begin()
+	if err != nil {
+		return msg, err
+	}
+	defer tx.Rollback()
+
+	var parentUID string
+	if msg.ParentID != 0 {
+		err := tx.QueryRow(`SELECT t.id, t.board, t.uid FROM messages m
+			JOIN messages t ON t.id = CASE WHEN m.parent_id = 0 THEN m.id ELSE m.parent_id END
+			WHERE m.id = ?`, msg.ParentID).Scan(&msg.ParentID, &msg.Board, &parentUID)
+		if err == sql.ErrNoRows {
+			return msg, errBBSNotFound
+		}
+		if err != nil {
+			return msg, err
+		}
+		msg.Title = ""
+	}
+
+	seq, err := nextBBSSeq(tx)
+	if err != nil {
+		return msg, err
+	}
+	msg.Origin = nodeID
+	msg.UID = fmt.Sprintf("%s-%d", nodeID, seq)
+
+	res, err := tx.Exec("INSERT INTO messages (uid, origin, origin_seq, parent_uid, board, parent_id, title, author, owner, message, created_at, last_activity) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		msg.UID, msg.Origin, seq, parentUID, msg.Board, msg.ParentID, msg.Title, msg.Author, msg.Owner, msg.Message, msg.CreatedAt, msg.CreatedAt)
+	if err != nil {
+		return msg, err
+	}
+	if msg.ID, err = res.LastInsertId(); err != nil {
+		return msg, err
+	}
+	if msg.ParentID != 0 {
+		if _, err := tx.Exec("UPDATE messages SET replies = replies + 1, last_activity = MAX(last_activity, ?) WHERE id = ?", msg.CreatedAt, msg.ParentID); err != nil {
+			return msg, err
+		}
+	}
+	return msg, tx.Commit()
+}
+
+// updateBBSMessage stores an edit. Our own messages move to the next seq so
+// that peers fetch the new text; an edit to a message from another node
+// stays local, as we cannot sign it for its origin.
+func updateBBSMessage(msg BBSMessage) error {
+	tx, err := bbsDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE messages SET title = ?, message = ?, updated_at = ?, signature = '' WHERE id = ?", msg.Title, msg.Message, msg.UpdatedAt, msg.ID); err != nil {
+		return err
+	}
+	if msg.Origin == nodeID {
+		seq, err := nextBBSSeq(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE messages SET origin_seq = ? WHERE id = ?", seq, msg.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nextBBSSeq takes the next seq of this node for a new message, edit or
+// deletion.
+func nextBBSSeq(tx *sql.Tx) (int64, error) {
+	var seq int64
+	err := tx.QueryRow("INSERT INTO sync_state (origin, seq) VALUES (?, 1) ON CONFLICT(origin) DO UPDATE SET seq = seq + 1 RETURNING seq", nodeID).Scan(&seq)
+	return seq, err
+}
+
+func removeBBSMessage(msg BBSMessage) ([]BBSAttachment, error) {
+	tx, err := bbsDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, message_id, name, path, size, mime FROM attachments WHERE message_id IN (SELECT id FROM messages WHERE id = ? OR parent_id = ?)", msg.ID, msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := scanBBSAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM attachments WHERE message_id IN (SELECT id FROM messages WHERE id = ? OR parent_id = ?)", msg.ID, msg.ID); err != nil {
+		return nil, err
+	}
+	// Deleted messages leave a tombstone, so they are not fetched again. Ours
+	// take a new seq and reach the peers; those of other nodes stay local.
+	if _, err := tx.Exec("INSERT INTO deleted_messages (uid, origin, origin_seq) SELECT uid, origin, origin_seq FROM messages WHERE (id = ? OR parent_id = ?) AND uid != '' AND origin != ? ON CONFLICT(uid) DO NOTHING",
+		msg.ID, msg.ID, nodeID); err != nil {
+		return nil, err
+	}
+	rows, err = tx.Query("SELECT uid FROM messages WHERE (id = ? OR parent_id = ?) AND origin = ?", msg.ID, msg.ID, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	var own []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		own = append(own, uid)
+	}
+	rows.Close()
+	for _, uid := range own {
+		seq, err := nextBBSSeq(tx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO deleted_messages (uid, origin, origin_seq) VALUES (?, ?, ?) ON CONFLICT(uid) DO NOTHING", uid, nodeID, seq); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM messages WHERE id = ? OR parent_id = ?", msg.ID, msg.ID); err != nil {
+		return nil, err
+	}
+	if msg.ParentID != 0 {
+		if _, err := tx.Exec(`UPDATE messages SET
+			replies = (SELECT COUNT(*) FROM messages r WHERE r.parent_id = messages.id),
+			last_activity = MAX(created_at, COALESCE((SELECT MAX(created_at) FROM messages r WHERE r.parent_id = messages.id), ''))
+			WHERE id = ?`, msg.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	return attachments, tx.Commit()
+}
+
+func insertBBSAttachment(att BBSAttachment) (BBSAttachment, error) {
+	res, err := bbsDB.Exec("INSERT INTO attachments (message_id, name, path, size, mime) VALUES (?, ?, ?, ?, ?)",
+		att.MessageID, att.Name, att.Path, att.Size, att.Mime)
+	if err != nil {
+		return att, err
+	}
+	att.ID, err = res.LastInsertId()
+	return att, err
+}
+
+func queryBBSAttachments(ids []int64) (map[int64][]BBSAttachment, error) {
+	result := make(map[int64][]BBSAttachment)
+	if len(ids) == 0 {
+		return result, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	rows, err := bbsDB.Query("SELECT id, message_id, name, path, size, mime FROM attachments WHERE message_id IN ("+placeholders+") ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := scanBBSAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, att := range attachments {
+		result[att.MessageID] = append(result[att.MessageID], withAttachmentURLs(att))
+	}
+	return result, nil
+}
+
+func scanBBSAttachments(rows *sql.Rows) ([]BBSAttachment, error) {
+	defer rows.Close()
+	var attachments []BBSAttachment
+	for rows.Next() {
+		var a BBSAttachment
+		if err := rows.Scan(&a.ID, &a.MessageID, &a.Name, &a.Path, &a.Size, &a.Mime); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+func queryBBSBoards() ([]BBSBoard, error) {
+	rows, err := bbsDB.Query("SELECT board, SUM(parent_id = 0), COUNT(*) FROM messages GROUP BY board ORDER BY board")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	boards := []BBSBoard{{Name: bbsDefaultBoard}}
+	for rows.Next() {
+		var b BBSBoard
+		if err := rows.Scan(&b.Name, &b.Topics, &b.Messages); err != nil {
+			return nil, err
+		}
+		if b.Name == bbsDefaultBoard {
+			boards[0] = b
+		} else {
+			boards = append(boards, b)
+		}
+	}
+	return boards, rows.Err()
+}
+
+func queryBBSTopics(board string, page int) ([]BBSTopicView, int, error) {
+	var total int
+	if err := bbsDB.QueryRow("SELECT COUNT(*) FROM messages WHERE board = ? AND parent_id = 0", board).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	totalPages := max((total+bbsTopicsPerPage-1)/bbsTopicsPerPage, 1)
+	page = min(max(page, 1), totalPages)
+
+	rows, err := bbsDB.Query("SELECT "+bbsColumns+", replies, last_activity FROM messages WHERE board = ? AND parent_id = 0 ORDER BY last_activity DESC, id DESC LIMIT ? OFFSET ?",
+		board, bbsTopicsPerPage, (page-1)*bbsTopicsPerPage)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	topics := []BBSTopicView{}
+	for rows.Next() {
+		var t BBSTopicView
+		m := &t.BBSMessage
+		if err := rows.Scan(&m.ID, &m.UID, &m.Origin, &m.Board, &m.ParentID, &m.Title, &m.Author, &m.Owner, &m.Message, &m.CreatedAt, &m.UpdatedAt, &t.Replies, &t.LastActivity); err != nil {
+			return nil, 0, err
+		}
+		topics = append(topics, t)
+	}
+	return topics, totalPages, rows.Err()
+}
+
+func queryBBSReplies(topicID int64) ([]BBSMessage, error) {
+	rows, err := bbsDB.Query("SELECT "+bbsColumns+" FROM messages WHERE parent_id = ? ORDER BY id", topicID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replies []BBSMessage
+	for rows.Next() {
+		m, err := scanBBSMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, m)
+	}
+	return replies, rows.Err()
+}
+
+func ftsQuery(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		word = strings.ReplaceAll(word, `"`, "")
+		if word != "" {
+			terms = append(terms, `"`+word+`"*`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+func queryBBSSearch(query, board string, limit int) ([]BBSMessage, error) {
+	match := ftsQuery(query)
+	if match == "" {
+		return nil, nil
+	}
+	sqlQuery := "SELECT " + strings.ReplaceAll("m."+bbsColumns, ", ", ", m.") +
+		" FROM messages_fts JOIN messages m ON m.id = messages_fts.rowid WHERE messages_fts MATCH ?"
+	args := []interface{}{match}
+	if board != "" {
+		sqlQuery += " AND m.board = ?"
+		args = append(args, board)
+	}
+	sqlQuery += " ORDER BY rank LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := bbsDB.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []BBSMessage
+	for rows.Next() {
+		m, err := scanBBSMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, m)
+	}
+	return results, rows.Err()
+}
+
+func queryBBSSyncState() (map[string]int64, error) {
+	rows, err := bbsDB.Query("SELECT origin, seq FROM sync_state")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	state := make(map[string]int64)
+	for rows.Next() {
+		var origin string
+		var seq int64
+		if err := rows.Scan(&origin, &seq); err != nil {
+			return nil, err
+		}
+		state[origin] = seq
+	}
+	return state, rows.Err()
+}
+
+func advanceBBSSyncState(origin string, seq int64) error {
+	_, err := bbsDB.Exec("INSERT INTO sync_state (origin, seq) VALUES (?, ?) ON CONFLICT(origin) DO UPDATE SET seq = MAX(seq, excluded.seq)", origin, seq)
+	return err
+}
+
+// exportBBSMessages pages through messages and tombstones in (origin, seq)
+// order, so a cursor made of the highest seq per origin never skips a row.
+// With vouched, only rows up to our own cursor are sent: past it we may be
+// missing some, and a peer advancing its cursor over them would never fetch
+// the gap. Our own rows are signed on the way out; those of other nodes
+// carry the signature they came with, and are left out without one.
+func exportBBSMessages(since map[string]int64, limit int, vouched bool) ([]BBSSyncMessage, bool, error) {
+	filter := func(table string) (string, []interface{}) {
+		var known []string
+		args := []interface{}{nodeID}
+		var conditions []string
+		for origin, seq := range since {
+			conditions = append(conditions, "(origin = ? AND origin_seq > ?)")
+			args = append(args, origin, seq)
+			known = append(known, origin)
+		}
+		where := "uid != '' AND (origin = ? OR signature != '')"
+		if len(known) > 0 {
+			conditions = append(conditions, "origin NOT IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(known)), ", ")+")")
+			for _, origin := range known {
+				args = append(args, origin)
+			}
+			where += " AND (" + strings.Join(conditions, " OR ") + ")"
+		}
+		if vouched {
+			where += " AND origin_seq <= COALESCE((SELECT seq FROM sync_state WHERE sync_state.origin = " + table + ".origin), 0)"
+		}
+		return where, args
+	}
+	live, args := filter("messages")
+	gone, goneArgs := filter("deleted_messages")
+	args = append(append(args, goneArgs...), limit+1)
+
+	rows, err := bbsDB.Query(`SELECT id, uid, origin, origin_seq, parent_uid, board, title, author, message, created_at, updated_at, origin_key, signature, 0 FROM messages WHERE `+live+`
+		UNION ALL SELECT 0, uid, origin, origin_seq, '', '', '', '', '', '', '', origin_key, signature, 1 FROM deleted_messages WHERE `+gone+`
+		ORDER BY 3, 4 LIMIT ?`, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	messages := []BBSSyncMessage{}
+	for rows.Next() {
+		var id int64
+		var m BBSSyncMessage
+		if err := rows.Scan(&id, &m.UID, &m.Origin, &m.Seq, &m.ParentUID, &m.Board, &m.Title, &m.Author, &m.Message, &m.CreatedAt, &m.UpdatedAt, &m.Key, &m.Signature, &m.Deleted); err != nil {
+			return nil, false, err
+		}
+		if m.Origin == nodeID {
+			signBBSMessage(&m)
+		}
+		ids = append(ids, id)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	more := len(messages) > limit
+	if more {
+		messages, ids = messages[:limit], ids[:limit]
+	}
+
+	attachments, err := queryBBSAttachments(ids)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, id := range ids {
+		messages[i].Attachments = attachments[id]
+	}
+	return messages, more, nil
+}
+
+// importBBSMessage stores a message, edit or deletion from another node,
+// once it checks out against the key of its origin. It returns 0 when
+// nothing new was added and errBBSOrphan when the topic of a reply has not
+// arrived yet; the sync cursor is left to the caller.
+func importBBSMessage(m BBSSyncMessage) (int64, error) {
+	if !verifyBBSMessage(m) {
+		return 0, errBBSUnsigned
+	}
+	if m.Deleted {
+		return 0, importBBSDeletion(m)
+	}
+	tx, err := bbsDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var gone int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM deleted_messages WHERE uid IN (?, ?)", m.UID, m.ParentUID).Scan(&gone); err != nil {
+		return 0, err
+	}
+	if gone > 0 {
+		return 0, tx.Commit()
+	}
+	var seq int64
+	err = tx.QueryRow("SELECT origin_seq FROM messages WHERE uid = ?", m.UID).Scan(&seq)
+	if err == nil {
+		if m.Seq > seq {
+			if _, err := tx.Exec("UPDATE messages SET title = ?, message = ?, updated_at = ?, origin_seq = ?, origin_key = ?, signature = ? WHERE uid = ?",
+				m.Title, m.Message, m.UpdatedAt, m.Seq, m.Key, m.Signature, m.UID); err != nil {
+				return 0, err
+			}
+		}
+		return 0, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var parentID int64
+	if m.ParentUID != "" {
+		err := tx.QueryRow("SELECT id, board FROM messages WHERE uid = ? AND parent_id = 0", m.ParentUID).Scan(&parentID, &m.Board)
+		if err == sql.ErrNoRows {
+			return 0, errBBSOrphan
+		}
+		if err != nil {
+			return 0, err
+		}
+		m.Title = ""
+	}
+
+	res, err := tx.Exec("INSERT INTO messages (uid, origin, origin_seq, parent_uid, board, parent_id, title, author, message, created_at, updated_at, last_activity, origin_key, signature) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		m.UID, m.Origin, m.Seq, m.ParentUID, normalizeBoardName(m.Board), parentID, m.Title, m.Author, m.Message, m.CreatedAt, m.UpdatedAt, m.CreatedAt, m.Key, m.Signature)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if parentID != 0 {
+		if _, err := tx.Exec("UPDATE messages SET replies = replies + 1, last_activity = MAX(last_activity, ?) WHERE id = ?", m.CreatedAt, parentID); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// importBBSDeletion records the tombstone of a message and removes it, with
+// its replies and attachments, if we have it.
+func importBBSDeletion(m BBSSyncMessage) error {
+	if _, err := bbsDB.Exec("INSERT INTO deleted_messages (uid, origin, origin_seq, origin_key, signature) VALUES (?, ?, ?, ?, ?) ON CONFLICT(uid) DO NOTHING",
+		m.UID, m.Origin, m.Seq, m.Key, m.Signature); err != nil {
+		return err
+	}
+	var id int64
+	err := bbsDB.QueryRow("SELECT id FROM messages WHERE uid = ?", m.UID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	msg, err := getBBSMessage(id)
+	if err != nil {
+		return err
+	}
+	attachments, err := removeBBSMessage(msg)
+	if err != nil {
+		return err
+	}
+	removeBBSAttachments(attachments)
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bbsSyncBatchSize  = 200
+	bbsSyncMaxBatches = 50
+	bbsSyncInterval   = 30 * time.Second
+	bbsSyncMaxOrigins = 1000
+)
+
+var (
+	bbsSyncMutex  sync.Mutex
+	bbsSyncClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+func startBBSSync() {
+	if options.BBSPath == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(bbsSyncInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			syncBBSPeers()
+		}
+	}()
+}
+
+func syncBBSPeers() {
+	if !bbsSyncMutex.TryLock() {
+		return
+	}
+	defer bbsSyncMutex.Unlock()
+
+	for _, peer := range append(getDiscoveredPeers(), meshPeers()...) {
+		if err := pullBBSFromPeer(peer); err != nil {
+			appLogger.Printf("BBS sync with %s failed: %v", peer.Name, err)
+		}
+	}
+}
+
+func formatBBSSince(state map[string]int64) string {
+	var parts []string
+	for origin, seq := range state {
+		parts = append(parts, fmt.Sprintf("%s:%d", origin, seq))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseBBSSince reads the cursors a peer sends, keeping at most
+// bbsSyncMaxOrigins well formed ones.
+func parseBBSSince(value string) map[string]int64 {
+	since := make(map[string]int64)
+	for _, part := range strings.SplitN(value, ",", bbsSyncMaxOrigins+1) {
+		if len(since) >= bbsSyncMaxOrigins {
+			break
+		}
+		origin, seq, ok := strings.Cut(part, ":")
+		if !ok || !validNodeID(origin) {
+			continue
+		}
+		if n, err := strconv.ParseInt(seq, 10, 64); err == nil && n >= 0 {
+			since[origin] = n
+		}
+	}
+	return since
+}
+
+// bbsPayload is what the origin of a message signs: everything but its
+// attachments and local ids.
+func bbsPayload(m BBSSyncMessage) []byte {
+	data, _ := json.Marshal([]interface{}{"TAZ_BBS", m.UID, m.Origin, m.Seq, m.ParentUID, m.Board, m.Title, m.Author, m.Message, m.CreatedAt, m.UpdatedAt, m.Deleted})
+	return data
+}
+
+func signBBSMessage(m *BBSSyncMessage) {
+	m.Key = nodePublicKey()
+	m.Signature = hex.EncodeToString(ed25519.Sign(nodeKey, bbsPayload(*m)))
+}
+
+// verifyBBSMessage checks that a message was signed by the key of its
+// origin, pinning that key the first time the origin is seen.
+func verifyBBSMessage(m BBSSyncMessage) bool {
+	if !validNodeID(m.Origin) || !strings.HasPrefix(m.UID, m.Origin+"-") || m.Seq <= 0 {
+		return false
+	}
+	key := strings.ToLower(m.Key)
+	pub, err := hex.DecodeString(key)
+	sig, serr := hex.DecodeString(m.Signature)
+	if err != nil || serr != nil || len(pub) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(pub), bbsPayload(m), sig) {
+		return false
+	}
+	if m.Origin == nodeID {
+		return key == nodePublicKey()
+	}
+	return pinPeerKey(m.Origin, key, "bbs")
+}
+
+// pullBBSFromPeer pages through the peer feed. Paging follows every message
+// received, but the stored cursor of an origin stops before its first reply
+// whose topic is still missing, so the next pass asks for it again, and
+// never moves for a message its origin did not sign.
+func pullBBSFromPeer(peer Peer) error {
+	base := peerBase(peer)
+	imported := 0
+	since, err := queryBBSSyncState()
+	if err != nil {
+		return err
+	}
+	blocked := make(map[string]bool)
+	for i := 0; i < bbsSyncMaxBatches; i++ {
+		resp, err := bbsSyncClient.Get(base + "/bbs/api/sync?since=" + url.QueryEscape(formatBBSSince(since)))
+		if err != nil {
+			return err
+		}
+		var batch BBSSyncBatch
+		err = json.NewDecoder(resp.Body).Decode(&batch)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if err != nil {
+			return err
+		}
+		if batch.Node == nodeID {
+			return nil
+		}
+
+		cursors := make(map[string]int64)
+		for _, m := range batch.Messages {
+			if m.UID == "" || m.Origin == "" || m.Seq <= 0 {
+				continue
+			}
+			since[m.Origin] = max(since[m.Origin], m.Seq)
+			id, err := importBBSMessage(m)
+			if err == errBBSOrphan {
+				blocked[m.Origin] = true
+				continue
+			}
+			if err == errBBSUnsigned {
+				appLogger.Printf("BBS sync: ignored %s from %s: %v", m.UID, peer.Name, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !blocked[m.Origin] {
+				cursors[m.Origin] = m.Seq
+			}
+			if id == 0 {
+				continue
+			}
+			imported++
+			for _, att := range m.Attachments {
+				if err := fetchBBSAttachment(base, id, att); err != nil {
+					appLogger.Printf("BBS sync: failed to fetch %s from %s: %v", att.Path, peer.Name, err)
+				}
+			}
+		}
+		for origin, seq := range cursors {
+			if err := advanceBBSSyncState(origin, seq); err != nil {
+				return err
+			}
+		}
+		if !batch.More || len(batch.Messages) == 0 {
+			break
+		}
+	}
+	if imported > 0 {
+		appLogger.Printf("BBS sync: imported %d messages from %s", imported, peer.Name)
+	}
+	return nil
+}
+
+func fetchBBSAttachment(base string, messageID int64, att BBSAttachment) error {
+	name := bbsAttachmentName(att.Name)
+	if name == "" {
+		return fmt.Errorf("invalid name %q", att.Name)
+	}
+	resp, err := bbsSyncClient.Get(base + (&url.URL{Path: "/download/" + att.Path}).EscapedPath())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	_, err = storeBBSAttachment(messageID, name, resp.Body)
+	return err
+}
+
+func handleBBSSync(w http.ResponseWriter, r *http.Request) {
+	messages, more, err := exportBBSMessages(parseBBSSince(r.URL.Query().Get("since")), bbsSyncBatchSize, true)
+	if err != nil {
+		writeBBSAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, BBSSyncBatch{Node: nodeID, Messages: messages, More: more})
+}
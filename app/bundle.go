@@ -0,0 +1,485 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	bundlesDir       = "bundles"
+	bundleExtension  = ".tazbundle"
+	bundleVersion    = 1
+	bundleManifest   = "manifest.json"
+	bundleSignature  = "manifest.sig"
+	bundleExportSize = 500
+)
+
+var (
+	errBundleSignature = errors.New("bundle signature is not valid")
+	errBundleUntrusted = errors.New("bundle is signed by an untrusted key")
+	errBundleCorrupted = errors.New("bundle content does not match its manifest")
+)
+
+func isBundleFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), bundleExtension)
+}
+
+func exportBundle(folders []string) (string, BundleManifest, error) {
+	manifest := BundleManifest{
+		Version:   bundleVersion,
+		Node:      nodeID,
+		Name:      appLabel,
+		PublicKey: nodePublicKey(),
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Entries:   []BundleEntry{},
+	}
+
+	dir := filepath.Join(options.RootPath, bundlesDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", manifest, err
+	}
+	name := fmt.Sprintf("taz-%s-%s%s", nodeID, time.Now().Format("20060102-150405"), bundleExtension)
+	target := filepath.Join(dir, name)
+	tmp := target + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", manifest, err
+	}
+	defer os.Remove(tmp)
+	zw := zip.NewWriter(f)
+
+	addEntry := func(entry, src string, info os.FileInfo) error {
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		header := &zip.FileHeader{Name: entry, Method: zip.Deflate, Modified: info.ModTime()}
+		out, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(out, hash), in)
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, BundleEntry{
+			Name:    entry,
+			Size:    size,
+			SHA256:  hex.EncodeToString(hash.Sum(nil)),
+			ModTime: info.ModTime().Unix(),
+		})
+		return nil
+	}
+
+	if bbsDB != nil {
+		cursors, err := queryBBSSyncState()
+		if err != nil {
+			zw.Close()
+			f.Close()
+			return "", manifest, err
+		}
+		manifest.Cursors = cursors
+		since := make(map[string]int64)
+		for {
+			messages, more, err := exportBBSMessages(since, bundleExportSize, false)
+			if err != nil {
+				zw.Close()
+				f.Close()
+				return "", manifest, err
+			}
+			for _, m := range messages {
+				since[m.Origin] = max(since[m.Origin], m.Seq)
+				for _, att := range m.Attachments {
+					src := filepath.Join(options.RootPath, filepath.FromSlash(att.Path))
+					info, err := os.Stat(src)
+					if err != nil {
+						continue
+					}
+					if err := addEntry(path.Join("attachments", m.UID, att.Name), src, info); err != nil {
+						zw.Close()
+						f.Close()
+						return "", manifest, err
+					}
+				}
+			}
+			manifest.Messages = append(manifest.Messages, messages...)
+			if !more {
+				break
+			}
+		}
+	}
+
+	sysAbs, _ := filepath.Abs(options.SystemPath)
+	rootAbs, _ := filepath.Abs(options.RootPath)
+	skip := map[string]bool{
+		sysAbs:                             true,
+		filepath.Join(rootAbs, bundlesDir): true,
+		filepath.Join(rootAbs, bbsAttachmentsDir): true,
+	}
+	for _, folder := range folders {
+		folderAbs, err := getSafePath(folder)
+		if err != nil {
+			continue
+		}
+		rel, _ := filepath.Rel(rootAbs, folderAbs)
+		manifest.Folders = append(manifest.Folders, filepath.ToSlash(rel))
+		err = filepath.WalkDir(folderAbs, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if skip[p] {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(rootAbs, p)
+			return addEntry(path.Join("files", filepath.ToSlash(rel)), p, info)
+		})
+		if err != nil {
+			zw.Close()
+			f.Close()
+			return "", manifest, err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = writeZipEntry(zw, bundleManifest, data)
+	}
+	if err == nil {
+		err = writeZipEntry(zw, bundleSignature, []byte(hex.EncodeToString(ed25519.Sign(nodeKey, data))))
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", manifest, err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return "", manifest, err
+	}
+	return path.Join(bundlesDir, name), manifest, nil
+}
+
+func writeZipEntry(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readZipEntry(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, 64<<20))
+}
+
+func hashZipEntry(file *zip.File) (string, int64, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, rc)
+	return hex.EncodeToString(hash.Sum(nil)), size, err
+}
+
+func openBundle(bundlePath string) (*zip.ReadCloser, BundleManifest, map[string]*zip.File, error) {
+	var manifest BundleManifest
+	zr, err := zip.OpenReader(bundlePath)
+	if err != nil {
+		return nil, manifest, nil, err
+	}
+	files := make(map[string]*zip.File)
+	for _, file := range zr.File {
+		files[file.Name] = file
+	}
+
+	fail := func(err error) (*zip.ReadCloser, BundleManifest, map[string]*zip.File, error) {
+		zr.Close()
+		return nil, manifest, nil, err
+	}
+	if files[bundleManifest] == nil || files[bundleSignature] == nil {
+		return fail(errBundleSignature)
+	}
+	data, err := readZipEntry(files[bundleManifest])
+	if err != nil {
+		return fail(err)
+	}
+	sigHex, err := readZipEntry(files[bundleSignature])
+	if err != nil {
+		return fail(err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fail(err)
+	}
+	pub, err := hex.DecodeString(manifest.PublicKey)
+	sig, serr := hex.DecodeString(strings.TrimSpace(string(sigHex)))
+	if err != nil || serr != nil || len(pub) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+		return fail(errBundleSignature)
+	}
+	if key := strings.ToLower(manifest.PublicKey); key != nodePublicKey() && !loadTrustedKeys()[key] {
+		return fail(errBundleUntrusted)
+	}
+
+	for _, entry := range manifest.Entries {
+		file := files[entry.Name]
+		if file == nil {
+			return fail(errBundleCorrupted)
+		}
+		sum, size, err := hashZipEntry(file)
+		if err != nil || sum != entry.SHA256 || size != entry.Size {
+			return fail(errBundleCorrupted)
+		}
+	}
+	return zr, manifest, files, nil
+}
+
+func importBundle(bundlePath string) (BundleManifest, int, int, error) {
+	zr, manifest, files, err := openBundle(bundlePath)
+	if err != nil {
+		return manifest, 0, 0, err
+	}
+	defer zr.Close()
+
+	messages := 0
+	if bbsDB != nil {
+		// Replies may come before topics from another origin: retry them
+		// while that brings anything in.
+		pending := manifest.Messages
+		orphans := make(map[string]int64)
+		for len(pending) > 0 {
+			var retry []BBSSyncMessage
+			clear(orphans)
+			for _, m := range pending {
+				if m.UID == "" || m.Origin == "" || m.Seq <= 0 {
+					continue
+				}
+				id, err := importBBSMessage(m)
+				if err == errBBSUnsigned {
+					appLogger.Printf("Bundle: ignored %s: %v", m.UID, err)
+					continue
+				}
+				if err == errBBSOrphan {
+					retry = append(retry, m)
+					if seq, ok := orphans[m.Origin]; !ok || m.Seq < seq {
+						orphans[m.Origin] = m.Seq
+					}
+					continue
+				}
+				if err != nil {
+					return manifest, messages, 0, err
+				}
+				if id == 0 {
+					continue
+				}
+				messages++
+				if err := importBundleAttachments(files, id, m); err != nil {
+					return manifest, messages, 0, err
+				}
+			}
+			if len(retry) == len(pending) {
+				break
+			}
+			pending = retry
+		}
+		// The bundle holds every message up to the cursors of its node, so
+		// ours can follow them, short of any reply still missing its topic.
+		for origin, seq := range manifest.Cursors {
+			if orphan, ok := orphans[origin]; ok {
+				seq = min(seq, orphan-1)
+			}
+			if err := advanceBBSSyncState(origin, seq); err != nil {
+				return manifest, messages, 0, err
+			}
+		}
+	}
+
+	written := 0
+	for _, entry := range manifest.Entries {
+		rel, ok := strings.CutPrefix(entry.Name, "files/")
+		if !ok {
+			continue
+		}
+		changed, err := importBundleFile(manifest, entry, rel, files[entry.Name])
+		if err != nil {
+			return manifest, messages, written, err
+		}
+		if changed {
+			written++
+		}
+	}
+	return manifest, messages, written, nil
+}
+
+func importBundleAttachments(files map[string]*zip.File, id int64, m BBSSyncMessage) error {
+	for _, att := range m.Attachments {
+		file := files[path.Join("attachments", m.UID, att.Name)]
+		name := bbsAttachmentName(att.Name)
+		if file == nil || name == "" {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		_, err = storeBBSAttachment(id, name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const bundleMaxConflicts = 100
+
+// importBundleFile writes a bundle file unless the tree already holds it.
+// When the local file differs, it goes next to it as a conflict copy, numbered
+// if earlier copies from the same node differ too.
+func importBundleFile(manifest BundleManifest, entry BundleEntry, rel string, file *zip.File) (bool, error) {
+	target, err := peerSafePath(rel)
+	if err != nil {
+		appLogger.Printf("Bundle: skipped %s: %v", rel, err)
+		return false, nil
+	}
+
+	conflict := bundleConflictPath(target, manifest.Node)
+	for i := 0; i <= bundleMaxConflicts; i++ {
+		candidate := target
+		if i > 0 {
+			candidate = conflict
+		}
+		if i > 1 {
+			ext := filepath.Ext(conflict)
+			candidate = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(conflict, ext), i, ext)
+		}
+		sum, err := fileSHA256(candidate)
+		if os.IsNotExist(err) {
+			if i > 0 {
+				appLogger.Printf("Bundle: %s differs locally, saved the copy from %s as %s", rel, manifest.Name, candidate)
+			}
+			return true, writeBundleFile(candidate, entry, file)
+		}
+		if err != nil {
+			return false, err
+		}
+		if sum == entry.SHA256 {
+			return false, nil
+		}
+	}
+	appLogger.Printf("Bundle: skipped %s, too many conflict copies", rel)
+	return false, nil
+}
+
+func bundleConflictPath(target, node string) string {
+	if len(node) > 8 {
+		node = node[:8]
+	}
+	ext := filepath.Ext(target)
+	return strings.TrimSuffix(target, ext) + "." + node + ext
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func writeBundleFile(target string, entry BundleEntry, file *zip.File) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if entry.ModTime > 0 {
+		mtime := time.Unix(entry.ModTime, 0)
+		os.Chtimes(target, mtime, mtime)
+	}
+	return nil
+}
+
+func handleBundleExport(r *http.Request) (string, string) {
+	var folders []string
+	if item := r.FormValue("item"); item != "" {
+		folders = append(folders, item)
+	}
+	appLogger.Printf("BUNDLE by %s: exporting %v", r.RemoteAddr, folders)
+	name, manifest, err := exportBundle(folders)
+	if err != nil {
+		appLogger.Printf("Bundle export failed: %v", err)
+		return "", "Failed to create bundle."
+	}
+	return fmt.Sprintf("Bundle '%s' created with %d messages and %d files.", name, len(manifest.Messages), len(manifest.Entries)), ""
+}
+
+func handleBundleImport(r *http.Request) (string, string) {
+	item := r.FormValue("item")
+	appLogger.Printf("BUNDLE by %s: importing '%s'", r.RemoteAddr, item)
+	safePath, err := getSafePath(item)
+	if err != nil || !isBundleFile(safePath) {
+		return "", "Invalid bundle path."
+	}
+	manifest, messages, files, err := importBundle(safePath)
+	if err != nil {
+		appLogger.Printf("Bundle import of %s failed: %v", item, err)
+		return "", fmt.Sprintf("Failed to import bundle: %v.", err)
+	}
+	return fmt.Sprintf("Imported bundle from %s (%s, key %.16s): %d new messages, %d new files.", manifest.Name, manifest.Node, manifest.PublicKey, messages, files), ""
+}
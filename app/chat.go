@@ -0,0 +1,287 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	chatReplaySize   = 50
+	chatPageSize     = 50
+	chatMaxPageSize  = 200
+	chatMaxMessage   = 2000
+	chatMaxSender    = 32
+	chatTypeDefault  = "chat"
+	chatHistoryQuery = "SELECT id, sender, message, type, created_at FROM messages WHERE room = ?"
+)
+
+var chatDB *sql.DB
+
+func openChatStore() error {
+	db, err := sql.Open("sqlite", options.ChatPath+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS messages (
+			id INTEGER PRIMARY KEY,
+			sender TEXT NOT NULL,
+			message TEXT NOT NULL,
+			type TEXT NOT NULL DEFAULT 'chat',
+			created_at INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS direct_messages (
+			id INTEGER PRIMARY KEY,
+			sender TEXT NOT NULL,
+			recipient TEXT NOT NULL COLLATE NOCASE,
+			message TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			delivered INTEGER NOT NULL DEFAULT 0
+		)`,
+		"CREATE INDEX IF NOT EXISTS direct_messages_pending ON direct_messages(recipient, delivered)",
+		`CREATE TABLE IF NOT EXISTS chat_names (
+			name TEXT PRIMARY KEY COLLATE NOCASE,
+			identity TEXT NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS rooms (
+			name TEXT PRIMARY KEY,
+			password TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL
+		)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	var hasRoom int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name = 'room'").Scan(&hasRoom); err != nil {
+		db.Close()
+		return err
+	}
+	if hasRoom == 0 {
+		if _, err := db.Exec("ALTER TABLE messages ADD COLUMN room TEXT NOT NULL DEFAULT '" + defaultRoom + "'"); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS messages_room ON messages(room, id)"); err != nil {
+		db.Close()
+		return err
+	}
+
+	var hasTalkTime int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('rooms') WHERE name = 'talk_time'").Scan(&hasTalkTime); err != nil {
+		db.Close()
+		return err
+	}
+	if hasTalkTime == 0 {
+		if _, err := db.Exec("ALTER TABLE rooms ADD COLUMN talk_time INTEGER NOT NULL DEFAULT 0"); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	var hasIdentity int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('direct_messages') WHERE name = 'recipient_identity'").Scan(&hasIdentity); err != nil {
+		db.Close()
+		return err
+	}
+	if hasIdentity == 0 {
+		if _, err := db.Exec("ALTER TABLE direct_messages ADD COLUMN recipient_identity TEXT NOT NULL DEFAULT ''"); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS direct_messages_identity ON direct_messages(recipient_identity, delivered)"); err != nil {
+		db.Close()
+		return err
+	}
+	chatDB = db
+	return nil
+}
+
+func getRoomPassword(name string) (string, error) {
+	if chatDB == nil {
+		return "", nil
+	}
+	var password string
+	err := chatDB.QueryRow("SELECT password FROM rooms WHERE name = ?", name).Scan(&password)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return password, err
+}
+
+func getRoomTalkTime(name string) (int, error) {
+	if chatDB == nil {
+		return 0, nil
+	}
+	var talkTime int
+	err := chatDB.QueryRow("SELECT talk_time FROM rooms WHERE name = ?", name).Scan(&talkTime)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return talkTime, err
+}
+
+func queryRooms() ([]RoomInfo, error) {
+	if chatDB == nil {
+		return nil, nil
+	}
+	rows, err := chatDB.Query("SELECT name, password != '', talk_time FROM rooms ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []RoomInfo
+	for rows.Next() {
+		var room RoomInfo
+		if err := rows.Scan(&room.Name, &room.Protected, &room.TalkTime); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func saveRoom(name, password string, talkTime int) error {
+	_, err := chatDB.Exec("INSERT INTO rooms (name, password, talk_time, created_at) VALUES (?, ?, ?, ?) ON CONFLICT(name) DO UPDATE SET password = excluded.password, talk_time = excluded.talk_time",
+		name, password, talkTime, time.Now().Unix())
+	return err
+}
+
+func deleteRoom(name string) error {
+	_, err := chatDB.Exec("DELETE FROM rooms WHERE name = ?", name)
+	return err
+}
+
+// chatFrame rebuilds a text frame from a room client before it is relayed:
+// the sender is the name the server knows the client by, never the one in
+// the frame, and chat messages are stored for the history. Frames that are
+// not chat messages give nil and are dropped.
+func chatFrame(room, sender string, data []byte) []byte {
+	var msg ChatMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil
+	}
+	if msg.Type == "" {
+		msg.Type = chatTypeDefault
+	}
+	msg.ID = 0
+	msg.Sender = truncateString(sender, chatMaxSender)
+	msg.Message = truncateString(strings.TrimSpace(msg.Message), chatMaxMessage)
+	msg.Time = time.Now().Unix()
+	msg.History = false
+
+	if chatDB != nil && msg.Type == chatTypeDefault && msg.Message != "" {
+		res, err := chatDB.Exec("INSERT INTO messages (room, sender, message, type, created_at) VALUES (?, ?, ?, ?, ?)", room, msg.Sender, msg.Message, msg.Type, msg.Time)
+		if err != nil {
+			appLogger.Printf("Chat: failed to store message: %v", err)
+		} else {
+			msg.ID, _ = res.LastInsertId()
+		}
+	}
+	out, err := json.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func queryChatHistory(room string, before int64, limit int) ([]ChatMessage, bool, error) {
+	query := chatHistoryQuery
+	args := []interface{}{room}
+	if before > 0 {
+		query += " AND id < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := chatDB.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages := []ChatMessage{}
+	for rows.Next() {
+		var m ChatMessage
+		if err := rows.Scan(&m.ID, &m.Sender, &m.Message, &m.Type, &m.Time); err != nil {
+			return nil, false, err
+		}
+		m.History = true
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, more, nil
+}
+
+func chatReplay(room string) [][]byte {
+	if chatDB == nil {
+		return nil
+	}
+	messages, _, err := queryChatHistory(room, 0, chatReplaySize)
+	if err != nil {
+		appLogger.Printf("Chat: failed to load history: %v", err)
+		return nil
+	}
+	var frames [][]byte
+	for _, m := range messages {
+		if data, err := json.Marshal(m); err == nil {
+			frames = append(frames, data)
+		}
+	}
+	return frames
+}
+
+func chatHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if options.RoomAuth && options.Password != "" && !isAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	if chatDB == nil {
+		writeJSONError(w, http.StatusNotFound, "chat history disabled")
+		return
+	}
+	room := normalizeRoomName(r.URL.Query().Get("name"))
+	if !checkRoomAccess(r, room) {
+		writeJSONError(w, http.StatusForbidden, "room password required")
+		return
+	}
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = chatPageSize
+	}
+	limit = min(limit, chatMaxPageSize)
+
+	messages, more, err := queryChatHistory(room, before, limit)
+	if err != nil {
+		appLogger.Printf("Chat: failed to load history: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"messages": messages,
+		"has_more": more,
+	})
+}
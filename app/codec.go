@@ -0,0 +1,190 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Room audio codecs. "pcm" is raw float32 at mixSampleRate and is what older
+// clients send. "adpcm" is IMA ADPCM at adpcmSampleRate, 4 bits per sample,
+// with every frame carrying its own predictor and step index so a lost frame
+// never desynchronizes the decoder.
+const (
+	codecPCM        = "pcm"
+	codecADPCM      = "adpcm"
+	adpcmSampleRate = 16000
+	adpcmRatio      = mixSampleRate / adpcmSampleRate
+	adpcmHeaderSize = 4
+)
+
+var adpcmIndexTable = [8]int{-1, -1, -1, -1, 2, 4, 6, 8}
+
+var adpcmStepTable = [89]int{
+	7, 8, 9, 10, 11, 12, 13, 14, 16, 17, 19, 21, 23, 25, 28, 31, 34, 37, 41, 45,
+	50, 55, 60, 66, 73, 80, 88, 97, 107, 118, 130, 143, 157, 173, 190, 209, 230,
+	253, 279, 307, 337, 371, 408, 449, 494, 544, 598, 658, 724, 796, 876, 963,
+	1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066, 2272, 2499, 2749, 3024, 3327,
+	3660, 4026, 4428, 4871, 5358, 5894, 6484, 7132, 7845, 8630, 9493, 10442, 11487,
+	12635, 13899, 15289, 16818, 18500, 20350, 22385, 24623, 27086, 29794, 32767,
+}
+
+func negotiateCodec(preferred string) string {
+	for _, codec := range strings.Split(preferred, ",") {
+		switch codec = strings.ToLower(strings.TrimSpace(codec)); codec {
+		case codecPCM, codecADPCM:
+			return codec
+		}
+	}
+	return codecPCM
+}
+
+func codecRate(codec string) int {
+	if codec == codecADPCM {
+		return adpcmSampleRate
+	}
+	return mixSampleRate
+}
+
+func decodeAudio(codec string, data []byte) []float32 {
+	if codec == codecADPCM {
+		return upsample(adpcmDecode(data))
+	}
+	return decodePCM(data)
+}
+
+func encodeAudio(codec string, samples []float32) []byte {
+	if codec == codecADPCM {
+		return adpcmEncode(downsample(samples))
+	}
+	return encodePCM(samples)
+}
+
+func downsample(samples []float32) []float32 {
+	out := make([]float32, len(samples)/adpcmRatio)
+	for i := range out {
+		var sum float32
+		for _, s := range samples[i*adpcmRatio : (i+1)*adpcmRatio] {
+			sum += s
+		}
+		out[i] = sum / adpcmRatio
+	}
+	return out
+}
+
+func upsample(samples []float32) []float32 {
+	out := make([]float32, len(samples)*adpcmRatio)
+	for i, s := range samples {
+		next := s
+		if i+1 < len(samples) {
+			next = samples[i+1]
+		}
+		for j := 0; j < adpcmRatio; j++ {
+			out[i*adpcmRatio+j] = s + (next-s)*float32(j)/adpcmRatio
+		}
+	}
+	return out
+}
+
+func clampInt16(v int) int {
+	return max(-32768, min(32767, v))
+}
+
+func adpcmEncode(samples []float32) []byte {
+	pcm := make([]int, len(samples))
+	for i, s := range samples {
+		pcm[i] = clampInt16(int(s * 32767))
+	}
+	if len(pcm) == 0 {
+		return nil
+	}
+
+	// Start from a step size matching the opening slope to avoid a ramp-up click.
+	diff, n := 0, min(8, len(pcm)-1)
+	for i := 0; i < n; i++ {
+		diff += abs(pcm[i+1] - pcm[i])
+	}
+	index := 0
+	if n > 0 {
+		for index < len(adpcmStepTable)-1 && adpcmStepTable[index] < diff/n {
+			index++
+		}
+	}
+
+	predictor := pcm[0]
+	data := make([]byte, adpcmHeaderSize+(len(pcm)+1)/2)
+	binary.LittleEndian.PutUint16(data, uint16(int16(predictor)))
+	data[2] = byte(index)
+	for i, sample := range pcm {
+		step := adpcmStepTable[index]
+		delta := sample - predictor
+		var nibble int
+		if delta < 0 {
+			nibble = 8
+			delta = -delta
+		}
+		if delta >= step {
+			nibble |= 4
+			delta -= step
+		}
+		if delta >= step/2 {
+			nibble |= 2
+			delta -= step / 2
+		}
+		if delta >= step/4 {
+			nibble |= 1
+		}
+		predictor, index = adpcmStep(predictor, index, nibble)
+		if i%2 == 0 {
+			data[adpcmHeaderSize+i/2] = byte(nibble)
+		} else {
+			data[adpcmHeaderSize+i/2] |= byte(nibble << 4)
+		}
+	}
+	return data
+}
+
+func adpcmDecode(data []byte) []float32 {
+	if len(data) <= adpcmHeaderSize {
+		return nil
+	}
+	predictor := int(int16(binary.LittleEndian.Uint16(data)))
+	index := min(int(data[2]), len(adpcmStepTable)-1)
+	body := data[adpcmHeaderSize:]
+	samples := make([]float32, len(body)*2)
+	for i := range samples {
+		nibble := int(body[i/2] >> (4 * (i % 2)) & 0x0f)
+		predictor, index = adpcmStep(predictor, index, nibble)
+		samples[i] = float32(predictor) / 32767
+	}
+	return samples
+}
+
+func adpcmStep(predictor, index, nibble int) (int, int) {
+	step := adpcmStepTable[index]
+	diff := step >> 3
+	if nibble&4 != 0 {
+		diff += step
+	}
+	if nibble&2 != 0 {
+		diff += step >> 1
+	}
+	if nibble&1 != 0 {
+		diff += step >> 2
+	}
+	if nibble&8 != 0 {
+		predictor -= diff
+	} else {
+		predictor += diff
+	}
+	index = max(0, min(len(adpcmStepTable)-1, index+adpcmIndexTable[nibble&7]))
+	return clampInt16(predictor), index
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
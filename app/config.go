@@ -31,6 +31,9 @@ var (
 	options       Options
 	urlList       stringSlice
 	dhcpList      stringSlice
+	originList    stringSlice
+	syncList      stringSlice
+	discoveryList stringSlice
 	uptime        = time.Now()
 )
 
@@ -43,17 +46,33 @@ type Options struct {
 	LogEnabled     bool     `json:"log_enabled"`
 	LogFile        string   `json:"log_file"`
 	BBSPath        string   `json:"bbs_path"`
+	PlacesPath     string   `json:"places_path"`
+	RoutingPath    string   `json:"routing_path"`
+	ChatPath       string   `json:"chat_path"`
 	URLs           []string `json:"urls"`
 	DHCPInterfaces []string `json:"dhcp_interfaces"`
 	DNS            string   `json:"dns"`
 	Name           string   `json:"name"`
+	RoomAuth       bool     `json:"room_auth"`
+	RoomOrigins    []string `json:"room_origins"`
+	SyncFolders    []string `json:"sync_folders"`
+	MeshKey        string   `json:"mesh_key"`
+	MDNSName       string   `json:"mdns_name"`
+	MeshHops       int      `json:"mesh_hops"`
+	Discovery      string   `json:"discovery"`
+	DiscoveryPort  int      `json:"discovery_port"`
+	DiscoveryPeers []string `json:"discovery_peers"`
+	OpenOffers     bool     `json:"open_offers"`
 }
 
 func initOptions() {
 	options = Options{
-		WebHost:  "localhost",
-		WebPort:  35248,
-		RootPath: "files",
+		WebHost:       "localhost",
+		WebPort:       35248,
+		RootPath:      "files",
+		MeshHops:      4,
+		Discovery:     "auto",
+		DiscoveryPort: 35248,
 	}
 
 	configFile := flag.String("config", "", "Path to JSON config file")
@@ -68,6 +87,16 @@ func initOptions() {
 	flag.Var(&dhcpList, "dhcp", "DHCP interface and subnet (e.g., 'wlan0:10.35.2.0/24'). Repeatable.")
 	dns := flag.String("dns", options.DNS, "Enable DNS sinkhole. Optionally provide an upstream IP (e.g., '8.8.8.8').")
 	name := flag.String("name", options.Name, "This TAZ name")
+	roomAuth := flag.Bool("room-auth", options.RoomAuth, "Require login for the audio/chat room when a password is set")
+	flag.Var(&originList, "room-origin", "Extra allowed origin for the room websocket (e.g., 'https://example.org'). Repeatable.")
+	meshKey := flag.String("mesh-key", options.MeshKey, "Shared secret; only nodes with the same key discover each other")
+	discovery := flag.String("discovery", options.Discovery, "Node discovery: 'auto' (when listening on 0.0.0.0 or a private address), 'on' or 'off'")
+	discoveryPort := flag.Int("discovery-port", options.DiscoveryPort, "UDP port shared by all nodes for discovery")
+	flag.Var(&discoveryList, "discovery-peer", "Address asked directly for discovery, for nodes beyond the broadcast domain (e.g., '10.1.2.3' or '10.1.2.3:35248'). Repeatable.")
+	meshHops := flag.Int("mesh-hops", options.MeshHops, "Maximum number of nodes a relayed request may cross")
+	mdnsName := flag.String("mdns-name", options.MDNSName, "mDNS host name advertised as <name>.local (defaults to the TAZ name, 'off' to disable)")
+	openOffers := flag.Bool("open-offers", options.OpenOffers, "Accept files pushed by any node, not only those in sys/trusted_keys")
+	flag.Var(&syncList, "sync", "Folder to keep in sync with discovered peers. Format: 'folder[:two-way|mirror|send]'. Repeatable.")
 
 	flag.Parse()
 
@@ -116,6 +145,36 @@ func initOptions() {
 	if isFlagSet["dns"] {
 		options.DNS = *dns
 	}
+	if isFlagSet["room-auth"] {
+		options.RoomAuth = *roomAuth
+	}
+	if isFlagSet["room-origin"] {
+		options.RoomOrigins = originList
+	}
+	if isFlagSet["sync"] {
+		options.SyncFolders = syncList
+	}
+	if isFlagSet["mesh-key"] {
+		options.MeshKey = *meshKey
+	}
+	if isFlagSet["discovery"] {
+		options.Discovery = *discovery
+	}
+	if isFlagSet["discovery-port"] {
+		options.DiscoveryPort = *discoveryPort
+	}
+	if isFlagSet["discovery-peer"] {
+		options.DiscoveryPeers = discoveryList
+	}
+	if isFlagSet["mesh-hops"] {
+		options.MeshHops = *meshHops
+	}
+	if isFlagSet["open-offers"] {
+		options.OpenOffers = *openOffers
+	}
+	if isFlagSet["mdns-name"] {
+		options.MDNSName = *mdnsName
+	}
 	if isFlagSet["name"] {
 		options.Name = *name
 		appLabel = appName + "-" + *name
@@ -142,4 +201,7 @@ func initOptions() {
 	}
 
 	options.BBSPath = filepath.Join(options.SystemPath, "bbs.db")
+	options.PlacesPath = filepath.Join(options.SystemPath, "places.db")
+	options.RoutingPath = filepath.Join(options.SystemPath, "routing")
+	options.ChatPath = filepath.Join(options.SystemPath, "chat.db")
 }
@@ -3,98 +3,569 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+)
+
+const (
+	discoveryNonceTTL  = 30 * time.Second
+	announcementTTL    = 30 * time.Second
+	announcementFormat = 1
 )
 
 type Peer struct {
-	IP       string `json:"ip"`
-	Name     string `json:"name"`
-	Version  string `json:"version"`
-	LastSeen int64  `json:"last_seen"`
+	IP             string   `json:"ip"`
+	Port           int      `json:"port"`
+	Name           string   `json:"name"`
+	Version        string   `json:"version"`
+	Node           string   `json:"node"`
+	PublicKey      string   `json:"public_key"`
+	TLSFingerprint string   `json:"tls_fingerprint,omitempty"`
+	Features       []string `json:"features"`
+	FreeBytes      uint64   `json:"free_bytes"`
+	Users          int      `json:"users"`
+	LastSeen       int64    `json:"last_seen"`
+}
+
+// discoveryRequest remembers a TAZ_DISCOVER we sent. Each node may answer
+// it once, and a request sent to a single host only takes replies from it.
+type discoveryRequest struct {
+	created  time.Time
+	target   net.IP
+	answered map[string]bool
+}
+
+// Announcement is the versioned JSON carried inside TAZ_IDENT.
+type Announcement struct {
+	Format   int      `json:"v"`
+	Port     int      `json:"port"`
+	TLS      string   `json:"tls,omitempty"`
+	Features []string `json:"features"`
+	Free     uint64   `json:"free"`
+	Users    int      `json:"users"`
 }
 
 var (
 	peers      = make(map[string]Peer)
 	peersMutex = sync.RWMutex{}
+
+	discoveryNonces   = make(map[string]*discoveryRequest)
+	discoveryNoncesMu sync.Mutex
+
+	knownPeers   map[string]string
+	knownPeersMu sync.Mutex
+
+	announcement   []byte
+	announcementMu sync.RWMutex
+
+	discoveryConn   *net.UDPConn
+	discoveryConn6  *net.UDPConn
+	discoveryGroup6 = net.ParseIP("ff02::114")
+
+	errIdentFormat    = errors.New("malformed announcement")
+	errIdentSignature = errors.New("invalid signature")
+	errIdentMesh      = errors.New("wrong mesh key")
+	errIdentNonce     = errors.New("unsolicited announcement")
+	errIdentPinned    = errors.New("key does not match the pinned key")
 )
 
-func startDiscovery() {
+func discoveryEnabled() bool {
+	switch options.Discovery {
+	case "on":
+		return true
+	case "off":
+		return false
+	}
 	host := options.WebHost
-	if host != "0.0.0.0" && !isPrivateIP(host) {
+	return isWildcardHost(host) || isPrivateIP(host)
+}
+
+// startDiscovery listens on the shared discovery port for requests, by
+// broadcast on IPv4 and multicast on IPv6, and asks from a socket of its own
+// so that answers reach this node even when others share the host.
+func startDiscovery() {
+	if !discoveryEnabled() || options.DiscoveryPort <= 0 {
 		return
 	}
 
-	addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf(":%d", options.WebPort))
-	conn, err := net.ListenUDP("udp4", addr)
+	lc := net.ListenConfig{Control: reuseAddr}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", options.DiscoveryPort))
 	if err != nil {
 		appLogger.Printf("Discovery: Error binding UDP: %v", err)
 		return
 	}
+	listener := pc.(*net.UDPConn)
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		appLogger.Printf("Discovery: Error binding UDP: %v", err)
+		listener.Close()
+		return
+	}
+	discoveryConn = client
+	go serveDiscovery(listener)
+	go serveDiscovery(client)
 
-	appLogger.Printf("Discovery started on port %d\n", options.WebPort)
-
-	go func() {
-		defer conn.Close()
-
-		go func() {
-			ticker := time.NewTicker(10 * time.Second)
-			defer ticker.Stop()
-			for range ticker.C {
-				broadcastShout(conn)
-				cleanupOldPeers()
+	if client6, err := net.ListenUDP("udp6", &net.UDPAddr{}); err == nil {
+		discoveryConn6 = client6
+		go serveDiscovery(client6)
+		lc6 := net.ListenConfig{Control: reuseAddrV6Only}
+		if pc, err := lc6.ListenPacket(context.Background(), "udp6", fmt.Sprintf("[::]:%d", options.DiscoveryPort)); err == nil {
+			go serveDiscovery(pc.(*net.UDPConn))
+		}
+		for _, ifi := range discoveryInterfaces(net.FlagMulticast) {
+			if conn, err := net.ListenMulticastUDP("udp6", &ifi, &net.UDPAddr{IP: discoveryGroup6, Port: options.DiscoveryPort}); err == nil {
+				go serveDiscovery(conn)
 			}
-		}()
+		}
+	}
+
+	appLogger.Printf("Discovery started on port %d\n", options.DiscoveryPort)
+	startAnnouncements()
+	startMDNS()
 
-		buf := make([]byte, 1024)
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
 		for {
-			n, remoteAddr, err := conn.ReadFromUDP(buf)
+			broadcastShout()
+			<-ticker.C
+			cleanupOldPeers()
+		}
+	}()
+}
+
+func serveDiscovery(conn *net.UDPConn) {
+	defer conn.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			appLogger.Printf("Discovery socket error: %v", err)
+			return
+		}
+
+		msg := string(buf[:n])
+		if msg == "TAZ_DISCOVER" || strings.HasPrefix(msg, "TAZ_DISCOVER|") {
+			if nonce, ok := parseDiscover(msg); ok {
+				conn.WriteToUDP(identMessage(nonce), remoteAddr)
+			}
+		} else if strings.HasPrefix(msg, "TAZ_IDENT|") {
+			peer, err := parseIdent(msg, remoteAddr.IP)
 			if err != nil {
-				appLogger.Printf("Discovery socket error: %v", err)
-				return
+				appLogger.Printf("Discovery: ignored announcement from %s: %v", remoteAddr.IP, err)
+				continue
 			}
-
-			msg := string(buf[:n])
-			if msg == "TAZ_DISCOVER" {
-				resp := fmt.Sprintf("TAZ_IDENT|%s|%s", appLabel, appVersion)
-				conn.WriteToUDP([]byte(resp), remoteAddr)
-			} else if strings.HasPrefix(msg, "TAZ_IDENT|") {
-				parts := strings.Split(msg, "|")
-				if len(parts) >= 3 {
-					updatePeer(remoteAddr.IP.String(), parts[1], parts[2])
-				}
+			if peer.Node != nodeID {
+				peer.IP = ipString(remoteAddr.IP, remoteAddr.Zone)
+				updatePeer(peer)
 			}
 		}
+	}
+}
+
+// meshMAC authenticates discovery messages with the optional mesh key, so
+// nodes that do not share it neither see nor answer each other.
+func meshMAC(data string) string {
+	if options.MeshKey == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(options.MeshKey))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkMeshMAC(data, mac string) bool {
+	return hmac.Equal([]byte(meshMAC(data)), []byte(mac))
+}
+
+func newDiscoveryNonce(target net.IP) string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	nonce := hex.EncodeToString(buf)
+
+	discoveryNoncesMu.Lock()
+	defer discoveryNoncesMu.Unlock()
+	now := time.Now()
+	for n, req := range discoveryNonces {
+		if now.Sub(req.created) > discoveryNonceTTL {
+			delete(discoveryNonces, n)
+		}
+	}
+	discoveryNonces[nonce] = &discoveryRequest{created: now, target: target, answered: make(map[string]bool)}
+	return nonce
+}
+
+// claimDiscoveryNonce accepts the first reply of node to one of our recent
+// requests, so a captured announcement cannot be replayed from elsewhere.
+func claimDiscoveryNonce(nonce, node string, from net.IP) bool {
+	discoveryNoncesMu.Lock()
+	defer discoveryNoncesMu.Unlock()
+	req, ok := discoveryNonces[nonce]
+	if !ok || time.Since(req.created) > discoveryNonceTTL || req.answered[node] {
+		return false
+	}
+	if req.target != nil && !req.target.Equal(from) {
+		return false
+	}
+	req.answered[node] = true
+	return true
+}
+
+// parseDiscover accepts TAZ_DISCOVER|<nonce>|<mac>. The bare legacy form is
+// only answered when no mesh key is set.
+func parseDiscover(msg string) (string, bool) {
+	parts := strings.Split(msg, "|")
+	nonce, mac := "", ""
+	if len(parts) > 1 {
+		nonce = parts[1]
+	}
+	if len(parts) > 2 {
+		mac = parts[2]
+	}
+	if len(nonce) > 64 {
+		return "", false
+	}
+	return nonce, checkMeshMAC("TAZ_DISCOVER|"+nonce, mac)
+}
+
+func discoverMessage(target net.IP) []byte {
+	nonce := newDiscoveryNonce(target)
+	body := "TAZ_DISCOVER|" + nonce
+	return []byte(body + "|" + meshMAC(body))
+}
+
+// startAnnouncements keeps the encoded announcement fresh in the background,
+// so answering a request never walks the tree or waits on the room hub.
+// Until the first refresh lands, requests get the port and TLS fingerprint.
+func startAnnouncements() {
+	setAnnouncement(Announcement{Format: announcementFormat, Port: options.WebPort, TLS: tlsFingerprint, Features: []string{}})
+	go func() {
+		ticker := time.NewTicker(announcementTTL)
+		defer ticker.Stop()
+		for {
+			setAnnouncement(nodeAnnouncement())
+			<-ticker.C
+		}
 	}()
+}
 
+func setAnnouncement(a Announcement) {
+	data, _ := json.Marshal(a)
+	encoded := []byte(base64.RawURLEncoding.EncodeToString(data))
+	announcementMu.Lock()
+	announcement = encoded
+	announcementMu.Unlock()
 }
 
-func broadcastShout(conn *net.UDPConn) {
-	dest := &net.UDPAddr{IP: net.IPv4bcast, Port: 35248}
-	conn.WriteToUDP([]byte("TAZ_DISCOVER"), dest)
+func cachedAnnouncement() string {
+	announcementMu.RLock()
+	defer announcementMu.RUnlock()
+	return string(announcement)
 }
 
-func updatePeer(ip, name, version string) {
+// nodeAnnouncement describes what this node offers. Looking for map files
+// walks the tree, so it only runs from the background refresh.
+func nodeAnnouncement() Announcement {
+	features := []string{"files", "room"}
+	if bbsDB != nil {
+		features = append(features, "bbs")
+	}
+	if len(findTreeFiles(".pmtiles")) > 0 {
+		features = append(features, "maps")
+	}
+	routeGraphsMutex.RLock()
+	if len(routeGraphs) > 0 {
+		features = append(features, "routing")
+	}
+	routeGraphsMutex.RUnlock()
+	if len(options.DHCPInterfaces) > 0 {
+		features = append(features, "dhcp")
+	}
+	if options.DNS != "" {
+		features = append(features, "dns")
+	}
+	if len(syncFolders()) > 0 {
+		features = append(features, "sync")
+	}
+
+	users := 0
+	for _, n := range roomParticipantCounts() {
+		users += n
+	}
+	return Announcement{
+		Format:   announcementFormat,
+		Port:     options.WebPort,
+		TLS:      tlsFingerprint,
+		Features: features,
+		Free:     freeDiskSpace(options.RootPath),
+		Users:    users,
+	}
+}
+
+// identMessage answers a discovery request with
+// TAZ_IDENT|name|version|node|public key|nonce|announcement|mac|signature,
+// keeping name and version where older clients expect them. The announcement
+// is base64url encoded JSON.
+func identMessage(nonce string) []byte {
+	name := strings.ReplaceAll(appLabel, "|", "")
+	body := strings.Join([]string{"TAZ_IDENT", name, appVersion, nodeID, nodePublicKey(), nonce, cachedAnnouncement()}, "|")
+	body += "|" + meshMAC(body)
+	sig := ed25519.Sign(nodeKey, []byte(body))
+	return []byte(body + "|" + hex.EncodeToString(sig))
+}
+
+func parseIdent(msg string, from net.IP) (Peer, error) {
+	parts := strings.Split(msg, "|")
+	if len(parts) != 9 {
+		return Peer{}, errIdentFormat
+	}
+	peer := Peer{Name: peerLabel(parts[1]), Version: peerLabel(parts[2]), Node: parts[3], PublicKey: strings.ToLower(parts[4])}
+	body := strings.Join(parts[:8], "|")
+	pub, err := hex.DecodeString(peer.PublicKey)
+	sig, serr := hex.DecodeString(parts[8])
+	if err != nil || serr != nil || len(pub) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(pub), []byte(body), sig) {
+		return peer, errIdentSignature
+	}
+	if !checkMeshMAC(strings.Join(parts[:7], "|"), parts[7]) {
+		return peer, errIdentMesh
+	}
+	var info Announcement
+	if data, err := base64.RawURLEncoding.DecodeString(parts[6]); err != nil || json.Unmarshal(data, &info) != nil {
+		return peer, errIdentFormat
+	}
+	if info.Port <= 0 || info.Port > 65535 || !validNodeID(peer.Node) {
+		return peer, errIdentFormat
+	}
+	peer.Port = info.Port
+	peer.TLSFingerprint = info.TLS
+	peer.Features = info.Features
+	peer.FreeBytes = info.Free
+	peer.Users = info.Users
+	if !claimDiscoveryNonce(parts[5], peer.Node, from) {
+		return peer, errIdentNonce
+	}
+	if peer.Node != nodeID && !pinPeerKey(peer.Node, peer.PublicKey, peer.Name) {
+		return peer, errIdentPinned
+	}
+	return peer, nil
+}
+
+// pinPeerKey remembers the first key seen for every node in sys/known_peers
+// and refuses announcements signed by any other key afterwards. Removing a
+// line from the file lets a reinstalled node be pinned again.
+func pinPeerKey(node, key, name string) bool {
+	knownPeersMu.Lock()
+	defer knownPeersMu.Unlock()
+	loadKnownPeers()
+	if pinned, ok := knownPeers[node]; ok {
+		return pinned == key
+	}
+	knownPeers[node] = key
+	f, err := os.OpenFile(filepath.Join(options.SystemPath, "known_peers"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		appLogger.Printf("Discovery: failed to pin key for %s: %v", node, err)
+		return true
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s %s\n", node, key, name)
+	appLogger.Printf("Discovery: pinned key for %s (%s)", name, node)
+	return true
+}
+
+// pinnedPeerKey returns the key pinned for node, if it was ever seen.
+func pinnedPeerKey(node string) (string, bool) {
+	knownPeersMu.Lock()
+	defer knownPeersMu.Unlock()
+	loadKnownPeers()
+	key, ok := knownPeers[node]
+	return key, ok
+}
+
+// loadKnownPeers reads sys/known_peers once, keeping the first key listed
+// for a node. The caller holds knownPeersMu.
+func loadKnownPeers() {
+	if knownPeers != nil {
+		return
+	}
+	knownPeers = make(map[string]string)
+	f, err := os.Open(filepath.Join(options.SystemPath, "known_peers"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !validNodeID(fields[0]) {
+			continue
+		}
+		if _, ok := knownPeers[fields[0]]; !ok {
+			knownPeers[fields[0]] = strings.ToLower(fields[1])
+		}
+	}
+}
+
+// validNodeID accepts the 16 hex digits node identities are made of.
+func validNodeID(node string) bool {
+	if len(node) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(node)
+	return err == nil
+}
+
+// peerLabel drops control characters from names peers announce, so they
+// cannot break the lines of sys/known_peers or the logs.
+func peerLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func discoveryInterfaces(flag net.Flags) []net.Interface {
+	var list []net.Interface
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagLoopback == 0 && ifi.Flags&flag != 0 {
+			list = append(list, ifi)
+		}
+	}
+	return list
+}
+
+// discoveryTargets lists where requests go: the broadcast address of every
+// IPv4 network we are on, the IPv6 group on every multicast interface and
+// the configured peers.
+func discoveryTargets() []*net.UDPAddr {
+	port := options.DiscoveryPort
+	seen := map[string]bool{}
+	var targets []*net.UDPAddr
+	add := func(addr *net.UDPAddr) {
+		if key := addr.String(); !seen[key] {
+			seen[key] = true
+			targets = append(targets, addr)
+		}
+	}
+
+	add(&net.UDPAddr{IP: net.IPv4bcast, Port: port})
+	for _, bcast := range broadcastAddresses() {
+		add(&net.UDPAddr{IP: bcast, Port: port})
+	}
+	for _, ifi := range discoveryInterfaces(net.FlagMulticast) {
+		add(&net.UDPAddr{IP: discoveryGroup6, Port: port, Zone: ifi.Name})
+	}
+
+	for _, entry := range options.DiscoveryPeers {
+		hostport := entry
+		if _, _, err := net.SplitHostPort(entry); err != nil {
+			hostport = net.JoinHostPort(strings.Trim(entry, "[]"), strconv.Itoa(port))
+		}
+		if addr, err := net.ResolveUDPAddr("udp", hostport); err == nil {
+			add(addr)
+		}
+	}
+	return targets
+}
+
+// broadcastAddresses lists the broadcast address of every IPv4 network we
+// are on.
+func broadcastAddresses() []net.IP {
+	var list []net.IP
+	for _, ifi := range discoveryInterfaces(net.FlagBroadcast) {
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i, b := range ipnet.IP.To4() {
+				bcast[i] = b | ^ipnet.Mask[i]
+			}
+			list = append(list, bcast)
+		}
+	}
+	return list
+}
+
+// discoveryBroadcast tells whether a request to ip may be answered by many
+// hosts.
+func discoveryBroadcast(ip net.IP) bool {
+	if ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return true
+	}
+	for _, bcast := range broadcastAddresses() {
+		if ip.Equal(bcast) {
+			return true
+		}
+	}
+	return false
+}
+
+func broadcastShout() {
+	for _, addr := range discoveryTargets() {
+		sendDiscover(addr)
+	}
+}
+
+// sendDiscover asks addr to identify itself, from the socket matching its
+// address family. Requests to a single host only take replies from it.
+func sendDiscover(addr *net.UDPAddr) {
+	conn := discoveryConn
+	if addr.IP.To4() == nil {
+		conn = discoveryConn6
+	}
+	if conn != nil {
+		var target net.IP
+		if !discoveryBroadcast(addr.IP) {
+			target = addr.IP
+		}
+		conn.WriteToUDP(discoverMessage(target), addr)
+	}
+}
+
+// updatePeer keeps the address a node was first seen at until it goes
+// stale, so replies from anywhere else neither move nor refresh it.
+func updatePeer(peer Peer) {
 	peersMutex.Lock()
 	defer peersMutex.Unlock()
-	peers[ip] = Peer{
-		IP:       ip,
-		Name:     name,
-		Version:  version,
-		LastSeen: time.Now().Unix(),
+	peer.LastSeen = time.Now().Unix()
+	if old, ok := peers[peer.Node]; !ok {
+		go refreshMeshRoutes()
+	} else if old.IP != peer.IP {
+		return
 	}
+	peers[peer.Node] = peer
 }
 
 func cleanupOldPeers() {
 	peersMutex.Lock()
 	defer peersMutex.Unlock()
 	now := time.Now().Unix()
-	for ip, peer := range peers {
+	for node, peer := range peers {
 		if now-peer.LastSeen > 45 {
-			delete(peers, ip)
+			delete(peers, node)
 		}
 	}
 }
@@ -106,5 +577,6 @@ func getDiscoveredPeers() []Peer {
 	for _, p := range peers {
 		list = append(list, p)
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
 	return list
 }
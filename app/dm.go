@@ -0,0 +1,200 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const chatIdentityCookie = "taz_chat"
+
+var dmPending = make(chan pendingDelivery)
+
+type pendingDelivery struct {
+	client   *Client
+	messages []DirectMessage
+}
+
+// routeDirectMessage delivers a private message to every connection of the
+// recipient, echoes it back to the sender and stores it for offline delivery.
+func routeDirectMessage(rooms map[string]map[*Client]bool, sender *Client, msg controlMessage) {
+	text := strings.TrimSpace(msg.Message)
+	text = truncateString(text, chatMaxMessage)
+	recipient := strings.TrimSpace(msg.Recipient)
+	if !sender.joined || text == "" || (msg.To == 0 && recipient == "") {
+		sendDirect(sender, DirectMessage{Type: "dm", To: recipient, Error: "invalid direct message"})
+		return
+	}
+
+	var targets []*Client
+	for _, clients := range rooms {
+		for client := range clients {
+			if client == sender || !client.joined {
+				continue
+			}
+			if (msg.To != 0 && client.id == msg.To) || (msg.To == 0 && strings.EqualFold(client.name, recipient)) {
+				targets = append(targets, client)
+			}
+		}
+	}
+	if msg.To != 0 && len(targets) == 0 {
+		sendDirect(sender, DirectMessage{Type: "dm", ToID: msg.To, Error: "recipient not found"})
+		return
+	}
+	if len(targets) > 0 {
+		recipient = targets[0].name
+	}
+
+	dm := DirectMessage{
+		Type:      "dm",
+		From:      sender.name,
+		FromID:    sender.id,
+		To:        recipient,
+		Message:   text,
+		Time:      time.Now().Unix(),
+		Delivered: len(targets) > 0,
+	}
+	for _, client := range targets {
+		dm.ToID = client.id
+		sendDirect(client, dm)
+	}
+	dm.Echo = true
+	sendDirect(sender, dm)
+	identity := ""
+	if len(targets) > 0 {
+		identity = targets[0].identity
+	}
+	go storeDirectMessage(dm, identity)
+}
+
+func sendDirect(client *Client, dm DirectMessage) bool {
+	data, err := json.Marshal(dm)
+	if err != nil {
+		return false
+	}
+	select {
+	case client.send <- Packet{MsgType: websocket.TextMessage, Data: data}:
+		return true
+	default:
+		roomMetrics.droppedFrames.Add(1)
+		return false
+	}
+}
+
+// chatIdentity names the browser behind a room connection with a long-lived
+// cookie, so that offline messages follow the person and not a nickname
+// anyone can pick. The header sets the cookie on first use.
+func chatIdentity(r *http.Request) (string, http.Header) {
+	header := http.Header{}
+	token := ""
+	if cookie, err := r.Cookie(chatIdentityCookie); err == nil && cookie.Value != "" {
+		token = cookie.Value
+	} else {
+		buf := make([]byte, 16)
+		rand.Read(buf)
+		token = hex.EncodeToString(buf)
+		header.Add("Set-Cookie", (&http.Cookie{
+			Name:     chatIdentityCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			MaxAge:   10 * 365 * 24 * 3600,
+		}).String())
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:]), header
+}
+
+// storeDirectMessage keeps a message for the identity it was meant for: the
+// connected recipient, or else whoever used the name last.
+func storeDirectMessage(dm DirectMessage, identity string) {
+	if chatDB == nil {
+		return
+	}
+	if identity == "" {
+		err := chatDB.QueryRow("SELECT identity FROM chat_names WHERE name = ?", dm.To).Scan(&identity)
+		if err != nil && err != sql.ErrNoRows {
+			appLogger.Printf("Chat: failed to look up %s: %v", dm.To, err)
+		}
+	}
+	if _, err := chatDB.Exec("INSERT INTO direct_messages (sender, recipient, recipient_identity, message, created_at, delivered) VALUES (?, ?, ?, ?, ?, ?)",
+		dm.From, dm.To, identity, dm.Message, dm.Time, dm.Delivered); err != nil {
+		appLogger.Printf("Chat: failed to store direct message: %v", err)
+	}
+}
+
+// claimChatName binds a name nobody owns yet to the identity of client,
+// handing it the messages sent to that name before anyone had used it, then
+// delivers whatever arrived for the identity while it was offline. A name
+// stays with the first identity that claimed it. Pending messages are marked
+// delivered in the same transaction, so two claims never hand them out twice.
+func claimChatName(client *Client, name string) {
+	if chatDB == nil || name == "" || client.identity == "" {
+		return
+	}
+	tx, err := chatDB.Begin()
+	if err != nil {
+		appLogger.Printf("Chat: failed to claim %s: %v", name, err)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO chat_names (name, identity, updated_at) VALUES (?, ?, ?) ON CONFLICT(name) DO UPDATE SET updated_at = excluded.updated_at WHERE chat_names.identity = excluded.identity",
+		name, client.identity, time.Now().Unix())
+	if err != nil {
+		appLogger.Printf("Chat: failed to claim %s: %v", name, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		if _, err := tx.Exec("UPDATE direct_messages SET recipient_identity = ? WHERE recipient = ? AND recipient_identity = '' AND delivered = 0",
+			client.identity, name); err != nil {
+			appLogger.Printf("Chat: failed to claim %s: %v", name, err)
+			return
+		}
+	}
+
+	rows, err := tx.Query("UPDATE direct_messages SET delivered = 1 WHERE recipient_identity = ? AND delivered = 0 RETURNING id, sender, recipient, message, created_at", client.identity)
+	if err != nil {
+		appLogger.Printf("Chat: failed to load direct messages: %v", err)
+		return
+	}
+	var messages []DirectMessage
+	for rows.Next() {
+		dm := DirectMessage{Type: "dm", ToID: client.id, Offline: true, Delivered: true}
+		if err := rows.Scan(&dm.ID, &dm.From, &dm.To, &dm.Message, &dm.Time); err != nil {
+			rows.Close()
+			appLogger.Printf("Chat: failed to load direct messages: %v", err)
+			return
+		}
+		messages = append(messages, dm)
+	}
+	rows.Close()
+	if err := tx.Commit(); err != nil {
+		appLogger.Printf("Chat: failed to load direct messages: %v", err)
+		return
+	}
+	if len(messages) > 0 {
+		sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+		dmPending <- pendingDelivery{client: client, messages: messages}
+	}
+}
+
+// restoreDirectPending puts back the messages the hub could not queue, for
+// the next time their recipient comes back.
+func restoreDirectPending(messages []DirectMessage) {
+	for _, dm := range messages {
+		if _, err := chatDB.Exec("UPDATE direct_messages SET delivered = 0 WHERE id = ?", dm.ID); err != nil {
+			appLogger.Printf("Chat: failed to update direct message %d: %v", dm.ID, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+const defaultTalkTime = 30
+
+// floorState tracks push-to-talk in a half-duplex room. It is owned by the hub
+// goroutine like the rest of the room state.
+type floorState struct {
+	limit  time.Duration
+	holder *Client
+	until  time.Time
+	queue  []*Client
+}
+
+type floorUpdate struct {
+	room  string
+	limit time.Duration
+}
+
+func (f *floorState) request(c *Client, now time.Time) bool {
+	if f.holder == c || slices.Contains(f.queue, c) {
+		return false
+	}
+	if f.holder == nil {
+		f.grant(c, now)
+	} else {
+		f.queue = append(f.queue, c)
+	}
+	return true
+}
+
+func (f *floorState) release(c *Client, now time.Time) bool {
+	if f.holder == c {
+		f.next(now)
+		return true
+	}
+	if i := slices.Index(f.queue, c); i >= 0 {
+		f.queue = slices.Delete(f.queue, i, i+1)
+		return true
+	}
+	return false
+}
+
+func (f *floorState) expire(now time.Time) bool {
+	if f.holder != nil && now.After(f.until) {
+		f.next(now)
+		return true
+	}
+	return false
+}
+
+func (f *floorState) grant(c *Client, now time.Time) {
+	f.holder = c
+	f.until = now.Add(f.limit)
+	if c.audio != nil {
+		c.audio.samples = c.audio.samples[:0]
+	}
+}
+
+func (f *floorState) next(now time.Time) {
+	f.holder = nil
+	if len(f.queue) > 0 {
+		c := f.queue[0]
+		f.queue = f.queue[1:]
+		f.grant(c, now)
+	}
+}
+
+func (f *floorState) info(room string) FloorInfo {
+	info := FloorInfo{Type: "floor", Room: room, Mode: "open", Queue: []int64{}}
+	if f == nil {
+		return info
+	}
+	info.Mode = "ptt"
+	info.TalkTime = int(f.limit / time.Second)
+	if f.holder != nil {
+		info.Holder = f.holder.id
+		info.Expires = f.until.UnixMilli()
+	}
+	for _, c := range f.queue {
+		info.Queue = append(info.Queue, c.id)
+	}
+	return info
+}
@@ -0,0 +1,332 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Folder sync modes. A two-way folder pulls changes from every peer sharing
+// it and keeps a conflict copy when both sides changed a file; a mirror only
+// receives, from a single peer whose key is in sys/trusted_keys, and becomes
+// a copy of that peer's folder; a send folder is only served.
+const (
+	syncTwoWay         = "two-way"
+	syncMirror         = "mirror"
+	syncSend           = "send"
+	folderSyncInterval = 60 * time.Second
+)
+
+var (
+	folderSyncMutex sync.Mutex
+
+	hashCache   = map[string]cachedHash{}
+	hashCacheMu sync.Mutex
+)
+
+type cachedHash struct {
+	size  int64
+	mtime int64
+	sum   string
+}
+
+type syncAction struct {
+	entry    PeerEntry
+	target   string
+	conflict bool
+	remove   bool
+}
+
+func syncFolders() map[string]string {
+	folders := map[string]string{}
+	for _, entry := range options.SyncFolders {
+		folder, mode, _ := strings.Cut(entry, ":")
+		folder = cleanPeerPath(folder)
+		mode = strings.ToLower(strings.TrimSpace(mode))
+		if mode == "" {
+			mode = syncTwoWay
+		}
+		if mode != syncTwoWay && mode != syncMirror && mode != syncSend {
+			continue
+		}
+		if _, err := peerSafePath(folder); err != nil || folder == "." {
+			continue
+		}
+		folders[folder] = mode
+	}
+	return folders
+}
+
+func startFolderSync() {
+	folders := syncFolders()
+	if len(folders) == 0 {
+		return
+	}
+	for folder, mode := range folders {
+		if abs, err := peerSafePath(folder); err == nil {
+			os.MkdirAll(abs, os.ModePerm)
+		}
+		appLogger.Printf("Folder sync: %s (%s)", folder, mode)
+	}
+	go func() {
+		ticker := time.NewTicker(folderSyncInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runFolderSync()
+		}
+	}()
+}
+
+func runFolderSync() {
+	if !folderSyncMutex.TryLock() {
+		return
+	}
+	defer folderSyncMutex.Unlock()
+
+	peers := getDiscoveredPeers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Node < peers[j].Node })
+	trusted := loadTrustedKeys()
+	for folder, mode := range syncFolders() {
+		if mode == syncSend {
+			continue
+		}
+		for _, peer := range peers {
+			// Any node can join the network, so only a trusted one may
+			// decide what a mirror holds.
+			if mode == syncMirror && !trusted[peer.PublicKey] {
+				continue
+			}
+			served, err := syncFolderWithPeer(folder, mode, peer)
+			if err != nil {
+				appLogger.Printf("Folder sync %s with %s failed: %v", folder, peer.IP, err)
+			}
+			// A mirror follows the first node serving the folder, so two
+			// sources never take turns overwriting it.
+			if served && mode == syncMirror {
+				break
+			}
+		}
+	}
+}
+
+func cachedSHA256(abs string, e PeerEntry) (string, error) {
+	hashCacheMu.Lock()
+	c, ok := hashCache[abs]
+	hashCacheMu.Unlock()
+	if ok && c.size == e.Size && c.mtime == e.ModTime {
+		return c.sum, nil
+	}
+	sum, err := fileSHA256(abs)
+	if err != nil {
+		return "", err
+	}
+	hashCacheMu.Lock()
+	hashCache[abs] = cachedHash{size: e.Size, mtime: e.ModTime, sum: sum}
+	hashCacheMu.Unlock()
+	return sum, nil
+}
+
+func buildFolderManifest(folder string) (PeerListing, error) {
+	return listPeerFiles(folder, true)
+}
+
+// The sync state keeps, per folder and peer, the hash each file had when both
+// sides last agreed on it, so a local edit can be told apart from a remote one.
+func syncStatePath(folder, node string) string {
+	name := url.PathEscape(folder)
+	if node != "" {
+		name += "@" + url.PathEscape(node)
+	}
+	return filepath.Join(options.SystemPath, "sync", name+".json")
+}
+
+// loadSyncState falls back to the state shared by all peers that older
+// versions kept for the folder.
+func loadSyncState(folder, node string) map[string]string {
+	state := map[string]string{}
+	data, err := os.ReadFile(syncStatePath(folder, node))
+	if err != nil {
+		data, err = os.ReadFile(syncStatePath(folder, ""))
+	}
+	if err == nil {
+		json.Unmarshal(data, &state)
+	}
+	return state
+}
+
+func saveSyncState(folder, node string, state map[string]string) error {
+	p := syncStatePath(folder, node)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+func planFolderSync(folder, mode, node string, local, remote []PeerEntry, state map[string]string) []syncAction {
+	have := map[string]PeerEntry{}
+	for _, e := range local {
+		have[e.Path] = e
+	}
+	var plan []syncAction
+	// A mirror drops what its source no longer has, unless the source listing
+	// was cut short or came back empty.
+	if mode == syncMirror && len(remote) > 0 && len(remote) < peerMaxEntries {
+		served := map[string]bool{}
+		for _, r := range remote {
+			served[r.Path] = true
+		}
+		for _, l := range local {
+			if !served[l.Path] {
+				plan = append(plan, syncAction{entry: l, target: l.Path, remove: true})
+			}
+		}
+	}
+	for _, r := range remote {
+		if r.SHA256 == "" || !strings.HasPrefix(r.Path, folder+"/") || !filepath.IsLocal(r.Path) {
+			continue
+		}
+		l, ok := have[r.Path]
+		switch {
+		case ok && l.SHA256 == r.SHA256:
+			state[r.Path] = r.SHA256
+		case !ok || mode == syncMirror || l.SHA256 == state[r.Path]:
+			plan = append(plan, syncAction{entry: r, target: r.Path})
+		case r.SHA256 == state[r.Path]:
+			// Only our copy changed; the peer picks it up on its own pass.
+		default:
+			target := bundleConflictPath(r.Path, node)
+			if c, ok := have[target]; ok && c.SHA256 == r.SHA256 {
+				continue
+			}
+			plan = append(plan, syncAction{entry: r, target: target, conflict: true})
+		}
+	}
+	return plan
+}
+
+// syncFolderWithPeer reports whether the peer serves the folder at all.
+func syncFolderWithPeer(folder, mode string, peer Peer) (bool, error) {
+	base := peerBaseURL(peer.IP, peer.Port)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var remote PeerListing
+	if err := peerGetJSON(ctx, base+"/sync/api/manifest?folder="+url.QueryEscape(folder), &remote); err != nil {
+		var status *peerStatusError
+		if errors.As(err, &status) && status.status == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	if remote.Node == nodeID {
+		return false, nil
+	}
+	if remote.Node != peer.Node {
+		return false, fmt.Errorf("peer answered as node %s", remote.Node)
+	}
+	local, err := buildFolderManifest(folder)
+	if err != nil {
+		return true, err
+	}
+	if mode == syncMirror && len(remote.Entries) == 0 && len(local.Entries) > 0 {
+		appLogger.Printf("Folder sync %s: %s lists no files, keeping the local copies", folder, remote.Name)
+	}
+
+	state := loadSyncState(folder, remote.Node)
+	plan := planFolderSync(folder, mode, remote.Node, local.Entries, remote.Entries, state)
+	if len(plan) == 0 {
+		return true, saveSyncState(folder, remote.Node, state)
+	}
+
+	var stateMu sync.Mutex
+	job := newPeerJob("sync", peer.IP, remote.Name, base, folder, folder, func(ctx context.Context, j *peerJob) error {
+		var total int64
+		conflicts := 0
+		for _, a := range plan {
+			if !a.remove {
+				total += a.entry.Size
+			}
+			if a.conflict {
+				conflicts++
+			}
+		}
+		j.update(func(t *PeerTransfer) {
+			t.Files, t.FilesDone, t.Bytes, t.Total, t.Conflicts = len(plan), 0, 0, total, conflicts
+		})
+		for _, a := range plan {
+			abs, err := peerSafePath(a.target)
+			if err != nil {
+				return err
+			}
+			if a.remove {
+				if err := os.Remove(abs); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				appLogger.Printf("Folder sync %s: removed %s, gone from %s", folder, a.entry.Path, remote.Name)
+				stateMu.Lock()
+				delete(state, a.entry.Path)
+				stateMu.Unlock()
+				j.update(func(t *PeerTransfer) { t.FilesDone++ })
+				continue
+			}
+			if err := fetchPeerFile(ctx, j, a.entry, abs); err != nil {
+				return fmt.Errorf("%s: %w", a.entry.Path, err)
+			}
+			if a.conflict {
+				appLogger.Printf("Folder sync %s: %s changed on both sides, saved %s copy as %s", folder, a.entry.Path, remote.Name, a.target)
+			} else {
+				stateMu.Lock()
+				state[a.entry.Path] = a.entry.SHA256
+				stateMu.Unlock()
+			}
+			j.update(func(t *PeerTransfer) { t.FilesDone++ })
+		}
+		return nil
+	})
+	<-job.start()
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return true, saveSyncState(folder, remote.Node, state)
+}
+
+func syncManifestHandler(w http.ResponseWriter, r *http.Request) {
+	folder := cleanPeerPath(r.URL.Query().Get("folder"))
+	if mode, ok := syncFolders()[folder]; !ok || mode == syncMirror {
+		writeJSONError(w, http.StatusNotFound, "folder is not shared")
+		return
+	}
+	manifest, err := buildFolderManifest(folder)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, manifest)
+}
+
+func syncRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if options.Password != "" && !isAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	go runFolderSync()
+	writeJSON(w, http.StatusAccepted, syncFolders())
+}
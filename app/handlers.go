@@ -3,7 +3,6 @@
 package main
 
 import (
-	"bufio"
 	"crypto/subtle"
 	"encoding/json"
 	"fmt"
@@ -11,149 +10,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
 	"strings"
 	"time"
-
-	"github.com/gorilla/websocket"
-)
-
-const (
-	writeWait  = 10 * time.Second
-	pingPeriod = (60 * time.Second * 9) / 10
-	pongWait   = 60 * time.Second
-	sendBuffer = 256
-)
-
-var (
-	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
-	}
-	register   = make(chan *Client)
-	unregister = make(chan *Client)
-	broadcast  = make(chan Packet)
 )
 
-type Client struct {
-	conn *websocket.Conn
-	send chan Packet
-}
-
-type Packet struct {
-	Sender  *Client
-	MsgType int
-	Data    []byte
-}
-
-func init() {
-	go runHub()
-}
-
-func runHub() {
-	clients := make(map[*Client]bool)
-
-	for {
-		select {
-		case client := <-register:
-			clients[client] = true
-			if appLogger != nil {
-				appLogger.Printf("Room client connected: %s", client.conn.RemoteAddr())
-			}
-		case client := <-unregister:
-			if _, ok := clients[client]; ok {
-				delete(clients, client)
-				close(client.send)
-				if appLogger != nil {
-					appLogger.Printf("Room client disconnected: %s", client.conn.RemoteAddr())
-				}
-			}
-		case packet := <-broadcast:
-			for client := range clients {
-				if client != packet.Sender {
-					select {
-					case client.send <- packet:
-					default:
-						close(client.send)
-						delete(clients, client)
-					}
-				}
-			}
-		}
-	}
-}
-
-func (c *Client) readPump() {
-	defer func() {
-		unregister <- c
-		c.conn.Close()
-	}()
-	c.conn.SetReadLimit(512 * 1024)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-
-	for {
-		msgType, msg, err := c.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) && appLogger != nil {
-				appLogger.Printf("WS error: %v", err)
-			}
-			break
-		}
-		broadcast <- Packet{Sender: c, MsgType: msgType, Data: msg}
-	}
-}
-
-func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
-
-	for {
-		select {
-		case packet, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(packet.MsgType)
-			if err != nil {
-				return
-			}
-			w.Write(packet.Data)
-
-			if err := w.Close(); err != nil {
-				return
-			}
-
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
-			}
-		}
-	}
-}
-
-func mediaRoomHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		if appLogger != nil {
-			appLogger.Printf("WS upgrade error: %v", err)
-		}
-		return
-	}
-
-	client := &Client{conn: conn, send: make(chan Packet, sendBuffer)}
-	register <- client
-
-	go client.writePump()
-	go client.readPump()
-}
-
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -246,6 +106,10 @@ func handlePostRequest(w http.ResponseWriter, r *http.Request) {
 		msg, errMsg = handleDelete(r)
 	case "rename":
 		msg, errMsg = handleRename(r)
+	case "bundle":
+		msg, errMsg = handleBundleExport(r)
+	case "import_bundle":
+		msg, errMsg = handleBundleImport(r)
 	}
 	redirect := fmt.Sprintf("/?path=%s&msg=%s&err=%s",
 		template.URLQueryEscaper(relativePath),
@@ -300,142 +164,30 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, absPath)
 }
 
-func bbsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		requireAuth(handleBBSPost, true)(w, r)
-		return
-	}
-	if options.BBSPath == "" {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
-	}
-	handleBBSGet(w, r)
-}
-
-func handleBBSGet(w http.ResponseWriter, r *http.Request) {
-	page := 1
-	if p := r.URL.Query().Get("page"); p != "" {
-		if parsedPage, err := strconv.Atoi(p); err == nil && parsedPage > 0 {
-			page = parsedPage
-		}
-	}
-
-	var messages []BBSMessage
-
-	file, err := os.Open(options.BBSPath)
-	if err == nil {
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		idCounter := 1
-		for scanner.Scan() {
-			var msg BBSMessage
-			if err := json.Unmarshal(scanner.Bytes(), &msg); err == nil {
-				msg.ID = idCounter
-				messages = append(messages, msg)
-				idCounter++
-			}
-		}
-	}
-
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
-	}
-
-	const messagesPerPage = 10
-	totalMessages := len(messages)
-	totalPages := (totalMessages + messagesPerPage - 1) / messagesPerPage
-	if totalPages == 0 {
-		totalPages = 1
-	}
-
-	if page > totalPages {
-		page = totalPages
-	}
-
-	start := (page - 1) * messagesPerPage
-	end := start + messagesPerPage
-	if end > totalMessages {
-		end = totalMessages
-	}
-
-	var displayedMessages []BBSMessage
-	if start < totalMessages {
-		displayedMessages = messages[start:end]
-	}
-
-	pages := make([]int, totalPages)
-	for i := 0; i < totalPages; i++ {
-		pages[i] = i + 1
-	}
-
-	data := BBSPageData{
-		Title:       "BBS Messages",
-		Messages:    displayedMessages,
-		CurrentPage: page,
-		TotalPages:  totalPages,
-		HasPrevious: page > 1,
-		HasNext:     page < totalPages,
-		Pages:       pages,
-	}
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	templates.ExecuteTemplate(w, "bbs.html", data)
-}
-
-func handleBBSPost(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Error parsing form", http.StatusInternalServerError)
-		return
-	}
-
-	messageContent := strings.TrimSpace(r.FormValue("message"))
-	if messageContent == "" {
-		http.Redirect(w, r, "/bbs", http.StatusSeeOther)
-		return
-	}
-
-	msg := BBSMessage{
-		Message:   messageContent,
-		CreatedAt: time.Now().Format("2006-01-02 15:04:05"),
-	}
-
-	msgBytes, err := json.Marshal(msg)
-	if err != nil {
-		appLogger.Printf("Failed to marshal BBS message: %v", err)
-		http.Redirect(w, r, "/bbs", http.StatusSeeOther)
-		return
-	}
-
-	f, err := os.OpenFile(options.BBSPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		appLogger.Printf("Failed to open BBS file: %v", err)
-		http.Error(w, "Storage error", http.StatusInternalServerError)
-		return
-	}
-	defer f.Close()
-
-	if _, err := f.Write(msgBytes); err != nil {
-		appLogger.Printf("Failed to write BBS message: %v", err)
-	} else {
-		f.WriteString("\n")
-		appLogger.Printf("BBS message posted by %s", r.RemoteAddr)
-	}
-
-	http.Redirect(w, r, "/bbs", http.StatusSeeOther)
-}
-
 func statusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	status := map[string]interface{}{
 		"name":      appLabel,
+		"node":      nodeID,
 		"version":   appVersion,
 		"time":      time.Now().Unix(),
 		"ips":       getServingIPs(),
 		"port":      options.WebPort,
 		"uptime":    int(time.Since(uptime).Seconds()),
 		"discovery": getDiscoveredPeers(),
+		"routes":    getMeshRoutes(),
+	}
+
+	counts := roomParticipantCounts()
+	participants := 0
+	for _, n := range counts {
+		participants += n
 	}
+	status["room_participants"] = participants
+	status["rooms"] = counts
+	status["room_metrics"] = roomMetricsSnapshot()
+	status["sync_folders"] = syncFolders()
 
 	json.NewEncoder(w).Encode(status)
 }
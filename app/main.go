@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -50,7 +51,28 @@ func main() {
 		log.Fatalf("Failed to create system directory '%s': %v", options.SystemPath, err)
 	}
 
-	addr := fmt.Sprintf("%s:%d", options.WebHost, options.WebPort)
+	if err := loadNodeIdentity(); err != nil {
+		log.Fatalf("Failed to load node identity: %v", err)
+	}
+
+	if err := openBBSStore(); err != nil {
+		appLogger.Printf("BBS disabled, failed to open %s: %v", options.BBSPath, err)
+		options.BBSPath = ""
+	}
+
+	if err := openChatStore(); err != nil {
+		appLogger.Printf("Chat history disabled, failed to open %s: %v", options.ChatPath, err)
+	}
+
+	addr := net.JoinHostPort(strings.Trim(options.WebHost, "[]"), strconv.Itoa(options.WebPort))
+	// Go listens on both families for any wildcard address, so 0.0.0.0
+	// needs tcp4 to stay on IPv4.
+	network, listenAddr := "tcp", addr
+	if isAnyHost(options.WebHost) {
+		listenAddr = fmt.Sprintf(":%d", options.WebPort)
+	} else if options.WebHost == "0.0.0.0" {
+		network = "tcp4"
+	}
 
 	startNetworkServices()
 
@@ -61,8 +83,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to prepare certificate: %v", err)
 	}
+	tlsFingerprint = certFingerprint(cert)
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := net.Listen(network, listenAddr)
 	if err != nil {
 		log.Fatalf("Failed to listen on %s: %v", addr, err)
 	}
@@ -80,6 +103,11 @@ func main() {
 	}
 
 	startDiscovery()
+	startMesh()
+	startPlaceIndex()
+	startRouting()
+	startBBSSync()
+	startFolderSync()
 
 	appLogger.Printf("Starting TAZ file manager on http://%s", addr)
 	if err := server.Serve(mux); err != nil {
@@ -0,0 +1,522 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mdnsPort          = 5353
+	mdnsTTL           = 120
+	mdnsBrowseEvery   = 60 * time.Second
+	mdnsProbeInterval = 30 * time.Second
+
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeANY  = 255
+
+	mdnsCacheFlush = 0x8000
+	mdnsServiceTAZ = "_taz._tcp.local"
+	mdnsServiceDir = "_services._dns-sd._udp.local"
+)
+
+var (
+	mdnsGroup    = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+	mdnsGroup6   = net.ParseIP("ff02::fb")
+	mdnsServices = []string{"_http._tcp.local", "_https._tcp.local", mdnsServiceTAZ}
+
+	mdnsHost    string
+	mdnsProbing bool
+	mdnsMu      sync.Mutex
+
+	mdnsProbed   = make(map[string]time.Time)
+	mdnsProbedMu sync.Mutex
+
+	errDNSMessage = errors.New("malformed dns message")
+)
+
+type mdnsSocket struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	nets  []*net.IPNet
+}
+
+func (s mdnsSocket) onLink(ip net.IP) bool {
+	for _, n := range s.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type dnsRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+
+	// Decoded rdata for the types mDNS browsing cares about.
+	Target string
+	Port   uint16
+	Text   []string
+	IP     net.IP
+}
+
+type dnsMessage struct {
+	ID        uint16
+	Flags     uint16
+	Questions []dnsQuestion
+	Records   []dnsRecord
+}
+
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readDNSName follows compression pointers, refusing loops and overruns.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; jumps++ {
+		if off >= len(msg) || jumps > 32 {
+			return "", 0, errDNSMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+func parseDNSMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < 12 {
+		return nil, errDNSMessage
+	}
+	m := &dnsMessage{ID: binary.BigEndian.Uint16(msg), Flags: binary.BigEndian.Uint16(msg[2:])}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rr := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return nil, errDNSMessage
+		}
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next:]),
+			Class: binary.BigEndian.Uint16(msg[next+2:]),
+		})
+		off = next + 4
+	}
+	for i := 0; i < rr; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		r := dnsRecord{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next:]),
+			Class: binary.BigEndian.Uint16(msg[next+2:]),
+			TTL:   binary.BigEndian.Uint32(msg[next+4:]),
+		}
+		size := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+size > len(msg) {
+			return nil, errDNSMessage
+		}
+		r.Data = msg[start : start+size]
+		switch r.Type {
+		case queryTypeA, dnsTypeAAAA:
+			if size == 4 || size == 16 {
+				r.IP = net.IP(append([]byte(nil), r.Data...))
+			}
+		case dnsTypePTR:
+			r.Target, _, _ = readDNSName(msg, start)
+		case dnsTypeSRV:
+			if size > 6 {
+				r.Port = binary.BigEndian.Uint16(msg[start+4:])
+				r.Target, _, _ = readDNSName(msg, start+6)
+			}
+		case dnsTypeTXT:
+			for p := 0; p < size; {
+				n := int(r.Data[p])
+				if p+1+n > size {
+					break
+				}
+				r.Text = append(r.Text, string(r.Data[p+1:p+1+n]))
+				p += 1 + n
+			}
+		}
+		m.Records = append(m.Records, r)
+		off = start + size
+	}
+	return m, nil
+}
+
+func (m *dnsMessage) encode(answers, extra []dnsRecord) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b, m.ID)
+	binary.BigEndian.PutUint16(b[2:], m.Flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(extra)))
+	for _, q := range m.Questions {
+		b = append(b, encodeDNSName(q.Name)...)
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+	for _, r := range append(answers, extra...) {
+		b = append(b, encodeDNSName(r.Name)...)
+		b = binary.BigEndian.AppendUint16(b, r.Type)
+		b = binary.BigEndian.AppendUint16(b, r.Class)
+		b = binary.BigEndian.AppendUint32(b, r.TTL)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+		b = append(b, r.Data...)
+	}
+	return b
+}
+
+func mdnsHostname() string {
+	mdnsMu.Lock()
+	defer mdnsMu.Unlock()
+	return mdnsHost
+}
+
+func mdnsInstance(service string) string {
+	return strings.NewReplacer(".", "-", "|", "-").Replace(appLabel) + "." + service
+}
+
+func mdnsAddresses() []net.IP {
+	var ips []net.IP
+	for _, s := range getServingIPs() {
+		s, _, _ = strings.Cut(s, "%")
+		if ip := net.ParseIP(s); ip != nil && !ip.IsLoopback() {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func mdnsAddressRecords() []dnsRecord {
+	var records []dnsRecord
+	for _, ip := range mdnsAddresses() {
+		rtype := uint16(queryTypeA)
+		if len(ip) == net.IPv6len {
+			rtype = dnsTypeAAAA
+		}
+		records = append(records, dnsRecord{Name: mdnsHostname(), Type: rtype, Class: queryClassIN | mdnsCacheFlush, TTL: mdnsTTL, Data: ip})
+	}
+	return records
+}
+
+func mdnsServiceRecords(service string) []dnsRecord {
+	instance := mdnsInstance(service)
+	srv := binary.BigEndian.AppendUint16(make([]byte, 4), uint16(options.WebPort))
+	srv = append(srv, encodeDNSName(mdnsHostname())...)
+
+	var txt []byte
+	for _, kv := range []string{"path=/", "node=" + nodeID, "version=" + appVersion, "name=" + appLabel, "discovery=" + strconv.Itoa(options.DiscoveryPort)} {
+		// A TXT string carries its length in one byte.
+		kv = truncateString(kv, 255)
+		txt = append(txt, byte(len(kv)))
+		txt = append(txt, kv...)
+	}
+	return []dnsRecord{
+		{Name: service, Type: dnsTypePTR, Class: queryClassIN, TTL: mdnsTTL, Data: encodeDNSName(instance)},
+		{Name: instance, Type: dnsTypeSRV, Class: queryClassIN | mdnsCacheFlush, TTL: mdnsTTL, Data: srv},
+		{Name: instance, Type: dnsTypeTXT, Class: queryClassIN | mdnsCacheFlush, TTL: mdnsTTL, Data: txt},
+	}
+}
+
+// mdnsAnswer collects the records that answer q, plus the extra records a
+// resolver needs to reach the service without asking again.
+func mdnsAnswer(q dnsQuestion) (answers, extra []dnsRecord) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	all := q.Type == dnsTypeANY
+	if name == strings.ToLower(mdnsHostname()) {
+		for _, r := range mdnsAddressRecords() {
+			if all || q.Type == r.Type {
+				answers = append(answers, r)
+			}
+		}
+		return answers, nil
+	}
+	if name == mdnsServiceDir && (all || q.Type == dnsTypePTR) {
+		for _, service := range mdnsServices {
+			answers = append(answers, dnsRecord{Name: mdnsServiceDir, Type: dnsTypePTR, Class: queryClassIN, TTL: mdnsTTL, Data: encodeDNSName(service)})
+		}
+		return answers, nil
+	}
+	for _, service := range mdnsServices {
+		records := mdnsServiceRecords(service)
+		switch {
+		case name == service && (all || q.Type == dnsTypePTR):
+			return records[:1], append(records[1:], mdnsAddressRecords()...)
+		case name == strings.ToLower(mdnsInstance(service)):
+			for _, r := range records[1:] {
+				if all || q.Type == r.Type {
+					answers = append(answers, r)
+				}
+			}
+			if len(answers) > 0 {
+				return answers, mdnsAddressRecords()
+			}
+		}
+	}
+	return nil, nil
+}
+
+func startMDNS() {
+	if options.MDNSName == "off" {
+		return
+	}
+	var socks []mdnsSocket
+	for _, ifi := range discoveryInterfaces(net.FlagMulticast) {
+		var nets []*net.IPNet
+		addrs, _ := ifi.Addrs()
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil {
+				nets = append(nets, n)
+			}
+		}
+		if len(nets) == 0 {
+			continue
+		}
+		if conn, err := net.ListenMulticastUDP("udp4", &ifi, mdnsGroup); err == nil {
+			socks = append(socks, mdnsSocket{conn, mdnsGroup, nets})
+		} else {
+			appLogger.Printf("mDNS: failed to join %s on %s: %v", mdnsGroup, ifi.Name, err)
+		}
+	}
+	if len(socks) == 0 {
+		if conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup); err == nil {
+			socks = append(socks, mdnsSocket{conn, mdnsGroup, nil})
+		} else {
+			appLogger.Printf("mDNS: failed to join %s: %v", mdnsGroup, err)
+		}
+	}
+	for _, ifi := range discoveryInterfaces(net.FlagMulticast) {
+		group := &net.UDPAddr{IP: mdnsGroup6, Port: mdnsPort, Zone: ifi.Name}
+		if conn, err := net.ListenMulticastUDP("udp6", &ifi, group); err == nil {
+			socks = append(socks, mdnsSocket{conn, group, nil})
+		}
+	}
+	// Every IPv4 socket receives what arrives on any interface, so a query
+	// from a known network is left to the socket of that network.
+	onLink := func(ip net.IP) bool {
+		for _, sock := range socks {
+			if sock.onLink(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(socks) == 0 {
+		return
+	}
+
+	host := options.MDNSName
+	if host == "" {
+		host = normalizeSlug(appLabel)
+	}
+	if host == "" {
+		host = "taz"
+	}
+	mdnsMu.Lock()
+	mdnsHost = strings.TrimSuffix(host, ".local") + ".local"
+	mdnsProbing = true
+	mdnsMu.Unlock()
+
+	for _, sock := range socks {
+		go func(sock mdnsSocket) {
+			defer sock.conn.Close()
+			buf := make([]byte, 9000)
+			for {
+				n, src, err := sock.conn.ReadFromUDP(buf)
+				if err != nil {
+					appLogger.Printf("mDNS socket error: %v", err)
+					return
+				}
+				if len(sock.nets) > 0 && !sock.onLink(src.IP) && onLink(src.IP) {
+					continue
+				}
+				handleMDNS(sock, src, buf[:n])
+			}
+		}(sock)
+	}
+	send := func(data []byte) {
+		for _, sock := range socks {
+			sock.conn.WriteToUDP(data, sock.group)
+		}
+	}
+
+	go func() {
+		// Probe for the host name before claiming it, then announce.
+		probe := &dnsMessage{Questions: []dnsQuestion{{Name: mdnsHostname(), Type: dnsTypeANY, Class: queryClassIN}}}
+		for i := 0; i < 3; i++ {
+			send(probe.encode(nil, nil))
+			time.Sleep(250 * time.Millisecond)
+		}
+		mdnsMu.Lock()
+		mdnsProbing = false
+		mdnsMu.Unlock()
+		appLogger.Printf("mDNS: advertising %s on port %d", mdnsHostname(), options.WebPort)
+
+		var records []dnsRecord
+		for _, service := range mdnsServices {
+			records = append(records, mdnsServiceRecords(service)...)
+		}
+		announce := (&dnsMessage{Flags: 0x8400}).encode(append(records, mdnsAddressRecords()...), nil)
+		browse := (&dnsMessage{Questions: []dnsQuestion{{Name: mdnsServiceTAZ, Type: dnsTypePTR, Class: queryClassIN}}}).encode(nil, nil)
+		send(announce)
+		time.Sleep(time.Second)
+		send(announce)
+
+		for {
+			send(browse)
+			time.Sleep(mdnsBrowseEvery)
+		}
+	}()
+}
+
+func handleMDNS(sock mdnsSocket, src *net.UDPAddr, data []byte) {
+	msg, err := parseDNSMessage(data)
+	if err != nil {
+		return
+	}
+	if msg.Flags&0x8000 != 0 {
+		handleMDNSResponse(src, msg)
+		return
+	}
+
+	var answers, extra []dnsRecord
+	unicast := src.Port != mdnsPort
+	for _, q := range msg.Questions {
+		a, e := mdnsAnswer(q)
+		answers = append(answers, a...)
+		extra = append(extra, e...)
+		unicast = unicast || q.Class&0x8000 != 0
+	}
+	if len(answers) == 0 {
+		return
+	}
+	resp := &dnsMessage{Flags: 0x8400}
+	if src.Port != mdnsPort {
+		// Legacy unicast resolvers expect their id and question back.
+		resp.ID = msg.ID
+		resp.Questions = msg.Questions
+	}
+	dest := sock.group
+	if unicast {
+		dest = src
+	}
+	sock.conn.WriteToUDP(resp.encode(answers, extra), dest)
+}
+
+// handleMDNSResponse watches for a clash on our host name while probing and
+// asks any TAZ node seen through DNS-SD to identify itself over the signed
+// discovery protocol; nothing learned from mDNS alone becomes a peer.
+func handleMDNSResponse(src *net.UDPAddr, msg *dnsMessage) {
+	ours := map[string]bool{}
+	for _, ip := range mdnsAddresses() {
+		ours[ip.String()] = true
+	}
+	host := strings.ToLower(mdnsHostname())
+
+	ports := map[string]uint16{}
+	nodes := map[string]string{}
+	discovery := map[string]uint16{}
+	for _, r := range msg.Records {
+		name := strings.ToLower(r.Name)
+		switch r.Type {
+		case queryTypeA, dnsTypeAAAA:
+			if name == host && r.IP != nil && !ours[r.IP.String()] {
+				mdnsMu.Lock()
+				if mdnsProbing {
+					mdnsHost = strings.TrimSuffix(mdnsHost, ".local") + "-" + nodeID[:4] + ".local"
+					appLogger.Printf("mDNS: host name taken by %s, using %s", r.IP, mdnsHost)
+				}
+				mdnsMu.Unlock()
+			}
+		case dnsTypeSRV:
+			ports[name] = r.Port
+		case dnsTypeTXT:
+			for _, kv := range r.Text {
+				if v, ok := strings.CutPrefix(kv, "node="); ok {
+					nodes[name] = v
+				}
+				// Older nodes answer discovery on their web port.
+				if v, ok := strings.CutPrefix(kv, "discovery="); ok {
+					if p, err := strconv.Atoi(v); err == nil && p > 0 && p <= 65535 {
+						discovery[name] = uint16(p)
+					}
+				}
+			}
+		}
+	}
+	for instance, port := range ports {
+		if !strings.HasSuffix(instance, "."+mdnsServiceTAZ) || nodes[instance] == nodeID || port == 0 {
+			continue
+		}
+		if p, ok := discovery[instance]; ok {
+			port = p
+		}
+		probeDiscoveryPeer(&net.UDPAddr{IP: src.IP, Port: int(port), Zone: src.Zone})
+	}
+}
+
+func probeDiscoveryPeer(addr *net.UDPAddr) {
+	key := net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+	mdnsProbedMu.Lock()
+	last, ok := mdnsProbed[key]
+	if ok && time.Since(last) < mdnsProbeInterval {
+		mdnsProbedMu.Unlock()
+		return
+	}
+	mdnsProbed[key] = time.Now()
+	mdnsProbedMu.Unlock()
+	sendDiscover(addr)
+}
@@ -0,0 +1,283 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	meshInterval   = 15 * time.Second
+	meshAuthWindow = 60 * time.Second
+	meshHopsHeader = "X-Taz-Hops"
+	meshAuthHeader = "X-Taz-Mesh"
+	meshRelayPath  = "/mesh/relay/"
+)
+
+var (
+	meshRoutes   = make(map[string]MeshRoute)
+	meshRoutesMu sync.RWMutex
+	meshMutex    sync.Mutex
+
+	errMeshNoRoute = errors.New("no route to node")
+	errMeshRelayed = errors.New("not available through the mesh")
+)
+
+type meshRelayedKey struct{}
+
+// meshRelayed tells whether a request reached us through the relay, whose
+// address is then the one of the last hop rather than the origin's.
+func meshRelayed(r *http.Request) bool {
+	relayed, _ := r.Context().Value(meshRelayedKey{}).(bool)
+	return relayed
+}
+
+func startMesh() {
+	go func() {
+		ticker := time.NewTicker(meshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			refreshMeshRoutes()
+		}
+	}()
+}
+
+func meshMaxHops() int {
+	if options.MeshHops <= 0 {
+		return 1
+	}
+	return options.MeshHops
+}
+
+// meshAuth proves to the next node that a request comes from a member of
+// the same mesh; without a mesh key every node is a member.
+func meshAuth() string {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return ts + "|" + meshMAC("TAZ_MESH|"+ts)
+}
+
+func checkMeshAuth(r *http.Request) bool {
+	if options.MeshKey == "" {
+		return true
+	}
+	ts, mac, _ := strings.Cut(r.Header.Get(meshAuthHeader), "|")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > meshAuthWindow || d < -meshAuthWindow {
+		return false
+	}
+	return checkMeshMAC("TAZ_MESH|"+ts, mac)
+}
+
+// refreshMeshRoutes rebuilds the routing table from the discovered peers and
+// the tables they advertise, keeping the shortest path to every node. Routes
+// a peer learned through us are skipped, and nothing beyond the hop limit is
+// kept, so a vanished node drops out after a few rounds.
+func refreshMeshRoutes() {
+	if !meshMutex.TryLock() {
+		return
+	}
+	defer meshMutex.Unlock()
+
+	table := make(map[string]MeshRoute)
+	direct := getDiscoveredPeers()
+	for _, p := range direct {
+		table[p.Node] = MeshRoute{Node: p.Node, Name: p.Name, Version: p.Version, Hops: 1, Via: p.Node, Features: p.Features, LastSeen: p.LastSeen}
+	}
+	for _, p := range direct {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		remote, err := fetchMeshTable(ctx, peerBaseURL(p.IP, p.Port))
+		cancel()
+		if err != nil {
+			appLogger.Printf("Mesh: routes from %s failed: %v", p.IP, err)
+			continue
+		}
+		for _, r := range remote.Routes {
+			if r.Node == "" || r.Node == nodeID || r.Via == nodeID {
+				continue
+			}
+			r.Hops++
+			if r.Hops > meshMaxHops() {
+				continue
+			}
+			if current, ok := table[r.Node]; ok && current.Hops <= r.Hops {
+				continue
+			}
+			r.Via = p.Node
+			table[r.Node] = r
+		}
+	}
+
+	meshRoutesMu.Lock()
+	meshRoutes = table
+	meshRoutesMu.Unlock()
+}
+
+func fetchMeshTable(ctx context.Context, base string) (MeshTable, error) {
+	var table MeshTable
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/mesh/api/routes", nil)
+	if err != nil {
+		return table, err
+	}
+	req.Header.Set(meshAuthHeader, meshAuth())
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return table, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return table, peerResponseError(resp)
+	}
+	return table, json.NewDecoder(resp.Body).Decode(&table)
+}
+
+func getMeshRoutes() []MeshRoute {
+	meshRoutesMu.RLock()
+	defer meshRoutesMu.RUnlock()
+	list := []MeshRoute{}
+	for _, r := range meshRoutes {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Hops != list[j].Hops {
+			return list[i].Hops < list[j].Hops
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func getMeshRoute(node string) (MeshRoute, bool) {
+	meshRoutesMu.RLock()
+	defer meshRoutesMu.RUnlock()
+	r, ok := meshRoutes[node]
+	return r, ok
+}
+
+func directPeer(node string) (Peer, bool) {
+	peersMutex.RLock()
+	defer peersMutex.RUnlock()
+	p, ok := peers[node]
+	return p, ok
+}
+
+// meshPeers lists the nodes only reachable through other nodes.
+func meshPeers() []Peer {
+	var list []Peer
+	for _, r := range getMeshRoutes() {
+		if r.Hops > 1 {
+			list = append(list, Peer{Node: r.Node, Name: r.Name, Version: r.Version, Features: r.Features, LastSeen: r.LastSeen})
+		}
+	}
+	return list
+}
+
+// peerBase is the URL to reach a peer, directly when it is on the local
+// network and through the relay of the next hop otherwise.
+func peerBase(p Peer) string {
+	if _, ok := directPeer(p.Node); !ok {
+		if r, ok := getMeshRoute(p.Node); ok {
+			if via, ok := directPeer(r.Via); ok {
+				return peerBaseURL(via.IP, via.Port) + meshRelayPath + url.PathEscape(p.Node)
+			}
+		}
+	}
+	return peerBaseURL(p.IP, p.Port)
+}
+
+func meshRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMeshAuth(r) {
+		writeJSONError(w, http.StatusForbidden, errIdentMesh.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, MeshTable{Node: nodeID, Name: appLabel, Routes: getMeshRoutes()})
+}
+
+// meshRelayHandler serves /mesh/relay/<node>/<path>: requests for this node
+// are handled locally, anything else is passed to the next hop with one hop
+// less to go.
+func meshRelayHandler(w http.ResponseWriter, r *http.Request) {
+	node, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, meshRelayPath), "/")
+	trailing := strings.HasSuffix(rest, "/")
+	rest = path.Clean("/" + rest)
+	if trailing && rest != "/" {
+		rest += "/"
+	}
+	if node == "" || strings.HasPrefix(rest, meshRelayPath) {
+		writeJSONError(w, http.StatusBadRequest, "invalid relay path")
+		return
+	}
+
+	// Without a mesh key anyone can send the hop header, so it only ever
+	// lowers the limit and never marks a request as coming from the mesh.
+	hops := meshMaxHops()
+	if h := r.Header.Get(meshHopsHeader); h != "" {
+		n, err := strconv.Atoi(h)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid hop count")
+			return
+		}
+		if !checkMeshAuth(r) {
+			writeJSONError(w, http.StatusForbidden, errIdentMesh.Error())
+			return
+		}
+		hops = min(hops, n)
+	}
+
+	if node == nodeID {
+		// Credentials never travel through the mesh: a relayed request is
+		// always anonymous on the node that serves it.
+		local := r.Clone(context.WithValue(r.Context(), meshRelayedKey{}, true))
+		local.Header.Del("Cookie")
+		local.Header.Del("Authorization")
+		local.URL.Path, local.URL.RawPath = rest, ""
+		local.Header.Set(meshHopsHeader, strconv.Itoa(hops))
+		http.DefaultServeMux.ServeHTTP(w, local)
+		return
+	}
+	if hops <= 0 {
+		writeJSONError(w, http.StatusLoopDetected, "hop limit reached")
+		return
+	}
+	route, ok := getMeshRoute(node)
+	var next Peer
+	if ok {
+		next, ok = directPeer(route.Via)
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errMeshNoRoute.Error())
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			target, _ := url.Parse(peerBaseURL(next.IP, next.Port))
+			pr.Out.URL.Scheme, pr.Out.URL.Host = target.Scheme, target.Host
+			pr.Out.URL.Path = meshRelayPath + node + rest
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = ""
+			pr.SetXForwarded()
+			pr.Out.Header.Del("Cookie")
+			pr.Out.Header.Del("Authorization")
+			pr.Out.Header.Set(meshHopsHeader, strconv.Itoa(hops-1))
+			pr.Out.Header.Set(meshAuthHeader, meshAuth())
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,121 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Room audio is mixed as mono float32 PCM at mixSampleRate. The hub buffers
+// every speaker and sends each listener a single mixed frame per tick, encoded
+// with the codec that listener negotiated.
+const (
+	mixSampleRate = 48000
+	mixFrameTime  = 20 * time.Millisecond
+	mixFrameSize  = mixSampleRate / 50
+	jitterTarget  = mixSampleRate / 10
+	jitterMax     = mixSampleRate * 4 / 10
+	jitterDelay   = 100 * time.Millisecond
+)
+
+type jitterBuffer struct {
+	samples []float32
+	frame   []float32
+	primed  bool
+	active  bool
+	updated time.Time
+}
+
+func newJitterBuffer() *jitterBuffer {
+	return &jitterBuffer{frame: make([]float32, mixFrameSize)}
+}
+
+func (j *jitterBuffer) write(samples []float32, now time.Time) {
+	j.samples = append(j.samples, samples...)
+	if over := len(j.samples) - jitterMax; over > 0 {
+		j.samples = j.samples[:copy(j.samples, j.samples[over:])]
+	}
+	j.updated = now
+}
+
+// next loads the following frame, waiting until enough audio is queued to
+// ride out network jitter, and reports whether the buffer has something to play.
+func (j *jitterBuffer) next(now time.Time) bool {
+	j.active = false
+	if len(j.samples) == 0 {
+		j.primed = false
+		return false
+	}
+	if !j.primed && len(j.samples) < jitterTarget && now.Sub(j.updated) < jitterDelay {
+		return false
+	}
+	j.primed = true
+	n := copy(j.frame, j.samples)
+	clear(j.frame[n:])
+	j.samples = j.samples[:copy(j.samples, j.samples[n:])]
+	j.active = true
+	return true
+}
+
+func decodePCM(data []byte) []float32 {
+	samples := make([]float32, len(data)/4)
+	for i := range samples {
+		samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	return samples
+}
+
+func encodePCM(samples []float32) []byte {
+	data := make([]byte, len(samples)*4)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(max(-1, min(1, s))))
+	}
+	return data
+}
+
+func mixRoom(clients map[*Client]bool, now time.Time) []float32 {
+	mix := make([]float32, mixFrameSize)
+	sources := 0
+	for client := range clients {
+		if client.audio != nil && client.audio.next(now) {
+			sources++
+			for i, s := range client.audio.frame {
+				mix[i] += s
+			}
+		}
+	}
+	if sources == 0 {
+		return mix
+	}
+
+	shared := map[string][]byte{}
+	for client := range clients {
+		var data []byte
+		if client.audio != nil && client.audio.active {
+			if sources == 1 {
+				continue
+			}
+			own := make([]float32, mixFrameSize)
+			for i, s := range client.audio.frame {
+				own[i] = mix[i] - s
+			}
+			data = encodeAudio(client.codec, own)
+		} else {
+			if shared[client.codec] == nil {
+				shared[client.codec] = encodeAudio(client.codec, mix)
+			}
+			data = shared[client.codec]
+		}
+		// A listener that cannot keep up loses this frame rather than the connection.
+		select {
+		case client.send <- Packet{MsgType: websocket.BinaryMessage, Data: data}:
+		default:
+			roomMetrics.droppedFrames.Add(1)
+		}
+	}
+	return mix
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -293,7 +294,7 @@ func handleDNSRequest(conn *net.UDPConn, clientAddr *net.UDPAddr, data []byte, s
 }
 
 func forwardDNSQuery(forwarderIP net.IP, query []byte) ([]byte, error) {
-	fconn, err := net.Dial("udp", fmt.Sprintf("%s:%d", forwarderIP.String(), dnsPort))
+	fconn, err := net.Dial("udp", net.JoinHostPort(forwarderIP.String(), strconv.Itoa(dnsPort)))
 	if err != nil {
 		return nil, err
 	}
@@ -410,7 +411,7 @@ func getServingIPs() []string {
 
 	host := options.WebHost
 
-	if host == "0.0.0.0" || host == "" {
+	if isWildcardHost(host) {
 		interfaces, err := net.Interfaces()
 		if err != nil {
 			return []string{options.WebHost}
@@ -428,9 +429,14 @@ func getServingIPs() []string {
 
 			for _, addr := range addrs {
 				if ipnet, ok := addr.(*net.IPNet); ok {
-					if ipnet.IP.To4() != nil {
-						listeningIPs = append(listeningIPs, ipnet.IP.String())
+					if !isAnyHost(host) && ipnet.IP.To4() == nil {
+						continue
 					}
+					zone := ""
+					if ipnet.IP.IsLinkLocalUnicast() {
+						zone = iface.Name
+					}
+					listeningIPs = append(listeningIPs, ipString(ipnet.IP, zone))
 				}
 			}
 		}
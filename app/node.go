@@ -0,0 +1,71 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	nodeID  string
+	nodeKey ed25519.PrivateKey
+)
+
+func loadNodeIdentity() error {
+	path := filepath.Join(options.SystemPath, "node.id")
+	if data, err := os.ReadFile(path); err == nil {
+		nodeID = strings.TrimSpace(string(data))
+	}
+	if nodeID == "" {
+		buf := make([]byte, 8)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		nodeID = hex.EncodeToString(buf)
+		if err := os.WriteFile(path, []byte(nodeID+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	keyPath := filepath.Join(options.SystemPath, "node.key")
+	if data, err := os.ReadFile(keyPath); err == nil {
+		if seed, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(seed) == ed25519.SeedSize {
+			nodeKey = ed25519.NewKeyFromSeed(seed)
+			return nil
+		}
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	nodeKey = key
+	return os.WriteFile(keyPath, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600)
+}
+
+func nodePublicKey() string {
+	return hex.EncodeToString(nodeKey.Public().(ed25519.PublicKey))
+}
+
+func loadTrustedKeys() map[string]bool {
+	f, err := os.Open(filepath.Join(options.SystemPath, "trusted_keys"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	keys := map[string]bool{nodePublicKey(): true}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys[strings.ToLower(strings.Fields(line)[0])] = true
+		}
+	}
+	return keys
+}
@@ -0,0 +1,343 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const osmMaxBlobSize = 64 << 20
+
+type osmVisitor struct {
+	node func(id int64, lat, lon float64)
+	way  func(id int64, tags map[string]string, refs []int64)
+}
+
+type osmBlock struct {
+	strings     [][]byte
+	granularity int64
+	latOffset   int64
+	lonOffset   int64
+}
+
+func readOSMPBF(path string, v osmVisitor) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if size > osmMaxBlobSize {
+			return fmt.Errorf("osm: blob header too large")
+		}
+		header := make([]byte, size)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+
+		var blobType string
+		var dataSize uint64
+		hr := &pbReader{buf: header}
+		for hr.more() {
+			field, wire, err := hr.key()
+			if err != nil {
+				return err
+			}
+			switch {
+			case field == 1 && wire == wireBytes:
+				b, err := hr.bytes()
+				if err != nil {
+					return err
+				}
+				blobType = string(b)
+			case field == 3 && wire == wireVarint:
+				if dataSize, err = hr.varint(); err != nil {
+					return err
+				}
+			default:
+				if err := hr.skip(wire); err != nil {
+					return err
+				}
+			}
+		}
+		if dataSize > osmMaxBlobSize {
+			return fmt.Errorf("osm: blob too large")
+		}
+
+		blob := make([]byte, dataSize)
+		if _, err := io.ReadFull(r, blob); err != nil {
+			return err
+		}
+		if blobType != "OSMData" {
+			continue
+		}
+		data, err := decodeOSMBlob(blob)
+		if err != nil {
+			return err
+		}
+		if err := decodeOSMBlock(data, v); err != nil {
+			return err
+		}
+	}
+}
+
+func decodeOSMBlob(blob []byte) ([]byte, error) {
+	r := &pbReader{buf: blob}
+	for r.more() {
+		field, wire, err := r.key()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			return r.bytes()
+		case field == 3 && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return io.ReadAll(zr)
+		case field >= 4 && wire == wireBytes:
+			return nil, fmt.Errorf("osm: unsupported blob compression %d", field)
+		default:
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("osm: empty blob")
+}
+
+func decodeOSMBlock(data []byte, v osmVisitor) error {
+	b := osmBlock{granularity: 100}
+	var groups [][]byte
+
+	r := &pbReader{buf: data}
+	for r.more() {
+		field, wire, err := r.key()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			st, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			sr := &pbReader{buf: st}
+			for sr.more() {
+				f, w, err := sr.key()
+				if err != nil {
+					return err
+				}
+				if f != 1 || w != wireBytes {
+					if err := sr.skip(w); err != nil {
+						return err
+					}
+					continue
+				}
+				s, err := sr.bytes()
+				if err != nil {
+					return err
+				}
+				b.strings = append(b.strings, s)
+			}
+		case field == 2 && wire == wireBytes:
+			g, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			groups = append(groups, g)
+		case field == 17 && wire == wireVarint:
+			g, err := r.varint()
+			if err != nil {
+				return err
+			}
+			b.granularity = int64(g)
+		case field == 19 && wire == wireVarint:
+			o, err := r.varint()
+			if err != nil {
+				return err
+			}
+			b.latOffset = int64(o)
+		case field == 20 && wire == wireVarint:
+			o, err := r.varint()
+			if err != nil {
+				return err
+			}
+			b.lonOffset = int64(o)
+		default:
+			if err := r.skip(wire); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, g := range groups {
+		gr := &pbReader{buf: g}
+		for gr.more() {
+			field, wire, err := gr.key()
+			if err != nil {
+				return err
+			}
+			if wire != wireBytes || (field == 1 || field == 2) && v.node == nil || field == 3 && v.way == nil {
+				if err := gr.skip(wire); err != nil {
+					return err
+				}
+				continue
+			}
+			msg, err := gr.bytes()
+			if err != nil {
+				return err
+			}
+			switch field {
+			case 1:
+				err = b.decodeNode(msg, v)
+			case 2:
+				err = b.decodeDenseNodes(msg, v)
+			case 3:
+				err = b.decodeWay(msg, v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *osmBlock) coord(offset, value int64) float64 {
+	return float64(offset+b.granularity*value) * 1e-9
+}
+
+func (b *osmBlock) decodeNode(data []byte, v osmVisitor) error {
+	var id, lat, lon int64
+	r := &pbReader{buf: data}
+	for r.more() {
+		field, wire, err := r.key()
+		if err != nil {
+			return err
+		}
+		if wire != wireVarint || (field != 1 && field != 8 && field != 9) {
+			if err := r.skip(wire); err != nil {
+				return err
+			}
+			continue
+		}
+		n, err := r.varint()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			id = zigzag(n)
+		case 8:
+			lat = zigzag(n)
+		case 9:
+			lon = zigzag(n)
+		}
+	}
+	v.node(id, b.coord(b.latOffset, lat), b.coord(b.lonOffset, lon))
+	return nil
+}
+
+func (b *osmBlock) decodeDenseNodes(data []byte, v osmVisitor) error {
+	var ids, lats, lons []uint64
+	r := &pbReader{buf: data}
+	for r.more() {
+		field, wire, err := r.key()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			ids, err = r.packedVarints()
+		case field == 8 && wire == wireBytes:
+			lats, err = r.packedVarints()
+		case field == 9 && wire == wireBytes:
+			lons, err = r.packedVarints()
+		default:
+			err = r.skip(wire)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(lats) != len(ids) || len(lons) != len(ids) {
+		return fmt.Errorf("osm: malformed dense nodes")
+	}
+
+	var id, lat, lon int64
+	for i := range ids {
+		id += zigzag(ids[i])
+		lat += zigzag(lats[i])
+		lon += zigzag(lons[i])
+		v.node(id, b.coord(b.latOffset, lat), b.coord(b.lonOffset, lon))
+	}
+	return nil
+}
+
+func (b *osmBlock) decodeWay(data []byte, v osmVisitor) error {
+	var id int64
+	var keys, vals, refs []uint64
+	r := &pbReader{buf: data}
+	for r.more() {
+		field, wire, err := r.key()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wire == wireVarint:
+			var n uint64
+			n, err = r.varint()
+			id = int64(n)
+		case field == 2 && wire == wireBytes:
+			keys, err = r.packedVarints()
+		case field == 3 && wire == wireBytes:
+			vals, err = r.packedVarints()
+		case field == 8 && wire == wireBytes:
+			refs, err = r.packedVarints()
+		default:
+			err = r.skip(wire)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	tags := make(map[string]string, len(keys))
+	for i := 0; i < len(keys) && i < len(vals); i++ {
+		if keys[i] < uint64(len(b.strings)) && vals[i] < uint64(len(b.strings)) {
+			tags[string(b.strings[keys[i]])] = string(b.strings[vals[i]])
+		}
+	}
+
+	nodes := make([]int64, len(refs))
+	var ref int64
+	for i, d := range refs {
+		ref += zigzag(d)
+		nodes[i] = ref
+	}
+	v.way(id, tags, nodes)
+	return nil
+}
@@ -0,0 +1,818 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	peerMaxEntries  = 10000
+	peerOfferWindow = 5 * time.Minute
+	peerPartSuffix  = ".part"
+	peerDefaultDest = "incoming"
+	peerJobTTL      = 24 * time.Hour
+	peerMaxJobs     = 200
+)
+
+var (
+	peerClient = &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}}
+
+	peerJobs   = map[string]*peerJob{}
+	peerJobsMu sync.Mutex
+
+	peerParts   = map[string]bool{}
+	peerPartsMu sync.Mutex
+
+	peerOfferNonces   = map[string]time.Time{}
+	peerOfferNoncesMu sync.Mutex
+
+	errPeerForbidden = errors.New("path is not shared")
+	errPeerUnknown   = errors.New("peer has not been discovered")
+	errPeerBusy      = errors.New("file is already being downloaded")
+)
+
+type peerJob struct {
+	info   PeerTransfer
+	base   string
+	node   string
+	run    func(context.Context, *peerJob) error
+	cancel context.CancelFunc
+}
+
+func peerBaseURL(ip string, port int) string {
+	return "http://" + net.JoinHostPort(strings.ReplaceAll(ip, "%", "%25"), strconv.Itoa(port))
+}
+
+// findPeer looks a discovered peer up by node id or address, then the
+// nodes reachable through the mesh by node id.
+func findPeer(id string) (Peer, bool) {
+	for _, p := range getDiscoveredPeers() {
+		if p.Node == id || p.IP == id {
+			return p, true
+		}
+	}
+	for _, p := range meshPeers() {
+		if p.Node == id {
+			return p, true
+		}
+	}
+	return Peer{}, false
+}
+
+func cleanPeerPath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// peerSafePath resolves a root-relative path for peers, keeping the system
+// directory (node key, databases) out of reach.
+func peerSafePath(rel string) (string, error) {
+	abs, err := getSafePath(rel)
+	if err != nil {
+		return "", err
+	}
+	sysAbs, _ := filepath.Abs(options.SystemPath)
+	if abs == sysAbs || strings.HasPrefix(abs, sysAbs+string(filepath.Separator)) {
+		return "", errPeerForbidden
+	}
+	return abs, nil
+}
+
+func peerEntry(rootAbs, abs string, info fs.FileInfo) PeerEntry {
+	rel, _ := filepath.Rel(rootAbs, abs)
+	e := PeerEntry{Name: info.Name(), Path: filepath.ToSlash(rel), IsDir: info.IsDir(), ModTime: info.ModTime().Unix()}
+	if !e.IsDir {
+		e.Size = info.Size()
+	}
+	return e
+}
+
+// listPeerFiles lists a path for peers. Recursive listings, the ones files
+// are pulled from, carry the sha256 of every file.
+func listPeerFiles(rel string, recursive bool) (PeerListing, error) {
+	listing := PeerListing{Node: nodeID, Name: appLabel, Path: cleanPeerPath(rel), Entries: []PeerEntry{}}
+	abs, err := peerSafePath(listing.Path)
+	if err != nil {
+		return listing, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return listing, err
+	}
+	rootAbs, _ := filepath.Abs(options.RootPath)
+	if !info.IsDir() {
+		listing.Entries = append(listing.Entries, peerEntry(rootAbs, abs, info))
+		if recursive {
+			listing.Entries = hashPeerEntries(rootAbs, listing.Entries)
+		}
+		return listing, nil
+	}
+
+	sysAbs, _ := filepath.Abs(options.SystemPath)
+	if recursive {
+		filepath.WalkDir(abs, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if p == sysAbs {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if len(listing.Entries) >= peerMaxEntries {
+				return filepath.SkipAll
+			}
+			if info, err := d.Info(); err == nil && info.Mode().IsRegular() && !strings.HasSuffix(p, peerPartSuffix) {
+				listing.Entries = append(listing.Entries, peerEntry(rootAbs, p, info))
+			}
+			return nil
+		})
+		listing.Entries = hashPeerEntries(rootAbs, listing.Entries)
+		return listing, nil
+	}
+
+	entries, err := os.ReadDir(abs)
+	if err != nil {
+		return listing, err
+	}
+	for _, d := range entries {
+		p := filepath.Join(abs, d.Name())
+		if p == sysAbs || strings.HasSuffix(p, peerPartSuffix) {
+			continue
+		}
+		if info, err := d.Info(); err == nil {
+			listing.Entries = append(listing.Entries, peerEntry(rootAbs, p, info))
+		}
+	}
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		a, b := listing.Entries[i], listing.Entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	return listing, nil
+}
+
+// hashPeerEntries fills in the sha256 of every file, dropping the ones that
+// cannot be read.
+func hashPeerEntries(rootAbs string, entries []PeerEntry) []PeerEntry {
+	hashed := entries[:0]
+	for _, e := range entries {
+		sum, err := cachedSHA256(filepath.Join(rootAbs, filepath.FromSlash(e.Path)), e)
+		if err != nil {
+			continue
+		}
+		e.SHA256 = sum
+		hashed = append(hashed, e)
+	}
+	return hashed
+}
+
+// samePeerFile tells whether the local file at abs already holds e, by
+// checksum when the peer sent one.
+func samePeerFile(abs string, info fs.FileInfo, e PeerEntry) bool {
+	if info.IsDir() || info.Size() != e.Size {
+		return false
+	}
+	if e.SHA256 == "" {
+		return true
+	}
+	sum, err := cachedSHA256(abs, PeerEntry{Size: info.Size(), ModTime: info.ModTime().Unix()})
+	return err == nil && sum == e.SHA256
+}
+
+func newPeerJob(direction, ip, name, base, p, dest string, run func(context.Context, *peerJob) error) *peerJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &peerJob{
+		info: PeerTransfer{
+			ID:        hex.EncodeToString(id),
+			Direction: direction,
+			Peer:      ip,
+			PeerName:  name,
+			Path:      p,
+			Dest:      dest,
+			Started:   time.Now().Unix(),
+		},
+		base: base,
+		run:  run,
+	}
+	peerJobsMu.Lock()
+	prunePeerJobs()
+	peerJobs[job.info.ID] = job
+	peerJobsMu.Unlock()
+	return job
+}
+
+// prunePeerJobs forgets finished transfers after peerJobTTL, and the oldest
+// of them beyond peerMaxJobs. The caller holds peerJobsMu.
+func prunePeerJobs() {
+	var finished []*peerJob
+	for id, job := range peerJobs {
+		if job.info.State == "" || job.info.State == "running" {
+			continue
+		}
+		if time.Since(time.Unix(job.info.Updated, 0)) > peerJobTTL {
+			delete(peerJobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if extra := len(peerJobs) - peerMaxJobs + 1; extra > 0 {
+		sort.Slice(finished, func(i, j int) bool { return finished[i].info.Updated < finished[j].info.Updated })
+		for _, job := range finished[:min(extra, len(finished))] {
+			delete(peerJobs, job.info.ID)
+		}
+	}
+}
+
+// resume restarts a failed or canceled job, unless it is running or done.
+func (j *peerJob) resume() bool {
+	peerJobsMu.Lock()
+	if j.info.State == "running" || j.info.State == "done" {
+		peerJobsMu.Unlock()
+		return false
+	}
+	j.info.State = "running"
+	peerJobsMu.Unlock()
+	j.start()
+	return true
+}
+
+// start runs the job in the background and returns a channel closed when it ends.
+func (j *peerJob) start() <-chan struct{} {
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	j.update(func(t *PeerTransfer) {
+		t.State = "running"
+		t.Error = ""
+	})
+	peerJobsMu.Lock()
+	j.cancel = cancel
+	peerJobsMu.Unlock()
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		err := j.run(ctx, j)
+		j.update(func(t *PeerTransfer) {
+			switch {
+			case ctx.Err() != nil:
+				t.State = "canceled"
+			case err != nil:
+				t.State = "failed"
+				t.Error = err.Error()
+			default:
+				t.State = "done"
+			}
+		})
+		info := j.snapshot()
+		appLogger.Printf("Peer %s %s %s: %s (%d/%d files, %d bytes) %s", info.Direction, info.Peer, info.Path, info.State, info.FilesDone, info.Files, info.Bytes, info.Error)
+	}()
+	return done
+}
+
+func (j *peerJob) update(fn func(*PeerTransfer)) {
+	peerJobsMu.Lock()
+	fn(&j.info)
+	j.info.Updated = time.Now().Unix()
+	peerJobsMu.Unlock()
+}
+
+func (j *peerJob) snapshot() PeerTransfer {
+	peerJobsMu.Lock()
+	defer peerJobsMu.Unlock()
+	return j.info
+}
+
+func (j *peerJob) Write(p []byte) (int, error) {
+	j.update(func(t *PeerTransfer) { t.Bytes += int64(len(p)) })
+	return len(p), nil
+}
+
+func getPeerJob(id string) *peerJob {
+	peerJobsMu.Lock()
+	defer peerJobsMu.Unlock()
+	return peerJobs[id]
+}
+
+func peerGetJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return peerResponseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type peerStatusError struct {
+	status  int
+	message string
+}
+
+func (e *peerStatusError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("status %d: %s", e.status, e.message)
+	}
+	return fmt.Sprintf("status %d", e.status)
+}
+
+func peerResponseError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+	return &peerStatusError{status: resp.StatusCode, message: body.Error}
+}
+
+// runPeerPull mirrors a remote file or folder into dest. Files are written to
+// a .part file first and a later run resumes them with a Range request. A
+// local file that differs is kept, and the remote one saved next to it.
+func runPeerPull(ctx context.Context, j *peerJob) error {
+	info := j.snapshot()
+	var listing PeerListing
+	if err := peerGetJSON(ctx, j.base+"/peer/api/files?recursive=1&path="+url.QueryEscape(info.Path), &listing); err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range listing.Entries {
+		total += e.Size
+	}
+	j.update(func(t *PeerTransfer) {
+		t.PeerName = listing.Name
+		t.Files = len(listing.Entries)
+		t.FilesDone = 0
+		t.Bytes = 0
+		t.Total = total
+	})
+
+	prefix := path.Dir(listing.Path)
+	for _, e := range listing.Entries {
+		rel, ok := e.Path, true
+		if prefix != "." {
+			rel, ok = strings.CutPrefix(e.Path, prefix+"/")
+		}
+		if !ok || !filepath.IsLocal(rel) {
+			return fmt.Errorf("invalid remote path %q", e.Path)
+		}
+		abs, err := peerSafePath(path.Join(info.Dest, rel))
+		if err != nil {
+			return err
+		}
+		conflict := false
+		if info, err := os.Stat(abs); err == nil && !info.IsDir() && !samePeerFile(abs, info, e) {
+			abs, conflict = bundleConflictPath(abs, listing.Node), true
+		}
+		if info, err := os.Stat(abs); err == nil && samePeerFile(abs, info, e) {
+			j.update(func(t *PeerTransfer) {
+				t.Bytes += e.Size
+				t.FilesDone++
+			})
+			continue
+		}
+		if err := fetchPeerFile(ctx, j, e, abs); err != nil {
+			return fmt.Errorf("%s: %w", e.Path, err)
+		}
+		if conflict {
+			appLogger.Printf("Peer pull %s: %s differs locally, saved %s copy as %s", info.Peer, e.Path, listing.Name, abs)
+		}
+		j.update(func(t *PeerTransfer) {
+			t.FilesDone++
+			if conflict {
+				t.Conflicts++
+			}
+		})
+	}
+	return nil
+}
+
+func fetchPeerFile(ctx context.Context, j *peerJob, e PeerEntry, abs string) error {
+	if err := os.MkdirAll(filepath.Dir(abs), os.ModePerm); err != nil {
+		return err
+	}
+	part := abs + peerPartSuffix
+	peerPartsMu.Lock()
+	busy := peerParts[part]
+	peerParts[part] = true
+	peerPartsMu.Unlock()
+	if busy {
+		return errPeerBusy
+	}
+	defer func() {
+		peerPartsMu.Lock()
+		delete(peerParts, part)
+		peerPartsMu.Unlock()
+	}()
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// A .part carries the modification time of the remote file it was
+	// started from, and is only continued for that same version.
+	mtime := time.Unix(e.ModTime, 0)
+	defer os.Chtimes(part, mtime, mtime)
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if st, err := f.Stat(); err != nil || st.ModTime().Unix() != e.ModTime || offset > e.Size {
+		offset = 0
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", j.base+(&url.URL{Path: "/download/" + e.Path}).EscapedPath(), nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", mtime.UTC().Format(http.TimeFormat))
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset != e.Size {
+			return peerResponseError(resp)
+		}
+	default:
+		return peerResponseError(resp)
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	j.update(func(t *PeerTransfer) { t.Bytes += offset })
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if _, err := io.Copy(io.MultiWriter(f, j), resp.Body); err != nil {
+			return err
+		}
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if size != e.Size {
+		return fmt.Errorf("short transfer: %d of %d bytes", size, e.Size)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if e.SHA256 != "" {
+		if sum, err := fileSHA256(part); err != nil || sum != e.SHA256 {
+			os.Remove(part)
+			return fmt.Errorf("checksum mismatch")
+		}
+	}
+	if err := os.Rename(part, abs); err != nil {
+		return err
+	}
+	os.Chtimes(abs, mtime, mtime)
+	return nil
+}
+
+// payload is what an offer signs: besides what to pull, the node it is for,
+// the address it comes from and a nonce, so it cannot be replayed.
+func (o PeerOffer) payload() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%d\n%s\n%s\n%d\n%s\n%s\n%s", o.Node, o.PublicKey, o.Port, o.Path, o.Dest, o.Time, o.Target, o.Source, o.Nonce))
+}
+
+// usePeerOfferNonce accepts every offer nonce once within the offer window.
+func usePeerOfferNonce(nonce string) bool {
+	peerOfferNoncesMu.Lock()
+	defer peerOfferNoncesMu.Unlock()
+	now := time.Now()
+	for n, seen := range peerOfferNonces {
+		if now.Sub(seen) > 2*peerOfferWindow {
+			delete(peerOfferNonces, n)
+		}
+	}
+	if _, ok := peerOfferNonces[nonce]; ok || len(nonce) < 16 || len(nonce) > 64 {
+		return false
+	}
+	peerOfferNonces[nonce] = now
+	return true
+}
+
+// localAddressFor returns our address on the route to the host of base.
+func localAddressFor(base string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), "9"))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// runPeerSend asks the peer to pull from us and mirrors its progress.
+func runPeerSend(ctx context.Context, j *peerJob) error {
+	info := j.snapshot()
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	offer := PeerOffer{
+		Node:      nodeID,
+		Name:      appLabel,
+		PublicKey: nodePublicKey(),
+		Port:      options.WebPort,
+		Path:      info.Path,
+		Dest:      info.Dest,
+		Time:      time.Now().Unix(),
+		Target:    j.node,
+		Source:    localAddressFor(j.base),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+	offer.Signature = hex.EncodeToString(ed25519.Sign(nodeKey, offer.payload()))
+	data, _ := json.Marshal(offer)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", j.base+"/peer/api/offer", strings.NewReader(string(data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	var remote PeerTransfer
+	if resp.StatusCode != http.StatusOK {
+		err = peerResponseError(resp)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&remote)
+	}
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if err := peerGetJSON(ctx, j.base+"/peer/api/transfer?id="+url.QueryEscape(remote.ID), &remote); err != nil {
+			return err
+		}
+		j.update(func(t *PeerTransfer) {
+			t.Files, t.FilesDone, t.Bytes, t.Total = remote.Files, remote.FilesDone, remote.Bytes, remote.Total
+		})
+		switch remote.State {
+		case "done":
+			return nil
+		case "failed", "canceled":
+			return fmt.Errorf("peer %s: %s", remote.State, remote.Error)
+		}
+	}
+}
+
+func peerFilesHandler(w http.ResponseWriter, r *http.Request) {
+	listing, err := listPeerFiles(r.URL.Query().Get("path"), r.URL.Query().Get("recursive") == "1")
+	switch {
+	case errors.Is(err, errPeerForbidden):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, fs.ErrNotExist):
+		writeJSONError(w, http.StatusNotFound, "not found")
+	case err != nil:
+		writeJSONError(w, http.StatusBadRequest, "invalid path")
+	default:
+		writeJSON(w, http.StatusOK, listing)
+	}
+}
+
+func peerTransferHandler(w http.ResponseWriter, r *http.Request) {
+	job := getPeerJob(r.URL.Query().Get("id"))
+	if job == nil {
+		writeJSONError(w, http.StatusNotFound, "transfer not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
+
+// peerOfferHandler lets another node push files by asking us to pull them.
+// Offers must be signed by a key listed in sys/trusted_keys, or by any key
+// with -open-offers, for this node, from the address they arrive from and
+// by the key pinned for the sending node.
+func peerOfferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var offer PeerOffer
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&offer); err != nil || offer.Port <= 0 || offer.Port > 65535 {
+		writeJSONError(w, http.StatusBadRequest, "invalid offer")
+		return
+	}
+	if d := time.Since(time.Unix(offer.Time, 0)); d > peerOfferWindow || d < -peerOfferWindow {
+		writeJSONError(w, http.StatusForbidden, "offer expired")
+		return
+	}
+	pub, err := hex.DecodeString(offer.PublicKey)
+	sig, serr := hex.DecodeString(offer.Signature)
+	if err != nil || serr != nil || len(pub) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(pub), offer.payload(), sig) {
+		writeJSONError(w, http.StatusForbidden, "invalid signature")
+		return
+	}
+	key := strings.ToLower(offer.PublicKey)
+	if !options.OpenOffers && !loadTrustedKeys()[key] {
+		writeJSONError(w, http.StatusForbidden, "untrusted node")
+		return
+	}
+	relayed := meshRelayed(r)
+	ip := remoteIP(r)
+	host, _, _ := strings.Cut(ip, "%")
+	if offer.Target != nodeID || !validNodeID(offer.Node) || !relayed && !net.ParseIP(offer.Source).Equal(net.ParseIP(host)) {
+		writeJSONError(w, http.StatusForbidden, "offer is not for this node")
+		return
+	}
+	if pinned, ok := pinnedPeerKey(offer.Node); ok && pinned != key || !ok && relayed {
+		writeJSONError(w, http.StatusForbidden, errIdentPinned.Error())
+		return
+	}
+	if !usePeerOfferNonce(offer.Nonce) {
+		writeJSONError(w, http.StatusForbidden, "offer already used")
+		return
+	}
+	if offer.Dest == "" {
+		offer.Dest = peerDefaultDest
+	}
+	offer.Dest = cleanPeerPath(offer.Dest)
+	if _, err := peerSafePath(offer.Dest); err != nil {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	base := peerBaseURL(ip, offer.Port)
+	if relayed {
+		// Relayed offers are pulled back along the mesh.
+		peer, ok := findPeer(offer.Node)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, errMeshNoRoute.Error())
+			return
+		}
+		base = peerBase(peer)
+	}
+	if relayed {
+		ip = offer.Node
+	}
+	job := newPeerJob("pull", ip, offer.Name, base, cleanPeerPath(offer.Path), offer.Dest, runPeerPull)
+	job.start()
+	appLogger.Printf("Peer offer from %s (%s): %s -> %s", offer.Name, ip, offer.Path, offer.Dest)
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
+
+func peerBrowseHandler(w http.ResponseWriter, r *http.Request) {
+	peer, ok := findPeer(r.URL.Query().Get("peer"))
+	if !ok {
+		writeJSONError(w, http.StatusForbidden, errPeerUnknown.Error())
+		return
+	}
+	var listing PeerListing
+	u := peerBase(peer) + "/peer/api/files?path=" + url.QueryEscape(r.URL.Query().Get("path"))
+	if err := peerGetJSON(r.Context(), u, &listing); err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, listing)
+}
+
+func peerTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	if options.Password != "" && !isAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		peerJobsMu.Lock()
+		list := []PeerTransfer{}
+		for _, job := range peerJobs {
+			list = append(list, job.info)
+		}
+		peerJobsMu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Started > list[j].Started })
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		var input struct {
+			Action string `json:"action"`
+			Peer   string `json:"peer"`
+			Path   string `json:"path"`
+			Dest   string `json:"dest"`
+			ID     string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+		if input.Action == "resume" {
+			job := getPeerJob(input.ID)
+			if job == nil {
+				writeJSONError(w, http.StatusNotFound, "transfer not found")
+				return
+			}
+			if !job.resume() {
+				writeJSONError(w, http.StatusConflict, "transfer is "+job.snapshot().State)
+				return
+			}
+			writeJSON(w, http.StatusOK, job.snapshot())
+			return
+		}
+
+		run := runPeerPull
+		switch input.Action {
+		case "pull":
+		case "send":
+			run = runPeerSend
+		default:
+			writeJSONError(w, http.StatusBadRequest, "action must be pull, send or resume")
+			return
+		}
+		peer, ok := findPeer(input.Peer)
+		if !ok {
+			writeJSONError(w, http.StatusForbidden, errPeerUnknown.Error())
+			return
+		}
+		input.Path = cleanPeerPath(input.Path)
+		if input.Dest == "" {
+			input.Dest = peerDefaultDest
+		}
+		input.Dest = cleanPeerPath(input.Dest)
+		check := input.Dest
+		if input.Action == "send" {
+			check = input.Path
+		}
+		if _, err := peerSafePath(check); err != nil {
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+
+		job := newPeerJob(input.Action, peer.IP, peer.Name, peerBase(peer), input.Path, input.Dest, run)
+		job.node = peer.Node
+		job.start()
+		appLogger.Printf("Peer %s %s by %s: %s -> %s", input.Action, peer.IP, r.RemoteAddr, input.Path, input.Dest)
+		writeJSON(w, http.StatusOK, job.snapshot())
+	case "DELETE":
+		job := getPeerJob(r.URL.Query().Get("id"))
+		if job == nil {
+			writeJSONError(w, http.StatusNotFound, "transfer not found")
+			return
+		}
+		peerJobsMu.Lock()
+		if job.cancel != nil {
+			job.cancel()
+		}
+		peerJobsMu.Unlock()
+		writeJSON(w, http.StatusOK, job.snapshot())
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
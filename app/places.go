@@ -0,0 +1,329 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	placesScanInterval = 30 * time.Second
+	placesMaxResults   = 20
+)
+
+var (
+	placesDB       *sql.DB
+	placesDBMutex  sync.Mutex
+	placesMutex    sync.Mutex
+	placesLastScan atomic.Int64
+	placeLayers    = map[string]bool{"place": true, "places": true}
+)
+
+type Place struct {
+	Name   string  `json:"name"`
+	Kind   string  `json:"kind"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Source string  `json:"source"`
+}
+
+func openPlacesDB() (*sql.DB, error) {
+	placesDBMutex.Lock()
+	defer placesDBMutex.Unlock()
+	if placesDB != nil {
+		return placesDB, nil
+	}
+	db, err := sql.Open("sqlite", options.PlacesPath+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// Sources indexed before the word table existed have to be read again.
+	var words int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'place_words'").Scan(&words)
+	schema := []string{
+		"CREATE TABLE IF NOT EXISTS sources (path TEXT PRIMARY KEY, size INTEGER, mtime INTEGER)",
+		"CREATE TABLE IF NOT EXISTS places (id INTEGER PRIMARY KEY, source TEXT, name TEXT, search TEXT, kind TEXT, lat REAL, lon REAL)",
+		"CREATE INDEX IF NOT EXISTS places_search ON places(search)",
+		"CREATE INDEX IF NOT EXISTS places_source ON places(source)",
+		"CREATE TABLE IF NOT EXISTS place_words (word TEXT, place INTEGER)",
+		"CREATE INDEX IF NOT EXISTS place_words_word ON place_words(word)",
+		"CREATE INDEX IF NOT EXISTS place_words_place ON place_words(place)",
+	}
+	if words == 0 {
+		schema = append(schema, "DELETE FROM sources")
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	placesDB = db
+	return db, nil
+}
+
+func startPlaceIndex() {
+	go refreshPlaceIndex()
+}
+
+func refreshPlaceIndex() {
+	if !placesMutex.TryLock() {
+		return
+	}
+	defer placesMutex.Unlock()
+	placesLastScan.Store(time.Now().Unix())
+
+	db, err := openPlacesDB()
+	if err != nil {
+		appLogger.Printf("Places: failed to open index: %v", err)
+		return
+	}
+
+	found := findTreeFiles(".mbtiles", ".pmtiles")
+	gazetteers, _ := filepath.Glob(filepath.Join(options.SystemPath, "gazetteer*.csv"))
+	for _, path := range gazetteers {
+		if info, err := os.Stat(path); err == nil {
+			found["sys:"+filepath.Base(path)] = info
+		}
+	}
+
+	known := make(map[string][2]int64)
+	rows, err := db.Query("SELECT path, size, mtime FROM sources")
+	if err == nil {
+		for rows.Next() {
+			var path string
+			var size, mtime int64
+			if rows.Scan(&path, &size, &mtime) == nil {
+				known[path] = [2]int64{size, mtime}
+			}
+		}
+		rows.Close()
+	}
+
+	for source := range known {
+		if _, ok := found[source]; !ok {
+			removePlaceSource(db, source)
+		}
+	}
+
+	for source, info := range found {
+		if k, ok := known[source]; ok && k[0] == info.Size() && k[1] == info.ModTime().Unix() {
+			continue
+		}
+		start := time.Now()
+		count, err := indexPlaceSource(db, source, info)
+		if err != nil {
+			appLogger.Printf("Places: failed to index %s: %v", source, err)
+			continue
+		}
+		appLogger.Printf("Places: indexed %d names from %s in %s", count, source, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+func removePlaceSource(db *sql.DB, source string) {
+	db.Exec("DELETE FROM place_words WHERE place IN (SELECT id FROM places WHERE source = ?)", source)
+	db.Exec("DELETE FROM places WHERE source = ?", source)
+	db.Exec("DELETE FROM sources WHERE path = ?", source)
+}
+
+func indexPlaceSource(db *sql.DB, source string, info os.FileInfo) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM place_words WHERE place IN (SELECT id FROM places WHERE source = ?)", source); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM places WHERE source = ?", source); err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare("INSERT INTO places (source, name, search, kind, lat, lon) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	wordStmt, err := tx.Prepare("INSERT INTO place_words (word, place) VALUES (?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer wordStmt.Close()
+
+	count := 0
+	seen := make(map[string]bool)
+	add := func(name, kind string, lat, lon float64) {
+		key := name + "|" + strconv.FormatFloat(lat, 'f', 2, 64) + "|" + strconv.FormatFloat(lon, 'f', 2, 64)
+		if name == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		search := normalizePlaceName(name)
+		res, err := stmt.Exec(source, name, search, kind, lat, lon)
+		if err != nil {
+			return
+		}
+		count++
+		// Each later word is stored with the rest of the name, so a search
+		// for "york" or "york city" finds "new york city" by prefix.
+		if id, err := res.LastInsertId(); err == nil {
+			for i, c := range search {
+				if c == ' ' {
+					wordStmt.Exec(search[i+1:], id)
+				}
+			}
+		}
+	}
+
+	if strings.HasPrefix(source, "sys:") {
+		err = readGazetteer(filepath.Join(options.SystemPath, strings.TrimPrefix(source, "sys:")), add)
+	} else {
+		path, perr := getSafePath(source)
+		if perr != nil {
+			return 0, perr
+		}
+		visit := func(z, x, y int, data []byte) error {
+			points, _ := decodeVectorPoints(data, z, x, y, placeLayers)
+			for _, p := range points {
+				name, _ := p.Props["name"].(string)
+				add(name, placeKind(p.Props), p.Lat, p.Lon)
+			}
+			return nil
+		}
+		if strings.HasSuffix(strings.ToLower(source), ".pmtiles") {
+			err = walkPMTiles(path, visit)
+		} else {
+			err = walkMBTiles(path, visit)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("INSERT OR REPLACE INTO sources (path, size, mtime) VALUES (?, ?, ?)", source, info.Size(), info.ModTime().Unix()); err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+func readGazetteer(path string, add func(name, kind string, lat, lon float64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				continue
+			}
+			return err
+		}
+		if len(record) < 3 {
+			continue
+		}
+		lat, errLat := strconv.ParseFloat(record[1], 64)
+		lon, errLon := strconv.ParseFloat(record[2], 64)
+		if errLat != nil || errLon != nil {
+			continue
+		}
+		kind := ""
+		if len(record) > 3 {
+			kind = strings.TrimSpace(record[3])
+		}
+		add(strings.TrimSpace(record[0]), kind, lat, lon)
+	}
+}
+
+func placeKind(props map[string]interface{}) string {
+	for _, key := range []string{"class", "kind", "pmap:kind", "type"} {
+		if v, ok := props[key].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func normalizePlaceName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+func searchPlaces(query, file string) ([]Place, error) {
+	db, err := openPlacesDB()
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefixes are matched as byte ranges, which unlike LIKE can use the
+	// indexes; 0xff never occurs in UTF-8, so it closes the range.
+	q := normalizePlaceName(query)
+	upper := q + "\xff"
+	sqlQuery := "SELECT name, kind, lat, lon, source FROM places WHERE id IN (SELECT id FROM places WHERE search >= ? AND search < ? UNION SELECT place FROM place_words WHERE word >= ? AND word < ?)"
+	args := []interface{}{q, upper, q, upper}
+	if file != "" {
+		sqlQuery += " AND (source = ? OR source LIKE 'sys:%')"
+		args = append(args, file)
+	}
+	sqlQuery += " ORDER BY search = ? DESC, (search >= ? AND search < ?) DESC, length(name) LIMIT ?"
+	args = append(args, q, q, upper, placesMaxResults)
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []Place{}
+	for rows.Next() {
+		var p Place
+		if err := rows.Scan(&p.Name, &p.Kind, &p.Lat, &p.Lon, &p.Source); err == nil {
+			results = append(results, p)
+		}
+	}
+	return results, rows.Err()
+}
+
+func mapSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if time.Since(time.Unix(placesLastScan.Load(), 0)) > placesScanInterval {
+		go refreshPlaceIndex()
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	results := []Place{}
+	if query != "" {
+		file := strings.TrimPrefix(r.URL.Query().Get("file"), "/")
+		for _, prefix := range []string{"map/", "download/"} {
+			file = strings.TrimPrefix(file, prefix)
+		}
+		var err error
+		results, err = searchPlaces(query, file)
+		if err != nil {
+			appLogger.Printf("Places: search failed: %v", err)
+			http.Error(w, "Search failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(results)
+}
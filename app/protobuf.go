@@ -0,0 +1,119 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type pbReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *pbReader) more() bool {
+	return r.pos < len(r.buf)
+}
+
+func (r *pbReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, fmt.Errorf("protobuf: bad varint at %d", r.pos)
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *pbReader) key() (int, int, error) {
+	v, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(v >> 3), int(v & 7), nil
+}
+
+func (r *pbReader) bytes() ([]byte, error) {
+	l, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(len(r.buf)-r.pos) {
+		return nil, fmt.Errorf("protobuf: truncated field at %d", r.pos)
+	}
+	b := r.buf[r.pos : r.pos+int(l)]
+	r.pos += int(l)
+	return b, nil
+}
+
+func (r *pbReader) fixed32() (uint32, error) {
+	if r.pos+4 > len(r.buf) {
+		return 0, fmt.Errorf("protobuf: truncated fixed32 at %d", r.pos)
+	}
+	v := binary.LittleEndian.Uint32(r.buf[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *pbReader) fixed64() (uint64, error) {
+	if r.pos+8 > len(r.buf) {
+		return 0, fmt.Errorf("protobuf: truncated fixed64 at %d", r.pos)
+	}
+	v := binary.LittleEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+	return v, nil
+}
+
+func (r *pbReader) skip(wire int) error {
+	var err error
+	switch wire {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed64()
+	case wireBytes:
+		_, err = r.bytes()
+	case wireFixed32:
+		_, err = r.fixed32()
+	default:
+		err = fmt.Errorf("protobuf: unsupported wire type %d", wire)
+	}
+	return err
+}
+
+func (r *pbReader) packedVarints() ([]uint64, error) {
+	b, err := r.bytes()
+	if err != nil {
+		return nil, err
+	}
+	sub := pbReader{buf: b}
+	var out []uint64
+	for sub.more() {
+		v, err := sub.varint()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func float32bits(v uint32) float64 {
+	return float64(math.Float32frombits(v))
+}
+
+func float64bits(v uint64) float64 {
+	return math.Float64frombits(v)
+}
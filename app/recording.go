@@ -0,0 +1,257 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	recordingsDir       = "recordings"
+	recordingSampleRate = adpcmSampleRate
+	wavHeaderSize       = 44
+	recordingQueue      = 250
+	recordingMaxFiles   = 100
+)
+
+var (
+	recordCtl = make(chan recordRequest)
+
+	errRoomEmpty        = errors.New("room is empty")
+	errNotRecording     = errors.New("room is not being recorded")
+	errAlreadyRecording = errors.New("room is already being recorded")
+)
+
+type recordRequest struct {
+	room   string
+	action string
+	by     string
+	reply  chan recordResult
+}
+
+type recordResult struct {
+	info   RecordingInfo
+	active []RecordingInfo
+	done   <-chan error
+	err    error
+}
+
+// roomRecorder belongs to the hub, which hands the mixed frames to a
+// goroutine of its own, so slow storage never holds up the rooms.
+type roomRecorder struct {
+	file    *os.File
+	frames  chan []float32
+	done    chan error
+	samples int64
+	dropped int64
+	info    RecordingInfo
+	started time.Time
+}
+
+func startRecorder(room, by string, clients map[*Client]bool) (*roomRecorder, error) {
+	dir := filepath.Join(options.RootPath, recordingsDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	// Two recordings started in the same second get a numbered name instead
+	// of overwriting each other.
+	base := fmt.Sprintf("%s-%s", room, now.Format("20060102-150405"))
+	var f *os.File
+	var name string
+	for i := 1; f == nil; i++ {
+		if i > recordingMaxFiles {
+			return nil, fmt.Errorf("too many recordings named %s", base)
+		}
+		name = base + ".wav"
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d.wav", base, i)
+		}
+		var err error
+		f, err = os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+
+	rec := &roomRecorder{
+		file:    f,
+		frames:  make(chan []float32, recordingQueue),
+		done:    make(chan error, 1),
+		started: now,
+		info: RecordingInfo{
+			Room:      room,
+			File:      filepath.ToSlash(filepath.Join(recordingsDir, name)),
+			Started:   now.Unix(),
+			StartedBy: by,
+			Events:    []RecordingEvent{},
+		},
+	}
+	for _, p := range buildRoster(room, clients).Participants {
+		rec.info.Participants = append(rec.info.Participants, p.Name)
+	}
+	go rec.run()
+	return rec, nil
+}
+
+// write queues a frame; when the disk falls that far behind the frame is
+// dropped rather than stalling the hub.
+func (r *roomRecorder) write(mix []float32) {
+	select {
+	case r.frames <- mix:
+		r.samples += int64(len(mix) / adpcmRatio)
+	default:
+		r.dropped++
+	}
+}
+
+func (r *roomRecorder) event(event, name string) {
+	r.info.Events = append(r.info.Events, RecordingEvent{
+		Offset: float64(time.Since(r.started).Milliseconds()) / 1000,
+		Event:  event,
+		Name:   name,
+	})
+	if event == "join" && !slices.Contains(r.info.Participants, name) {
+		r.info.Participants = append(r.info.Participants, name)
+	}
+}
+
+// stop ends the recording and returns its final info; done reports once the
+// file is complete.
+func (r *roomRecorder) stop() (RecordingInfo, <-chan error) {
+	r.info.Stopped = time.Now().Unix()
+	r.info.Duration = float64(r.samples) / recordingSampleRate
+	sort.Strings(r.info.Participants)
+	if r.dropped > 0 && appLogger != nil {
+		appLogger.Printf("Room %s recording: dropped %d frames, storage too slow", r.info.Room, r.dropped)
+	}
+	info := r.info
+	close(r.frames)
+	return info, r.done
+}
+
+func (r *roomRecorder) run() {
+	err := r.save()
+	if err != nil && appLogger != nil {
+		appLogger.Printf("Room %s recording failed: %v", r.info.Room, err)
+	}
+	r.done <- err
+}
+
+func (r *roomRecorder) save() error {
+	w := bufio.NewWriter(r.file)
+	// The header is rewritten with the final sizes when the recording stops.
+	w.Write(make([]byte, wavHeaderSize))
+	buf := make([]byte, 2)
+	var samples int64
+	for mix := range r.frames {
+		for _, s := range downsample(mix) {
+			binary.LittleEndian.PutUint16(buf, uint16(int16(clampInt16(int(s*32767)))))
+			w.Write(buf)
+		}
+		samples += int64(len(mix) / adpcmRatio)
+	}
+	if err := w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	if _, err := r.file.WriteAt(wavHeader(samples), 0); err != nil {
+		r.file.Close()
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	// The hub is done with the info once frames is closed.
+	meta, err := json.MarshalIndent(r.info, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(options.RootPath, filepath.FromSlash(strings.TrimSuffix(r.info.File, ".wav")+".json"))
+	return os.WriteFile(path, meta, 0644)
+}
+
+func wavHeader(samples int64) []byte {
+	dataSize := uint32(samples * 2)
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+dataSize)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1)
+	binary.LittleEndian.PutUint16(h[22:], 1)
+	binary.LittleEndian.PutUint32(h[24:], recordingSampleRate)
+	binary.LittleEndian.PutUint32(h[28:], recordingSampleRate*2)
+	binary.LittleEndian.PutUint16(h[32:], 2)
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataSize)
+	return h
+}
+
+func recordHandler(w http.ResponseWriter, r *http.Request) {
+	if !roomAdmin(r) {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	req := recordRequest{action: "list", by: r.RemoteAddr, reply: make(chan recordResult)}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var input struct {
+			Name   string `json:"name"`
+			Action string `json:"action"`
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+				return
+			}
+		} else {
+			input.Name = r.FormValue("name")
+			input.Action = r.FormValue("action")
+		}
+		if input.Action != "start" && input.Action != "stop" {
+			writeJSONError(w, http.StatusBadRequest, "action must be start or stop")
+			return
+		}
+		req.room = normalizeRoomName(input.Name)
+		req.action = input.Action
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	recordCtl <- req
+	res := <-req.reply
+	if res.err == nil && res.done != nil {
+		res.err = <-res.done
+	}
+	if res.err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(res.err, errRoomEmpty) || errors.Is(res.err, errNotRecording) || errors.Is(res.err, errAlreadyRecording) {
+			status = http.StatusConflict
+		}
+		writeJSONError(w, status, res.err.Error())
+		return
+	}
+	if req.action == "list" {
+		writeJSON(w, http.StatusOK, res.active)
+		return
+	}
+	appLogger.Printf("Room %s recording %s by %s: %s", req.room, req.action, r.RemoteAddr, res.info.File)
+	writeJSON(w, http.StatusOK, res.info)
+}
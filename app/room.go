@@ -0,0 +1,768 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait   = 10 * time.Second
+	pingPeriod  = (60 * time.Second * 9) / 10
+	pongWait    = 60 * time.Second
+	sendBuffer  = 256
+	defaultRoom = "main"
+
+	speakingCheck   = 250 * time.Millisecond
+	speakingTimeout = 700 * time.Millisecond
+	maxNickSize     = 32
+
+	roomAccessCookie   = "taz_room_"
+	roomPasswordRounds = 100000
+)
+
+var (
+	upgrader = websocket.Upgrader{
+		CheckOrigin: checkRoomOrigin,
+	}
+	register   = make(chan *Client)
+	unregister = make(chan *Client)
+	broadcast  = make(chan Packet)
+	control    = make(chan controlMessage)
+	floorSet   = make(chan floorUpdate)
+	roomCounts = make(chan chan map[string]int)
+	clientSeq  atomic.Int64
+)
+
+type Client struct {
+	conn     *websocket.Conn
+	send     chan Packet
+	room     string
+	ip       string
+	admin    bool
+	identity string
+
+	id        int64
+	name      string
+	joined    bool
+	muted     bool
+	speaking  bool
+	lastAudio time.Time
+	audio     *jitterBuffer
+	codec     string
+	talkLimit time.Duration
+	// nick mirrors name for readPump, which stamps it on chat messages.
+	nick atomic.Pointer[string]
+}
+
+func (c *Client) setName(name string) {
+	c.name = name
+	c.nick.Store(&name)
+}
+
+func (c *Client) chatName() string {
+	if name := c.nick.Load(); name != nil {
+		return *name
+	}
+	return ""
+}
+
+type controlMessage struct {
+	client    *Client
+	Type      string          `json:"type"`
+	Name      string          `json:"name"`
+	Muted     *bool           `json:"muted"`
+	To        int64           `json:"to"`
+	Kind      string          `json:"kind"`
+	Data      json.RawMessage `json:"data"`
+	Recipient string          `json:"recipient"`
+	Message   string          `json:"message"`
+}
+
+var controlTypes = map[string]bool{"join": true, "nick": true, "mute": true, "talk": true, "release": true, "signal": true, "dm": true}
+
+type Packet struct {
+	Sender  *Client
+	MsgType int
+	Data    []byte
+}
+
+func init() {
+	go runHub()
+}
+
+func runHub() {
+	rooms := make(map[string]map[*Client]bool)
+	floors := make(map[string]*floorState)
+	recorders := make(map[string]*roomRecorder)
+	ticker := time.NewTicker(speakingCheck)
+	defer ticker.Stop()
+	mixer := time.NewTicker(mixFrameTime)
+	defer mixer.Stop()
+
+	var remove func(client *Client)
+	send := func(clients map[*Client]bool, packet Packet) {
+		var slow []*Client
+		for client := range clients {
+			if client != packet.Sender {
+				select {
+				case client.send <- packet:
+				default:
+					slow = append(slow, client)
+				}
+			}
+		}
+		// A slow client leaves like any other, after the loop since leaving
+		// notifies the room again.
+		for _, client := range slow {
+			if !rooms[client.room][client] {
+				continue
+			}
+			remove(client)
+			roomMetrics.droppedClients.Add(1)
+			if appLogger != nil {
+				appLogger.Printf("Room %s: dropped slow client %s", client.room, client.ip)
+			}
+		}
+	}
+	sendJSON := func(room string, v interface{}) {
+		if data, err := json.Marshal(v); err == nil {
+			send(rooms[room], Packet{MsgType: websocket.TextMessage, Data: data})
+		}
+	}
+	sendRoster := func(room string) {
+		sendJSON(room, buildRoster(room, rooms[room]))
+	}
+	sendFloor := func(room string) {
+		sendJSON(room, floors[room].info(room))
+	}
+	sendRecording := func(room string) {
+		sendJSON(room, map[string]interface{}{"type": "recording", "room": room, "active": recorders[room] != nil})
+	}
+	recordEvent := func(client *Client, event, name string) {
+		if rec := recorders[client.room]; rec != nil {
+			rec.event(event, name)
+		}
+	}
+	stopRecording := func(room string) (RecordingInfo, <-chan error) {
+		rec := recorders[room]
+		delete(recorders, room)
+		return rec.stop()
+	}
+	remove = func(client *Client) {
+		clients := rooms[client.room]
+		delete(clients, client)
+		close(client.send)
+		if client.joined {
+			recordEvent(client, "leave", client.name)
+		}
+		if len(clients) == 0 {
+			delete(rooms, client.room)
+			delete(floors, client.room)
+			if recorders[client.room] != nil {
+				stopRecording(client.room)
+			}
+			return
+		}
+		if f := floors[client.room]; f != nil && f.release(client, time.Now()) {
+			sendFloor(client.room)
+		}
+		if client.joined {
+			sendJSON(client.room, PresenceEvent{Type: "presence", Event: "leave", ID: client.id, Name: client.name})
+		}
+		sendRoster(client.room)
+	}
+
+	for {
+		select {
+		case client := <-register:
+			if rooms[client.room] == nil {
+				rooms[client.room] = make(map[*Client]bool)
+			}
+			rooms[client.room][client] = true
+			if floors[client.room] == nil && client.talkLimit > 0 {
+				floors[client.room] = &floorState{limit: client.talkLimit}
+			}
+			if data, err := json.Marshal(map[string]interface{}{"type": "welcome", "id": client.id, "admin": client.admin, "room": client.room, "codec": client.codec, "rate": codecRate(client.codec)}); err == nil {
+				client.send <- Packet{MsgType: websocket.TextMessage, Data: data}
+			}
+			sendRoster(client.room)
+			if floors[client.room] != nil {
+				sendFloor(client.room)
+			}
+			if recorders[client.room] != nil {
+				sendRecording(client.room)
+			}
+			if appLogger != nil {
+				appLogger.Printf("Room client connected to %s: %s", client.room, client.conn.RemoteAddr())
+			}
+		case client := <-unregister:
+			if rooms[client.room][client] {
+				remove(client)
+				if appLogger != nil {
+					appLogger.Printf("Room client disconnected from %s: %s", client.room, client.conn.RemoteAddr())
+				}
+			}
+		case msg := <-control:
+			client := msg.client
+			if !rooms[client.room][client] {
+				continue
+			}
+			name := truncateString(strings.TrimSpace(msg.Name), maxNickSize)
+			if msg.Muted != nil {
+				client.muted = *msg.Muted
+			}
+			switch msg.Type {
+			case "dm":
+				routeDirectMessage(rooms, client, msg)
+				continue
+			case "signal":
+				// WebRTC offers, answers and candidates go to a single peer in the same room.
+				var target *Client
+				for peer := range rooms[client.room] {
+					if peer.id == msg.To && peer != client {
+						target = peer
+					}
+				}
+				signal := SignalMessage{Type: "signal", From: client.id, To: msg.To, Kind: msg.Kind, Data: msg.Data}
+				if target == nil {
+					signal = SignalMessage{Type: "signal", From: msg.To, To: client.id, Kind: "unavailable"}
+					target = client
+				}
+				if data, err := json.Marshal(signal); err == nil {
+					select {
+					case target.send <- Packet{MsgType: websocket.TextMessage, Data: data}:
+					default:
+						roomMetrics.droppedFrames.Add(1)
+					}
+				}
+				continue
+			case "talk", "release":
+				if f := floors[client.room]; f != nil {
+					changed := false
+					if msg.Type == "talk" {
+						changed = f.request(client, time.Now())
+					} else {
+						changed = f.release(client, time.Now())
+					}
+					if changed {
+						sendFloor(client.room)
+					}
+				}
+				continue
+			case "join":
+				if name != "" {
+					client.setName(name)
+				}
+				go claimChatName(client, client.name)
+				if !client.joined {
+					client.joined = true
+					recordEvent(client, "join", client.name)
+					sendJSON(client.room, PresenceEvent{Type: "presence", Event: "join", ID: client.id, Name: client.name})
+				}
+			case "nick":
+				if name != "" && name != client.name {
+					recordEvent(client, "nick", name)
+					go claimChatName(client, name)
+					sendJSON(client.room, PresenceEvent{Type: "presence", Event: "nick", ID: client.id, Name: name, Previous: client.name})
+					client.setName(name)
+				}
+			}
+			sendRoster(client.room)
+		case packet := <-broadcast:
+			sender := packet.Sender
+			if packet.MsgType == websocket.BinaryMessage {
+				if !rooms[sender.room][sender] {
+					continue
+				}
+				// Half-duplex rooms drop open mics that do not hold the floor.
+				if f := floors[sender.room]; f != nil && f.holder != sender {
+					continue
+				}
+				sender.lastAudio = time.Now()
+				if sender.audio == nil {
+					sender.audio = newJitterBuffer()
+				}
+				sender.audio.write(decodeAudio(sender.codec, packet.Data), sender.lastAudio)
+				if !sender.speaking {
+					sender.speaking = true
+					sendRoster(sender.room)
+				}
+				continue
+			}
+			send(rooms[sender.room], packet)
+		case now := <-mixer.C:
+			for room, clients := range rooms {
+				mix := mixRoom(clients, now)
+				if rec := recorders[room]; rec != nil {
+					rec.write(mix)
+				}
+			}
+		case req := <-recordCtl:
+			var res recordResult
+			switch req.action {
+			case "start":
+				if rooms[req.room] == nil {
+					res.err = errRoomEmpty
+				} else if recorders[req.room] != nil {
+					res.err = errAlreadyRecording
+				} else if rec, err := startRecorder(req.room, req.by, rooms[req.room]); err != nil {
+					res.err = err
+				} else {
+					recorders[req.room] = rec
+					res.info = rec.info
+					sendRecording(req.room)
+				}
+			case "stop":
+				if recorders[req.room] == nil {
+					res.err = errNotRecording
+				} else {
+					res.info, res.done = stopRecording(req.room)
+					sendRecording(req.room)
+				}
+			default:
+				res.active = []RecordingInfo{}
+				for _, rec := range recorders {
+					res.active = append(res.active, rec.info)
+				}
+			}
+			req.reply <- res
+		case req := <-kickCtl:
+			var kicked []*Client
+			for _, clients := range rooms {
+				for client := range clients {
+					if (req.id != 0 && client.id == req.id) || (req.id == 0 && client.joined && strings.EqualFold(client.name, req.name)) {
+						kicked = append(kicked, client)
+					}
+				}
+			}
+			var reply []kickedClient
+			for _, client := range kicked {
+				if !rooms[client.room][client] {
+					continue
+				}
+				select {
+				case client.send <- Packet{MsgType: websocket.TextMessage, Data: []byte(`{"type":"kicked"}`)}:
+				default:
+				}
+				remove(client)
+				roomMetrics.kicked.Add(1)
+				reply = append(reply, kickedClient{room: client.room, name: client.name, ip: client.ip})
+			}
+			req.reply <- reply
+		case pending := <-dmPending:
+			var failed []DirectMessage
+			for _, dm := range pending.messages {
+				if !rooms[pending.client.room][pending.client] || !sendDirect(pending.client, dm) {
+					failed = append(failed, dm)
+				}
+			}
+			if len(failed) > 0 {
+				go restoreDirectPending(failed)
+			}
+		case update := <-floorSet:
+			if rooms[update.room] == nil {
+				continue
+			}
+			if update.limit <= 0 {
+				delete(floors, update.room)
+			} else if f := floors[update.room]; f != nil {
+				f.limit = update.limit
+			} else {
+				floors[update.room] = &floorState{limit: update.limit}
+			}
+			sendFloor(update.room)
+		case <-ticker.C:
+			now := time.Now()
+			for room, f := range floors {
+				if f.expire(now) {
+					sendFloor(room)
+				}
+			}
+			for room, clients := range rooms {
+				changed := false
+				for client := range clients {
+					if client.speaking && now.Sub(client.lastAudio) > speakingTimeout {
+						client.speaking = false
+						changed = true
+					}
+				}
+				if changed {
+					sendRoster(room)
+				}
+			}
+		case reply := <-roomCounts:
+			counts := make(map[string]int, len(rooms))
+			for name, clients := range rooms {
+				counts[name] = len(clients)
+			}
+			reply <- counts
+		}
+	}
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		unregister <- c
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(roomReadLimit)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+
+	textLimit := newTokenBucket(roomTextRate, roomTextBurst)
+	byteLimit := newTokenBucket(roomByteRate, roomByteBurst)
+	violations := 0
+
+	for {
+		msgType, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) && appLogger != nil {
+				appLogger.Printf("WS error: %v", err)
+			}
+			break
+		}
+		if !byteLimit.allow(float64(len(msg))) || (msgType == websocket.TextMessage && !textLimit.allow(1)) {
+			roomMetrics.rateLimited.Add(1)
+			if violations++; violations > roomMaxViolations {
+				if appLogger != nil {
+					appLogger.Printf("Room %s: disconnecting flooding client %s", c.room, c.ip)
+				}
+				break
+			}
+			continue
+		}
+		if msgType == websocket.TextMessage {
+			var ctl controlMessage
+			if json.Unmarshal(msg, &ctl) == nil && controlTypes[ctl.Type] {
+				ctl.client = c
+				control <- ctl
+				continue
+			}
+			if msg = chatFrame(c.room, c.chatName(), msg); msg == nil {
+				continue
+			}
+		}
+		broadcast <- Packet{Sender: c, MsgType: msgType, Data: msg}
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case packet, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			w, err := c.conn.NextWriter(packet.MsgType)
+			if err != nil {
+				return
+			}
+			w.Write(packet.Data)
+
+			if err := w.Close(); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func buildRoster(room string, clients map[*Client]bool) Roster {
+	roster := Roster{Type: "roster", Room: room, Participants: []Participant{}}
+	for client := range clients {
+		name := client.name
+		if name == "" {
+			name = "guest-" + strconv.FormatInt(client.id, 10)
+		}
+		roster.Participants = append(roster.Participants, Participant{
+			ID:       client.id,
+			Name:     name,
+			Muted:    client.muted,
+			Speaking: client.speaking,
+		})
+	}
+	sort.Slice(roster.Participants, func(i, j int) bool { return roster.Participants[i].ID < roster.Participants[j].ID })
+	return roster
+}
+
+func roomParticipantCounts() map[string]int {
+	reply := make(chan map[string]int)
+	roomCounts <- reply
+	return <-reply
+}
+
+func normalizeRoomName(name string) string {
+	if room := normalizeSlug(name); room != "" {
+		return room
+	}
+	return defaultRoom
+}
+
+// hashRoomPassword keeps a salted PBKDF2 hash; rooms saved before hold an
+// unsalted SHA-256, which verifyRoomPassword still accepts.
+func hashRoomPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, _ := pbkdf2.Key(sha256.New, password, salt, roomPasswordRounds, sha256.Size)
+	return "pbkdf2$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(key)
+}
+
+func verifyRoomPassword(stored, password string) bool {
+	given := ""
+	if rest, ok := strings.CutPrefix(stored, "pbkdf2$"); ok {
+		saltHex, keyHex, _ := strings.Cut(rest, "$")
+		salt, err := hex.DecodeString(saltHex)
+		if err != nil {
+			return false
+		}
+		key, err := pbkdf2.Key(sha256.New, password, salt, roomPasswordRounds, sha256.Size)
+		if err != nil {
+			return false
+		}
+		given, stored = hex.EncodeToString(key), keyHex
+	} else {
+		sum := sha256.Sum256([]byte(password))
+		given = hex.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(stored)) == 1
+}
+
+// roomAccessToken is what the room cookie holds once the password was given;
+// it is keyed by the stored hash, so changing the password revokes it.
+func roomAccessToken(room, stored string) string {
+	mac := hmac.New(sha256.New, []byte(stored))
+	mac.Write([]byte(room))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkRoomAccess(r *http.Request, room string) bool {
+	stored, err := getRoomPassword(room)
+	if err != nil || stored == "" {
+		return true
+	}
+	cookie, err := r.Cookie(roomAccessCookie + room)
+	return err == nil && hmac.Equal([]byte(cookie.Value), []byte(roomAccessToken(room, stored)))
+}
+
+// roomUnlockHandler takes a room password in the request body and answers
+// with the room cookie, so the password never ends up in a URL or a log.
+func roomUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var input struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+	} else {
+		input.Name = r.FormValue("name")
+		input.Password = r.FormValue("password")
+	}
+	room := normalizeRoomName(input.Name)
+	stored, err := getRoomPassword(room)
+	if err != nil || stored == "" {
+		writeJSON(w, http.StatusOK, map[string]string{"name": room})
+		return
+	}
+	if !verifyRoomPassword(stored, input.Password) {
+		appLogger.Printf("Room %s: wrong password from %s", room, r.RemoteAddr)
+		writeJSONError(w, http.StatusForbidden, "wrong room password")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     roomAccessCookie + room,
+		Value:    roomAccessToken(room, stored),
+		Path:     "/room",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJSON(w, http.StatusOK, map[string]string{"name": room})
+}
+
+func listRooms() ([]RoomInfo, error) {
+	counts := roomParticipantCounts()
+
+	stored, err := queryRooms()
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*RoomInfo{defaultRoom: {Name: defaultRoom}}
+	for i := range stored {
+		byName[stored[i].Name] = &stored[i]
+	}
+	for name, count := range counts {
+		if byName[name] == nil {
+			byName[name] = &RoomInfo{Name: name}
+		}
+		byName[name].Participants = count
+	}
+
+	rooms := make([]RoomInfo, 0, len(byName))
+	for _, room := range byName {
+		rooms = append(rooms, *room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if (rooms[i].Name == defaultRoom) != (rooms[j].Name == defaultRoom) {
+			return rooms[i].Name == defaultRoom
+		}
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms, nil
+}
+
+func mediaRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if options.RoomAuth && options.Password != "" && !isAuthenticated(r) {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	// Bans and kicks go by address, which a relayed request does not carry.
+	if meshRelayed(r) {
+		http.Error(w, errMeshRelayed.Error(), http.StatusForbidden)
+		return
+	}
+	if isRoomBanned(remoteIP(r)) {
+		roomMetrics.rejectedBanned.Add(1)
+		http.Error(w, "Banned", http.StatusForbidden)
+		return
+	}
+	room := normalizeRoomName(r.URL.Query().Get("name"))
+	if !checkRoomAccess(r, room) {
+		http.Error(w, "Room password required", http.StatusForbidden)
+		return
+	}
+
+	identity, header := chatIdentity(r)
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		if appLogger != nil {
+			appLogger.Printf("WS upgrade error: %v", err)
+		}
+		return
+	}
+
+	client := &Client{
+		conn:     conn,
+		send:     make(chan Packet, sendBuffer),
+		room:     room,
+		ip:       remoteIP(r),
+		admin:    roomAdmin(r),
+		identity: identity,
+		id:       clientSeq.Add(1),
+		codec:    negotiateCodec(r.URL.Query().Get("codec")),
+	}
+	if talkTime, err := getRoomTalkTime(room); err == nil && talkTime > 0 {
+		client.talkLimit = time.Duration(talkTime) * time.Second
+	}
+	for _, data := range chatReplay(room) {
+		client.send <- Packet{MsgType: websocket.TextMessage, Data: data}
+	}
+	register <- client
+
+	go client.writePump()
+	go client.readPump()
+}
+
+func roomsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rooms, err := listRooms()
+		if err != nil {
+			appLogger.Printf("Rooms: failed to list: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+		writeJSON(w, http.StatusOK, rooms)
+
+	case "POST", "DELETE":
+		if options.Password != "" && !isAuthenticated(r) {
+			writeJSONError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if chatDB == nil {
+			writeJSONError(w, http.StatusNotFound, "rooms storage disabled")
+			return
+		}
+		var input struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+			PTT      bool   `json:"ptt"`
+			TalkTime int    `json:"talk_time"`
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+				return
+			}
+		} else {
+			input.Name = r.FormValue("name")
+			input.Password = r.FormValue("password")
+			input.PTT = r.FormValue("ptt") == "on" || r.FormValue("ptt") == "true"
+			input.TalkTime, _ = strconv.Atoi(r.FormValue("talk_time"))
+		}
+		if input.PTT && input.TalkTime <= 0 {
+			input.TalkTime = defaultTalkTime
+		}
+		input.TalkTime = max(input.TalkTime, 0)
+		room := normalizeRoomName(input.Name)
+
+		var err error
+		if r.Method == "DELETE" {
+			err = deleteRoom(room)
+		} else {
+			password := ""
+			if input.Password != "" {
+				password = hashRoomPassword(input.Password)
+			}
+			err = saveRoom(room, password, input.TalkTime)
+		}
+		if err != nil {
+			appLogger.Printf("Rooms: failed to update %s: %v", room, err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+		if r.Method == "DELETE" {
+			input.TalkTime = 0
+		}
+		floorSet <- floorUpdate{room: room, limit: time.Duration(input.TalkTime) * time.Second}
+		appLogger.Printf("Room %s %s by %s", room, strings.ToLower(r.Method), r.RemoteAddr)
+		writeJSON(w, http.StatusOK, RoomInfo{Name: room, Protected: input.Password != "" && r.Method == "POST", TalkTime: input.TalkTime})
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	roomReadLimit     = 64 << 10
+	roomTextRate      = 20
+	roomTextBurst     = 40
+	roomByteRate      = 256 << 10
+	roomByteBurst     = 512 << 10
+	roomMaxViolations = 200
+)
+
+var (
+	kickCtl = make(chan kickRequest)
+
+	roomMetrics struct {
+		droppedClients  atomic.Int64
+		droppedFrames   atomic.Int64
+		rateLimited     atomic.Int64
+		rejectedOrigins atomic.Int64
+		rejectedBanned  atomic.Int64
+		kicked          atomic.Int64
+	}
+
+	roomBans   = map[string]time.Time{}
+	roomBansMu sync.Mutex
+)
+
+type kickRequest struct {
+	id    int64
+	name  string
+	reply chan []kickedClient
+}
+
+// kickedClient is what the hub reports of a kicked client, copied while it
+// still owns the client.
+type kickedClient struct {
+	room string
+	name string
+	ip   string
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) allow(cost float64) bool {
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < cost {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
+
+func roomMetricsSnapshot() map[string]int64 {
+	return map[string]int64{
+		"dropped_clients":  roomMetrics.droppedClients.Load(),
+		"dropped_frames":   roomMetrics.droppedFrames.Load(),
+		"rate_limited":     roomMetrics.rateLimited.Load(),
+		"rejected_origins": roomMetrics.rejectedOrigins.Load(),
+		"rejected_banned":  roomMetrics.rejectedBanned.Load(),
+		"kicked":           roomMetrics.kicked.Load(),
+	}
+}
+
+// checkRoomOrigin accepts non-browser clients, same-host pages and any origin
+// listed in the room_origins option.
+func checkRoomOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range options.RoomOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	roomMetrics.rejectedOrigins.Add(1)
+	if appLogger != nil {
+		appLogger.Printf("Room: rejected origin %s from %s", origin, r.RemoteAddr)
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func isRoomBanned(ip string) bool {
+	roomBansMu.Lock()
+	defer roomBansMu.Unlock()
+	until, ok := roomBans[ip]
+	if ok && time.Now().After(until) {
+		delete(roomBans, ip)
+		return false
+	}
+	return ok
+}
+
+// roomAdmin is the one rule for kicks, bans and recording: only a logged-in
+// user, so a node without a password has no room admin at all.
+func roomAdmin(r *http.Request) bool {
+	return !meshRelayed(r) && isAuthenticated(r)
+}
+
+func kickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !roomAdmin(r) {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	var input struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+		Ban  int    `json:"ban"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || (input.ID == 0 && input.Name == "") {
+		writeJSONError(w, http.StatusBadRequest, "id or name required")
+		return
+	}
+
+	req := kickRequest{id: input.ID, name: strings.TrimSpace(input.Name), reply: make(chan []kickedClient)}
+	kickCtl <- req
+	kicked := <-req.reply
+
+	var banned []string
+	if input.Ban > 0 {
+		roomBansMu.Lock()
+		for _, c := range kicked {
+			roomBans[c.ip] = time.Now().Add(time.Duration(input.Ban) * time.Second)
+			banned = append(banned, c.ip)
+		}
+		roomBansMu.Unlock()
+	}
+	for _, c := range kicked {
+		appLogger.Printf("Room %s: kicked %s (%s) by %s", c.room, c.name, c.ip, r.RemoteAddr)
+	}
+	if len(kicked) == 0 {
+		writeJSONError(w, http.StatusNotFound, "participant not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"kicked": len(kicked), "banned": banned})
+}
+
+func bansHandler(w http.ResponseWriter, r *http.Request) {
+	if !roomAdmin(r) {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		type ban struct {
+			IP    string `json:"ip"`
+			Until int64  `json:"until"`
+		}
+		roomBansMu.Lock()
+		bans := []ban{}
+		for ip, until := range roomBans {
+			if time.Now().Before(until) {
+				bans = append(bans, ban{IP: ip, Until: until.Unix()})
+			}
+		}
+		roomBansMu.Unlock()
+		sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+		writeJSON(w, http.StatusOK, bans)
+	case "DELETE":
+		ip := r.URL.Query().Get("ip")
+		roomBansMu.Lock()
+		delete(roomBans, ip)
+		roomBansMu.Unlock()
+		appLogger.Printf("Room: unbanned %s by %s", ip, r.RemoteAddr)
+		writeJSON(w, http.StatusOK, map[string]string{"ip": ip})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
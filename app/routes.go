@@ -23,6 +23,25 @@ func setupRoutes() {
 	http.HandleFunc("/logout", logoutHandler)
 	http.HandleFunc("/edit", editHandler)
 	http.HandleFunc("/bbs", bbsHandler)
+	http.HandleFunc("/bbs/api/", bbsAPIHandler)
+	http.HandleFunc("/bbs/thumb/", bbsThumbHandler)
 	http.HandleFunc("/room", mediaRoomHandler)
+	http.HandleFunc("/room/history", chatHistoryHandler)
+	http.HandleFunc("/room/rooms", roomsHandler)
+	http.HandleFunc("/room/unlock", roomUnlockHandler)
+	http.HandleFunc("/room/record", recordHandler)
+	http.HandleFunc("/room/kick", kickHandler)
+	http.HandleFunc("/room/bans", bansHandler)
+	http.HandleFunc("/peer/api/files", peerFilesHandler)
+	http.HandleFunc("/peer/api/transfer", peerTransferHandler)
+	http.HandleFunc("/peer/api/offer", peerOfferHandler)
+	http.HandleFunc("/peer/browse", peerBrowseHandler)
+	http.HandleFunc("/peer/transfers", peerTransfersHandler)
+	http.HandleFunc("/sync/api/manifest", syncManifestHandler)
+	http.HandleFunc("/sync/run", syncRunHandler)
+	http.HandleFunc("/mesh/api/routes", meshRoutesHandler)
+	http.HandleFunc(meshRelayPath, meshRelayHandler)
 	http.HandleFunc("/map/", mapHandler)
+	http.HandleFunc("/map/search", mapSearchHandler)
+	http.HandleFunc("/map/route", mapRouteHandler)
 }
@@ -0,0 +1,660 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	routeGraphMagic    = "TAZR"
+	routeGraphVersion  = 1
+	routeScanInterval  = 30 * time.Second
+	routeSnapDistance  = 5000.0
+	routeWalkSpeed     = 5
+	routeFlagFoot      = 1
+	routeFlagCar       = 2
+	earthRadiusMeters  = 6371008.8
+	routeCoordinateDiv = 1e7
+	routeCellSize      = 0.01 * routeCoordinateDiv
+	routeGraphHeader   = len(routeGraphMagic) + 4 + 8 + 8 + 4 + 4
+)
+
+var routeCarSpeeds = map[string]uint8{
+	"motorway":       110,
+	"motorway_link":  60,
+	"trunk":          90,
+	"trunk_link":     50,
+	"primary":        70,
+	"primary_link":   50,
+	"secondary":      60,
+	"secondary_link": 45,
+	"tertiary":       50,
+	"tertiary_link":  40,
+	"unclassified":   40,
+	"road":           40,
+	"residential":    30,
+	"service":        20,
+	"living_street":  10,
+}
+
+var routeFootOnly = map[string]bool{
+	"footway":    true,
+	"path":       true,
+	"pedestrian": true,
+	"steps":      true,
+	"track":      true,
+	"cycleway":   true,
+	"bridleway":  true,
+	"corridor":   true,
+}
+
+var (
+	routeGraphs      = make(map[string]*routeGraph)
+	routeGraphsMutex sync.RWMutex
+	routeBuildMutex  sync.Mutex
+	routeLastScan    atomic.Int64
+)
+
+type routeGraph struct {
+	sourceSize  int64
+	sourceMtime int64
+	minLat      int32
+	minLon      int32
+	maxLat      int32
+	maxLon      int32
+	lat         []int32
+	lon         []int32
+	offsets     []uint32
+	targets     []uint32
+	dist        []float32
+	flags       []uint8
+	speed       []uint8
+	maxSpeed    uint8
+	cells       []uint64
+	cellNodes   []uint32
+}
+
+type Route struct {
+	Source   string       `json:"source"`
+	Mode     string       `json:"mode"`
+	Distance float64      `json:"distance"`
+	Duration float64      `json:"duration"`
+	Geometry [][2]float64 `json:"coordinates"`
+}
+
+func startRouting() {
+	go refreshRouteGraphs()
+}
+
+func routeGraphPath(source string) string {
+	return filepath.Join(options.RoutingPath, url.PathEscape(source)+".graph")
+}
+
+func refreshRouteGraphs() {
+	if !routeBuildMutex.TryLock() {
+		return
+	}
+	defer routeBuildMutex.Unlock()
+	routeLastScan.Store(time.Now().Unix())
+
+	if err := os.MkdirAll(options.RoutingPath, os.ModePerm); err != nil {
+		appLogger.Printf("Routing: failed to create %s: %v", options.RoutingPath, err)
+		return
+	}
+
+	found := findTreeFiles(".osm.pbf")
+
+	keep := make(map[string]bool)
+	for source := range found {
+		keep[routeGraphPath(source)] = true
+	}
+	stale, _ := filepath.Glob(filepath.Join(options.RoutingPath, "*.graph"))
+	for _, path := range stale {
+		if !keep[path] {
+			os.Remove(path)
+		}
+	}
+	routeGraphsMutex.Lock()
+	for source := range routeGraphs {
+		if _, ok := found[source]; !ok {
+			delete(routeGraphs, source)
+		}
+	}
+	routeGraphsMutex.Unlock()
+
+	for source, info := range found {
+		routeGraphsMutex.RLock()
+		g := routeGraphs[source]
+		routeGraphsMutex.RUnlock()
+		if g == nil {
+			g, _ = loadRouteGraph(routeGraphPath(source))
+		}
+		if g == nil || g.sourceSize != info.Size() || g.sourceMtime != info.ModTime().Unix() {
+			start := time.Now()
+			path, err := getSafePath(source)
+			if err != nil {
+				continue
+			}
+			g, err = buildRouteGraph(path, info)
+			if err != nil {
+				appLogger.Printf("Routing: failed to build graph for %s: %v", source, err)
+				continue
+			}
+			if err := g.save(routeGraphPath(source)); err != nil {
+				appLogger.Printf("Routing: failed to save graph for %s: %v", source, err)
+			}
+			appLogger.Printf("Routing: built graph for %s with %d nodes and %d edges in %s", source, len(g.lat), len(g.targets), time.Since(start).Round(time.Millisecond))
+		}
+		routeGraphsMutex.Lock()
+		routeGraphs[source] = g
+		routeGraphsMutex.Unlock()
+	}
+}
+
+func routeWayFlags(tags map[string]string) (uint8, uint8) {
+	highway := tags["highway"]
+	if highway == "" || tags["area"] == "yes" {
+		return 0, 0
+	}
+	if access := tags["access"]; access == "no" || access == "private" {
+		if tags["foot"] != "yes" {
+			return 0, 0
+		}
+		return routeFlagFoot, 0
+	}
+
+	var flags uint8
+	speed, car := routeCarSpeeds[highway]
+	if car && tags["motor_vehicle"] != "no" && tags["motorcar"] != "no" {
+		flags |= routeFlagCar
+	}
+	if routeFootOnly[highway] || (car && highway != "motorway" && highway != "motorway_link") {
+		flags |= routeFlagFoot
+	}
+	if tags["foot"] == "no" {
+		flags &^= routeFlagFoot
+	} else if tags["foot"] == "yes" || tags["foot"] == "designated" {
+		flags |= routeFlagFoot
+	}
+	if maxspeed, err := strconv.Atoi(strings.TrimSuffix(tags["maxspeed"], " km/h")); err == nil && maxspeed > 0 && maxspeed < 255 {
+		speed = uint8(maxspeed)
+	}
+	return flags, speed
+}
+
+func buildRouteGraph(path string, info os.FileInfo) (*routeGraph, error) {
+	type wayEdge struct {
+		from, to int64
+		flags    uint8
+		speed    uint8
+	}
+	var edges []wayEdge
+	index := make(map[int64]uint32)
+
+	err := readOSMPBF(path, osmVisitor{way: func(id int64, tags map[string]string, refs []int64) {
+		flags, speed := routeWayFlags(tags)
+		if flags == 0 || len(refs) < 2 {
+			return
+		}
+		oneway := tags["oneway"]
+		if tags["junction"] == "roundabout" && oneway == "" || tags["highway"] == "motorway" && oneway == "" {
+			oneway = "yes"
+		}
+		for i := 0; i+1 < len(refs); i++ {
+			a, b := refs[i], refs[i+1]
+			if oneway == "-1" {
+				a, b = b, a
+			}
+			forward, backward := flags, flags
+			if oneway == "yes" || oneway == "true" || oneway == "1" || oneway == "-1" {
+				backward &^= routeFlagCar
+			}
+			edges = append(edges, wayEdge{a, b, forward, speed})
+			if backward != 0 {
+				edges = append(edges, wayEdge{b, a, backward, speed})
+			}
+			index[a] = 0
+			index[b] = 0
+		}
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if len(edges) == 0 {
+		return nil, fmt.Errorf("no routable ways found")
+	}
+
+	ids := make([]int64, 0, len(index))
+	for id := range index {
+		ids = append(ids, id)
+	}
+	for i, id := range ids {
+		index[id] = uint32(i)
+	}
+
+	g := &routeGraph{
+		sourceSize:  info.Size(),
+		sourceMtime: info.ModTime().Unix(),
+		lat:         make([]int32, len(ids)),
+		lon:         make([]int32, len(ids)),
+	}
+	seen := make([]bool, len(ids))
+	err = readOSMPBF(path, osmVisitor{node: func(id int64, lat, lon float64) {
+		if i, ok := index[id]; ok {
+			g.lat[i] = int32(math.Round(lat * routeCoordinateDiv))
+			g.lon[i] = int32(math.Round(lon * routeCoordinateDiv))
+			seen[i] = true
+		}
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	g.offsets = make([]uint32, len(ids)+1)
+	for _, e := range edges {
+		if seen[index[e.from]] && seen[index[e.to]] {
+			g.offsets[index[e.from]+1]++
+		}
+	}
+	for i := 1; i < len(g.offsets); i++ {
+		g.offsets[i] += g.offsets[i-1]
+	}
+	total := g.offsets[len(ids)]
+	g.targets = make([]uint32, total)
+	g.dist = make([]float32, total)
+	g.flags = make([]uint8, total)
+	g.speed = make([]uint8, total)
+	fill := make([]uint32, len(ids))
+	copy(fill, g.offsets[:len(ids)])
+	for _, e := range edges {
+		from, to := index[e.from], index[e.to]
+		if !seen[from] || !seen[to] {
+			continue
+		}
+		pos := fill[from]
+		fill[from]++
+		g.targets[pos] = to
+		g.dist[pos] = float32(g.distance(from, to))
+		g.flags[pos] = e.flags
+		g.speed[pos] = e.speed
+	}
+	g.updateBounds()
+	g.indexCells()
+	return g, nil
+}
+
+// updateBounds sets the bounding box and the top car speed, which keeps the
+// A* heuristic from overestimating.
+func (g *routeGraph) updateBounds() {
+	g.minLat, g.minLon = math.MaxInt32, math.MaxInt32
+	g.maxLat, g.maxLon = math.MinInt32, math.MinInt32
+	g.maxSpeed = 1
+	for e, speed := range g.speed {
+		if g.flags[e]&routeFlagCar != 0 {
+			g.maxSpeed = max(g.maxSpeed, speed)
+		}
+	}
+	for i := range g.lat {
+		if g.offsets[i] == g.offsets[i+1] {
+			continue
+		}
+		g.minLat = min(g.minLat, g.lat[i])
+		g.maxLat = max(g.maxLat, g.lat[i])
+		g.minLon = min(g.minLon, g.lon[i])
+		g.maxLon = max(g.maxLon, g.lon[i])
+	}
+}
+
+func routeCell(lat, lon int32) uint64 {
+	cy := int32(math.Floor(float64(lat) / routeCellSize))
+	cx := int32(math.Floor(float64(lon) / routeCellSize))
+	return uint64(uint32(cy))<<32 | uint64(uint32(cx))
+}
+
+// indexCells sorts the nodes that have edges by grid cell, so nearest only
+// looks at the cells around a point instead of the whole graph.
+func (g *routeGraph) indexCells() {
+	g.cellNodes = g.cellNodes[:0]
+	for i := range g.lat {
+		if g.offsets[i] != g.offsets[i+1] {
+			g.cellNodes = append(g.cellNodes, uint32(i))
+		}
+	}
+	g.cells = make([]uint64, len(g.cellNodes))
+	for i, n := range g.cellNodes {
+		g.cells[i] = routeCell(g.lat[n], g.lon[n])
+	}
+	sort.Sort(routeCellSort{g})
+}
+
+type routeCellSort struct{ g *routeGraph }
+
+func (s routeCellSort) Len() int           { return len(s.g.cells) }
+func (s routeCellSort) Less(i, j int) bool { return s.g.cells[i] < s.g.cells[j] }
+func (s routeCellSort) Swap(i, j int) {
+	s.g.cells[i], s.g.cells[j] = s.g.cells[j], s.g.cells[i]
+	s.g.cellNodes[i], s.g.cellNodes[j] = s.g.cellNodes[j], s.g.cellNodes[i]
+}
+
+func (g *routeGraph) save(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	header := []interface{}{
+		[]byte(routeGraphMagic), uint32(routeGraphVersion),
+		g.sourceSize, g.sourceMtime,
+		uint32(len(g.lat)), uint32(len(g.targets)),
+	}
+	for _, v := range append(header, g.lat, g.lon, g.offsets, g.targets, g.dist, g.flags, g.speed) {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadRouteGraph(path string) (*routeGraph, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(routeGraphMagic))
+	var version, nodes, edges uint32
+	g := &routeGraph{}
+	for _, v := range []interface{}{magic, &version, &g.sourceSize, &g.sourceMtime, &nodes, &edges} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	if string(magic) != routeGraphMagic || version != routeGraphVersion {
+		return nil, fmt.Errorf("unsupported graph file")
+	}
+	// The counts decide how much gets allocated, so they have to add up to
+	// the file size before anything is read.
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if int64(routeGraphHeader)+12*int64(nodes)+4+14*int64(edges) != info.Size() {
+		return nil, fmt.Errorf("corrupt graph file")
+	}
+
+	g.lat = make([]int32, nodes)
+	g.lon = make([]int32, nodes)
+	g.offsets = make([]uint32, int(nodes)+1)
+	g.targets = make([]uint32, edges)
+	g.dist = make([]float32, edges)
+	g.flags = make([]uint8, edges)
+	g.speed = make([]uint8, edges)
+	for _, v := range []interface{}{g.lat, g.lon, g.offsets, g.targets, g.dist, g.flags, g.speed} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	if g.offsets[0] != 0 || g.offsets[nodes] != edges {
+		return nil, fmt.Errorf("corrupt graph file")
+	}
+	for i := uint32(0); i < nodes; i++ {
+		if g.offsets[i] > g.offsets[i+1] {
+			return nil, fmt.Errorf("corrupt graph file")
+		}
+	}
+	for _, t := range g.targets {
+		if t >= nodes {
+			return nil, fmt.Errorf("corrupt graph file")
+		}
+	}
+	g.updateBounds()
+	g.indexCells()
+	return g, nil
+}
+
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+func (g *routeGraph) coord(i uint32) (float64, float64) {
+	return float64(g.lat[i]) / routeCoordinateDiv, float64(g.lon[i]) / routeCoordinateDiv
+}
+
+func (g *routeGraph) distance(a, b uint32) float64 {
+	lat1, lon1 := g.coord(a)
+	lat2, lon2 := g.coord(b)
+	return haversine(lat1, lon1, lat2, lon2)
+}
+
+func (g *routeGraph) contains(lat, lon float64) bool {
+	la := int32(lat * routeCoordinateDiv)
+	lo := int32(lon * routeCoordinateDiv)
+	return la >= g.minLat && la <= g.maxLat && lo >= g.minLon && lo <= g.maxLon
+}
+
+// nearest only looks within routeSnapDistance, since anything further is
+// never used as a start or goal.
+func (g *routeGraph) nearest(lat, lon float64, flag uint8) (uint32, float64) {
+	best, bestDist := uint32(0), math.Inf(1)
+	span := routeSnapDistance / earthRadiusMeters * 180 / math.Pi * routeCoordinateDiv
+	spanLon := span / max(math.Cos(lat*math.Pi/180), 0.01)
+	la, lo := lat*routeCoordinateDiv, lon*routeCoordinateDiv
+	minY := int32(math.Floor((la - span) / routeCellSize))
+	maxY := int32(math.Floor((la + span) / routeCellSize))
+	minX := int32(math.Floor((lo - spanLon) / routeCellSize))
+	maxX := int32(math.Floor((lo + spanLon) / routeCellSize))
+	for cy := minY; cy <= maxY; cy++ {
+		for cx := minX; cx <= maxX; cx++ {
+			cell := uint64(uint32(cy))<<32 | uint64(uint32(cx))
+			for k := sort.Search(len(g.cells), func(k int) bool { return g.cells[k] >= cell }); k < len(g.cells) && g.cells[k] == cell; k++ {
+				i := g.cellNodes[k]
+				usable := false
+				for e := g.offsets[i]; e < g.offsets[i+1]; e++ {
+					if g.flags[e]&flag != 0 {
+						usable = true
+						break
+					}
+				}
+				if !usable {
+					continue
+				}
+				nlat, nlon := g.coord(i)
+				if d := haversine(lat, lon, nlat, nlon); d < bestDist {
+					best, bestDist = i, d
+				}
+			}
+		}
+	}
+	return best, bestDist
+}
+
+func (g *routeGraph) edgeCost(e uint32, flag uint8) float64 {
+	speed := float64(routeWalkSpeed)
+	if flag == routeFlagCar {
+		speed = float64(g.speed[e])
+	}
+	return float64(g.dist[e]) / (speed / 3.6)
+}
+
+type routeQueueItem struct {
+	node     uint32
+	priority float64
+}
+
+type routeQueue []routeQueueItem
+
+func (q routeQueue) Len() int            { return len(q) }
+func (q routeQueue) Less(i, j int) bool  { return q[i].priority < q[j].priority }
+func (q routeQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *routeQueue) Push(x interface{}) { *q = append(*q, x.(routeQueueItem)) }
+func (q *routeQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+func (g *routeGraph) route(start, goal uint32, flag uint8) ([]uint32, float64, bool) {
+	maxSpeed := float64(routeWalkSpeed)
+	if flag == routeFlagCar {
+		maxSpeed = float64(g.maxSpeed)
+	}
+	heuristic := func(n uint32) float64 { return g.distance(n, goal) / (maxSpeed / 3.6) }
+
+	cost := make([]float64, len(g.lat))
+	for i := range cost {
+		cost[i] = math.Inf(1)
+	}
+	prev := make([]uint32, len(g.lat))
+	done := make([]bool, len(g.lat))
+	cost[start] = 0
+
+	q := &routeQueue{{start, heuristic(start)}}
+	for q.Len() > 0 {
+		n := heap.Pop(q).(routeQueueItem).node
+		if done[n] {
+			continue
+		}
+		if n == goal {
+			path := []uint32{goal}
+			for n != start {
+				n = prev[n]
+				path = append(path, n)
+			}
+			for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return path, cost[goal], true
+		}
+		done[n] = true
+		for e := g.offsets[n]; e < g.offsets[n+1]; e++ {
+			if g.flags[e]&flag == 0 {
+				continue
+			}
+			t := g.targets[e]
+			if c := cost[n] + g.edgeCost(e, flag); c < cost[t] {
+				cost[t] = c
+				prev[t] = n
+				heap.Push(q, routeQueueItem{t, c + heuristic(t)})
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+func findRoute(fromLat, fromLon, toLat, toLon float64, mode string) (*Route, error) {
+	flag := uint8(routeFlagFoot)
+	if mode == "car" {
+		flag = routeFlagCar
+	} else {
+		mode = "foot"
+	}
+
+	// Graphs are never changed once built, so the search runs on a snapshot
+	// and a rebuild does not wait for it.
+	routeGraphsMutex.RLock()
+	graphs := maps.Clone(routeGraphs)
+	routeGraphsMutex.RUnlock()
+
+	for source, g := range graphs {
+		if !g.contains(fromLat, fromLon) || !g.contains(toLat, toLon) {
+			continue
+		}
+		start, startDist := g.nearest(fromLat, fromLon, flag)
+		goal, goalDist := g.nearest(toLat, toLon, flag)
+		if startDist > routeSnapDistance || goalDist > routeSnapDistance {
+			continue
+		}
+		path, duration, ok := g.route(start, goal, flag)
+		if !ok {
+			continue
+		}
+		r := &Route{Source: source, Mode: mode, Duration: math.Round(duration)}
+		r.Geometry = append(r.Geometry, [2]float64{fromLon, fromLat})
+		for i, n := range path {
+			lat, lon := g.coord(n)
+			r.Geometry = append(r.Geometry, [2]float64{lon, lat})
+			if i > 0 {
+				r.Distance += g.distance(path[i-1], n)
+			}
+		}
+		r.Geometry = append(r.Geometry, [2]float64{toLon, toLat})
+		r.Distance = math.Round(r.Distance)
+		return r, nil
+	}
+	return nil, fmt.Errorf("no route found")
+}
+
+func parseLatLon(s string) (float64, float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid coordinate")
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lat, lon, nil
+}
+
+func mapRouteHandler(w http.ResponseWriter, r *http.Request) {
+	if time.Since(time.Unix(routeLastScan.Load(), 0)) > routeScanInterval {
+		go refreshRouteGraphs()
+	}
+
+	fromLat, fromLon, errFrom := parseLatLon(r.URL.Query().Get("from"))
+	toLat, toLon, errTo := parseLatLon(r.URL.Query().Get("to"))
+	if errFrom != nil || errTo != nil {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+
+	route, err := findRoute(fromLat, fromLon, toLat, toLon, r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, "No route found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(route)
+}
@@ -0,0 +1,34 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+//go:build windows
+
+package main
+
+import "syscall"
+
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// reuseAddrV6Only keeps a wildcard IPv6 socket off IPv4, which has a listener
+// of its own, so a request is not answered twice.
+func reuseAddrV6Only(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if serr == nil {
+			serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,15 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+//go:build unix
+
+package main
+
+import "syscall"
+
+func freeDiskSpace(path string) uint64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize)
+}
@@ -0,0 +1,464 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	pmtilesHeaderSize      = 127
+	pmtilesCompressionNone = 1
+	pmtilesCompressionGzip = 2
+)
+
+type vectorPoint struct {
+	Layer string
+	Props map[string]interface{}
+	Lon   float64
+	Lat   float64
+}
+
+type tileVisitor func(z, x, y int, data []byte) error
+
+func gunzipIfNeeded(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// Place labels of the top zoom level are repeated one level lower in the
+// common tile schemas, so the walkers read that level, which holds a quarter
+// of the tiles.
+func walkZoom(minZoom, maxZoom int) int {
+	return max(minZoom, maxZoom-1)
+}
+
+func walkMBTiles(path string, fn tileVisitor) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var minZoom, maxZoom int
+	if err := db.QueryRow("SELECT MIN(zoom_level), MAX(zoom_level) FROM tiles").Scan(&minZoom, &maxZoom); err != nil {
+		return err
+	}
+	zoom := walkZoom(minZoom, maxZoom)
+
+	rows, err := db.Query("SELECT tile_column, tile_row, tile_data FROM tiles WHERE zoom_level = ?", zoom)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var x, tmsY int
+		var data []byte
+		if err := rows.Scan(&x, &tmsY, &data); err != nil {
+			continue
+		}
+		data, err := gunzipIfNeeded(data)
+		if err != nil {
+			continue
+		}
+		if err := fn(zoom, x, (1<<zoom)-1-tmsY, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+type pmtilesHeader struct {
+	rootOffset, rootLength uint64
+	leafOffset             uint64
+	dataOffset             uint64
+	internalCompression    byte
+	tileCompression        byte
+	minZoom                int
+	maxZoom                int
+	size                   uint64
+}
+
+type pmtilesEntry struct {
+	tileID    uint64
+	offset    uint64
+	length    uint64
+	runLength uint64
+}
+
+func walkPMTiles(path string, fn tileVisitor) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, pmtilesHeaderSize)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return err
+	}
+	if string(buf[0:7]) != "PMTiles" || buf[7] != 3 {
+		return fmt.Errorf("not a PMTiles v3 archive")
+	}
+	h := pmtilesHeader{
+		rootOffset:          binary.LittleEndian.Uint64(buf[8:]),
+		rootLength:          binary.LittleEndian.Uint64(buf[16:]),
+		leafOffset:          binary.LittleEndian.Uint64(buf[40:]),
+		dataOffset:          binary.LittleEndian.Uint64(buf[56:]),
+		internalCompression: buf[97],
+		tileCompression:     buf[98],
+		minZoom:             int(buf[100]),
+		maxZoom:             int(buf[101]),
+		size:                uint64(info.Size()),
+	}
+	if h.maxZoom > 31 || h.minZoom > h.maxZoom {
+		return fmt.Errorf("invalid PMTiles zoom range")
+	}
+
+	zoom := walkZoom(h.minZoom, h.maxZoom)
+	first := pmtilesFirstID(zoom)
+	last := first + (uint64(1)<<zoom)*(uint64(1)<<zoom)
+	return walkPMTilesDirectory(f, h, h.rootOffset, h.rootLength, first, last, fn)
+}
+
+func walkPMTilesDirectory(f *os.File, h pmtilesHeader, offset, length, first, last uint64, fn tileVisitor) error {
+	raw, err := readPMTilesBlock(f, h.size, offset, length, h.internalCompression)
+	if err != nil {
+		return err
+	}
+	entries, err := parsePMTilesDirectory(raw)
+	if err != nil {
+		return err
+	}
+
+	for i, e := range entries {
+		if e.runLength == 0 {
+			if i+1 < len(entries) && entries[i+1].tileID <= first {
+				continue
+			}
+			if e.tileID >= last {
+				continue
+			}
+			if err := walkPMTilesDirectory(f, h, h.leafOffset+e.offset, e.length, first, last, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if e.tileID+e.runLength <= first || e.tileID >= last {
+			continue
+		}
+		data, err := readPMTilesBlock(f, h.size, h.dataOffset+e.offset, e.length, h.tileCompression)
+		if err != nil {
+			return err
+		}
+		for id := e.tileID; id < e.tileID+e.runLength; id++ {
+			if id < first || id >= last {
+				continue
+			}
+			z, x, y := pmtilesIDToZXY(id)
+			if err := fn(z, x, y, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readPMTilesBlock checks the offset and length read from the archive against
+// its size before allocating for them.
+func readPMTilesBlock(f *os.File, size, offset, length uint64, compression byte) ([]byte, error) {
+	if offset > size || length > size-offset {
+		return nil, fmt.Errorf("PMTiles block outside the archive")
+	}
+	buf := make([]byte, length)
+	if _, err := f.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	switch compression {
+	case pmtilesCompressionNone, 0:
+		return buf, nil
+	case pmtilesCompressionGzip:
+		return gunzipIfNeeded(buf)
+	}
+	return nil, fmt.Errorf("unsupported PMTiles compression %d", compression)
+}
+
+func parsePMTilesDirectory(raw []byte) ([]pmtilesEntry, error) {
+	r := &pbReader{buf: raw}
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(raw)) {
+		return nil, fmt.Errorf("invalid PMTiles directory")
+	}
+	entries := make([]pmtilesEntry, n)
+
+	var lastID uint64
+	for i := range entries {
+		v, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		lastID += v
+		entries[i].tileID = lastID
+	}
+	for i := range entries {
+		if entries[i].runLength, err = r.varint(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range entries {
+		if entries[i].length, err = r.varint(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range entries {
+		v, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		if v == 0 && i > 0 {
+			entries[i].offset = entries[i-1].offset + entries[i-1].length
+		} else {
+			entries[i].offset = v - 1
+		}
+	}
+	return entries, nil
+}
+
+func pmtilesFirstID(z int) uint64 {
+	var acc uint64
+	for i := 0; i < z; i++ {
+		acc += (uint64(1) << i) * (uint64(1) << i)
+	}
+	return acc
+}
+
+func pmtilesIDToZXY(id uint64) (int, int, int) {
+	var acc uint64
+	for z := 0; z < 32; z++ {
+		n := uint64(1) << z
+		if acc+n*n > id {
+			pos := id - acc
+			var x, y uint64
+			for s := uint64(1); s < n; s *= 2 {
+				rx := 1 & (pos / 2)
+				ry := 1 & (pos ^ rx)
+				if ry == 0 {
+					if rx == 1 {
+						x = s - 1 - x
+						y = s - 1 - y
+					}
+					x, y = y, x
+				}
+				x += s * rx
+				y += s * ry
+				pos /= 4
+			}
+			return z, int(x), int(y)
+		}
+		acc += n * n
+	}
+	return 0, 0, 0
+}
+
+func tileToLonLat(z, x, y int, px, py, extent float64) (float64, float64) {
+	n := float64(uint64(1) << z)
+	lon := (float64(x)+px/extent)/n*360 - 180
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*(float64(y)+py/extent)/n))) * 180 / math.Pi
+	return lon, lat
+}
+
+func decodeVectorPoints(data []byte, z, x, y int, layers map[string]bool) ([]vectorPoint, error) {
+	var points []vectorPoint
+	r := &pbReader{buf: data}
+	for r.more() {
+		field, wire, err := r.key()
+		if err != nil {
+			return points, err
+		}
+		if field != 3 || wire != wireBytes {
+			if err := r.skip(wire); err != nil {
+				return points, err
+			}
+			continue
+		}
+		layer, err := r.bytes()
+		if err != nil {
+			return points, err
+		}
+		lp, err := decodeVectorLayer(layer, z, x, y, layers)
+		if err != nil {
+			return points, err
+		}
+		points = append(points, lp...)
+	}
+	return points, nil
+}
+
+func decodeVectorLayer(data []byte, z, x, y int, layers map[string]bool) ([]vectorPoint, error) {
+	var name string
+	var keys []string
+	var values []interface{}
+	var features [][]byte
+	extent := 4096.0
+
+	r := &pbReader{buf: data}
+	for r.more() {
+		field, wire, err := r.key()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			name = string(b)
+			if layers != nil && !layers[name] {
+				return nil, nil
+			}
+		case field == 2 && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			features = append(features, b)
+		case field == 3 && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, string(b))
+		case field == 4 && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, decodeVectorValue(b))
+		case field == 5 && wire == wireVarint:
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			extent = float64(v)
+		default:
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var points []vectorPoint
+	for _, fb := range features {
+		var tags, geometry []uint64
+		var geomType uint64
+		fr := &pbReader{buf: fb}
+		for fr.more() {
+			field, wire, err := fr.key()
+			if err != nil {
+				return points, err
+			}
+			switch {
+			case field == 2 && wire == wireBytes:
+				tags, err = fr.packedVarints()
+			case field == 3 && wire == wireVarint:
+				geomType, err = fr.varint()
+			case field == 4 && wire == wireBytes:
+				geometry, err = fr.packedVarints()
+			default:
+				err = fr.skip(wire)
+			}
+			if err != nil {
+				return points, err
+			}
+		}
+		// Only POINT features carrying a MoveTo command are useful here.
+		if geomType != 1 || len(geometry) < 3 || geometry[0]&7 != 1 {
+			continue
+		}
+		props := make(map[string]interface{})
+		for i := 0; i+1 < len(tags); i += 2 {
+			if tags[i] < uint64(len(keys)) && tags[i+1] < uint64(len(values)) {
+				props[keys[tags[i]]] = values[tags[i+1]]
+			}
+		}
+		lon, lat := tileToLonLat(z, x, y, float64(zigzag(geometry[1])), float64(zigzag(geometry[2])), extent)
+		points = append(points, vectorPoint{Layer: name, Props: props, Lon: lon, Lat: lat})
+	}
+	return points, nil
+}
+
+func decodeVectorValue(data []byte) interface{} {
+	r := &pbReader{buf: data}
+	for r.more() {
+		field, wire, err := r.key()
+		if err != nil {
+			return nil
+		}
+		switch field {
+		case 1:
+			b, err := r.bytes()
+			if err != nil {
+				return nil
+			}
+			return string(b)
+		case 2:
+			v, err := r.fixed32()
+			if err != nil {
+				return nil
+			}
+			return float32bits(v)
+		case 3:
+			v, err := r.fixed64()
+			if err != nil {
+				return nil
+			}
+			return float64bits(v)
+		case 4, 5:
+			v, err := r.varint()
+			if err != nil {
+				return nil
+			}
+			return int64(v)
+		case 6:
+			v, err := r.varint()
+			if err != nil {
+				return nil
+			}
+			return zigzag(v)
+		case 7:
+			v, err := r.varint()
+			if err != nil {
+				return nil
+			}
+			return v != 0
+		default:
+			if r.skip(wire) != nil {
+				return nil
+			}
+		}
+	}
+	return nil
+}
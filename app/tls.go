@@ -7,9 +7,11 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"math/big"
@@ -18,6 +20,16 @@ import (
 	"time"
 )
 
+var tlsFingerprint string
+
+func certFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
 func getCertificate(certPath string) (tls.Certificate, error) {
 	if _, err := os.Stat(certPath); err == nil {
 		certPEM, err := os.ReadFile(certPath)
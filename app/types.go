@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/json"
 	"strings"
 )
 
@@ -23,12 +24,13 @@ type ExternalLink struct {
 }
 
 type FileInfo struct {
-	Name    string
-	Path    string
-	Isdir   bool
-	IsMap   bool
-	Size    string
-	ModTime string
+	Name     string
+	Path     string
+	Isdir    bool
+	IsMap    bool
+	IsBundle bool
+	Size     string
+	ModTime  string
 }
 
 type PageData struct {
@@ -51,18 +53,261 @@ type EditPageData struct {
 	Content    string
 }
 
+type RoomInfo struct {
+	Name         string `json:"name"`
+	Participants int    `json:"participants"`
+	Protected    bool   `json:"protected"`
+	TalkTime     int    `json:"talk_time,omitempty"`
+}
+
+type RecordingEvent struct {
+	Offset float64 `json:"offset"`
+	Event  string  `json:"event"`
+	Name   string  `json:"name"`
+}
+
+type RecordingInfo struct {
+	Room         string           `json:"room"`
+	File         string           `json:"file"`
+	Started      int64            `json:"started"`
+	Stopped      int64            `json:"stopped,omitempty"`
+	Duration     float64          `json:"duration"`
+	StartedBy    string           `json:"started_by"`
+	Participants []string         `json:"participants"`
+	Events       []RecordingEvent `json:"events"`
+}
+
+type FloorInfo struct {
+	Type     string  `json:"type"`
+	Room     string  `json:"room"`
+	Mode     string  `json:"mode"`
+	TalkTime int     `json:"talk_time,omitempty"`
+	Holder   int64   `json:"holder"`
+	Expires  int64   `json:"expires,omitempty"`
+	Queue    []int64 `json:"queue"`
+}
+
+type Participant struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Muted    bool   `json:"muted"`
+	Speaking bool   `json:"speaking"`
+}
+
+type Roster struct {
+	Type         string        `json:"type"`
+	Room         string        `json:"room"`
+	Participants []Participant `json:"participants"`
+}
+
+type PresenceEvent struct {
+	Type     string `json:"type"`
+	Event    string `json:"event"`
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Previous string `json:"previous,omitempty"`
+}
+
+type SignalMessage struct {
+	Type string          `json:"type"`
+	From int64           `json:"from"`
+	To   int64           `json:"to"`
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type DirectMessage struct {
+	Type      string `json:"type"`
+	ID        int64  `json:"id,omitempty"`
+	From      string `json:"from,omitempty"`
+	FromID    int64  `json:"from_id,omitempty"`
+	To        string `json:"to,omitempty"`
+	ToID      int64  `json:"to_id,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Time      int64  `json:"time,omitempty"`
+	Delivered bool   `json:"delivered"`
+	Offline   bool   `json:"offline,omitempty"`
+	Echo      bool   `json:"echo,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ChatMessage struct {
+	ID      int64  `json:"id"`
+	Sender  string `json:"sender"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Time    int64  `json:"time"`
+	History bool   `json:"history,omitempty"`
+}
+
 type BBSMessage struct {
-	ID        int    `json:"-"`
+	ID        int64  `json:"id"`
+	UID       string `json:"uid,omitempty"`
+	Origin    string `json:"origin,omitempty"`
+	Board     string `json:"board"`
+	ParentID  int64  `json:"parent_id,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Author    string `json:"author"`
+	Owner     string `json:"owner,omitempty"`
 	Message   string `json:"message"`
 	CreatedAt string `json:"time"`
+	UpdatedAt string `json:"updated,omitempty"`
+}
+
+type BBSSyncMessage struct {
+	UID         string          `json:"uid"`
+	Origin      string          `json:"origin"`
+	Seq         int64           `json:"seq"`
+	ParentUID   string          `json:"parent_uid,omitempty"`
+	Board       string          `json:"board"`
+	Title       string          `json:"title,omitempty"`
+	Author      string          `json:"author"`
+	Message     string          `json:"message"`
+	CreatedAt   string          `json:"time"`
+	UpdatedAt   string          `json:"updated,omitempty"`
+	Deleted     bool            `json:"deleted,omitempty"`
+	Key         string          `json:"key,omitempty"`
+	Signature   string          `json:"signature,omitempty"`
+	Attachments []BBSAttachment `json:"attachments,omitempty"`
+}
+
+type BBSSyncBatch struct {
+	Node     string           `json:"node"`
+	Messages []BBSSyncMessage `json:"messages"`
+	More     bool             `json:"more"`
+}
+
+type BBSAttachment struct {
+	ID        int64  `json:"id"`
+	MessageID int64  `json:"message_id"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Mime      string `json:"mime"`
+	SizeLabel string `json:"-"`
+	URL       string `json:"url"`
+	ThumbURL  string `json:"thumb_url,omitempty"`
+	IsImage   bool   `json:"is_image"`
+}
+
+type BBSMessageView struct {
+	BBSMessage
+	CanEdit     bool            `json:"can_edit"`
+	Attachments []BBSAttachment `json:"attachments,omitempty"`
+}
+
+type BBSTopicView struct {
+	BBSMessageView
+	Replies      int    `json:"replies"`
+	LastActivity string `json:"last_activity"`
+}
+
+type BBSThread struct {
+	Topic   BBSMessageView   `json:"topic"`
+	Replies []BBSMessageView `json:"replies"`
+}
+
+type BBSBoard struct {
+	Name     string `json:"name"`
+	Topics   int    `json:"topics"`
+	Messages int    `json:"messages"`
 }
 
 type BBSPageData struct {
 	Title       string
-	Messages    []BBSMessage
+	Board       string
+	Boards      []BBSBoard
+	Author      string
+	Topics      []BBSTopicView
+	Thread      *BBSThread
+	Query       string
+	Results     []BBSMessageView
 	CurrentPage int
 	TotalPages  int
 	HasPrevious bool
 	HasNext     bool
 	Pages       []int
 }
+
+type BundleEntry struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	ModTime int64  `json:"mtime,omitempty"`
+}
+
+type BundleManifest struct {
+	Version   int              `json:"version"`
+	Node      string           `json:"node"`
+	Name      string           `json:"name"`
+	PublicKey string           `json:"public_key"`
+	Created   string           `json:"created"`
+	Folders   []string         `json:"folders,omitempty"`
+	Messages  []BBSSyncMessage `json:"messages,omitempty"`
+	Cursors   map[string]int64 `json:"cursors,omitempty"`
+	Entries   []BundleEntry    `json:"entries"`
+}
+
+type PeerEntry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	IsDir   bool   `json:"is_dir"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+type PeerListing struct {
+	Node    string      `json:"node"`
+	Name    string      `json:"name"`
+	Path    string      `json:"path"`
+	Entries []PeerEntry `json:"entries"`
+}
+
+type PeerOffer struct {
+	Node      string `json:"node"`
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+	Port      int    `json:"port"`
+	Path      string `json:"path"`
+	Dest      string `json:"dest"`
+	Time      int64  `json:"time"`
+	Target    string `json:"target"`
+	Source    string `json:"source"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+type MeshRoute struct {
+	Node     string   `json:"node"`
+	Name     string   `json:"name"`
+	Version  string   `json:"version"`
+	Hops     int      `json:"hops"`
+	Via      string   `json:"via"`
+	Features []string `json:"features"`
+	LastSeen int64    `json:"last_seen"`
+}
+
+type MeshTable struct {
+	Node   string      `json:"node"`
+	Name   string      `json:"name"`
+	Routes []MeshRoute `json:"routes"`
+}
+
+type PeerTransfer struct {
+	ID        string `json:"id"`
+	Direction string `json:"direction"`
+	Peer      string `json:"peer"`
+	PeerName  string `json:"peer_name,omitempty"`
+	Path      string `json:"path"`
+	Dest      string `json:"dest"`
+	State     string `json:"state"`
+	Files     int    `json:"files"`
+	FilesDone int    `json:"files_done"`
+	Bytes     int64  `json:"bytes"`
+	Total     int64  `json:"total"`
+	Conflicts int    `json:"conflicts,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Started   int64  `json:"started"`
+	Updated   int64  `json:"updated"`
+}
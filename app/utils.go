@@ -3,8 +3,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"net/url"
@@ -12,6 +14,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 func getSafePath(relativePath string) (string, error) {
@@ -27,6 +30,64 @@ func getSafePath(relativePath string) (string, error) {
 	return cleanedPath, nil
 }
 
+// truncateString cuts s to at most n bytes without splitting a character.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func normalizeSlug(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('-')
+		}
+	}
+	slug := b.String()
+	if len(slug) > bbsMaxNameSize {
+		slug = slug[:bbsMaxNameSize]
+	}
+	return slug
+}
+
+func findTreeFiles(suffixes ...string) map[string]os.FileInfo {
+	found := make(map[string]os.FileInfo)
+	sysAbs, _ := filepath.Abs(options.SystemPath)
+	rootAbs, _ := filepath.Abs(options.RootPath)
+	filepath.WalkDir(rootAbs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path == sysAbs {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		lower := strings.ToLower(d.Name())
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(lower, suffix) {
+				if info, err := d.Info(); err == nil {
+					rel, _ := filepath.Rel(rootAbs, path)
+					found[filepath.ToSlash(rel)] = info
+				}
+				break
+			}
+		}
+		return nil
+	})
+	return found
+}
+
 func formatFileSize(size int64) string {
 	const (
 		KB = 1024
@@ -59,12 +120,13 @@ func renderPage(w http.ResponseWriter, r *http.Request, absPath, relativePath st
 		}
 		name := entry.Name()
 		files = append(files, FileInfo{
-			Name:    name,
-			Path:    filepath.ToSlash(filepath.Join(relativePath, entry.Name())),
-			Isdir:   entry.IsDir(),
-			Size:    formatFileSize(info.Size()),
-			ModTime: info.ModTime().Format("2006-01-02 15:04"),
-			IsMap:   strings.HasSuffix(strings.ToLower(name), ".pmtiles") || strings.HasSuffix(strings.ToLower(name), ".mbtiles"),
+			Name:     name,
+			Path:     filepath.ToSlash(filepath.Join(relativePath, entry.Name())),
+			Isdir:    entry.IsDir(),
+			Size:     formatFileSize(info.Size()),
+			ModTime:  info.ModTime().Format("2006-01-02 15:04"),
+			IsMap:    strings.HasSuffix(strings.ToLower(name), ".pmtiles") || strings.HasSuffix(strings.ToLower(name), ".mbtiles"),
+			IsBundle: !entry.IsDir() && isBundleFile(name),
 		})
 	}
 	sort.Slice(files, func(i, j int) bool {
@@ -79,12 +141,6 @@ func renderPage(w http.ResponseWriter, r *http.Request, absPath, relativePath st
 		parentPath = filepath.ToSlash(filepath.Dir(relativePath))
 	}
 
-	isAuthenticated := false
-	cookie, err := r.Cookie(sessionCookie)
-	if err == nil {
-		isAuthenticated = isCookieValid(cookie.Value)
-	}
-
 	data := PageData{
 		Title:             appLabel,
 		CurrentPath:       relativePath,
@@ -93,7 +149,7 @@ func renderPage(w http.ResponseWriter, r *http.Request, absPath, relativePath st
 		Message:           r.URL.Query().Get("msg"),
 		Error:             r.URL.Query().Get("err"),
 		PasswordProtected: options.Password != "",
-		IsAuthenticated:   isAuthenticated,
+		IsAuthenticated:   isAuthenticated(r),
 		HasBBS:            options.BBSPath != "",
 	}
 	if relativePath == "." || relativePath == "" {
@@ -104,6 +160,16 @@ func renderPage(w http.ResponseWriter, r *http.Request, absPath, relativePath st
 	templates.ExecuteTemplate(w, "index.html", data)
 }
 
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
 func handleCreateTxt(w http.ResponseWriter, r *http.Request, currentPath string) {
 	fileName := r.FormValue("filename")
 	currentRelPath := r.FormValue("path")
@@ -257,6 +323,7 @@ func handleSaveFile(w http.ResponseWriter, r *http.Request) {
 }
 
 func isPrivateIP(ipStr string) bool {
+	ipStr, _, _ = strings.Cut(strings.Trim(ipStr, "[]"), "%")
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return false
@@ -270,5 +337,28 @@ func isPrivateIP(ipStr string) bool {
 			(ip4[0] == 192 && ip4[1] == 168) ||
 			(ip4[0] == 169 && ip4[1] == 254)
 	}
+	return ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// isAnyHost reports whether host means every address of both IPv4 and
+// IPv6; 0.0.0.0 is every IPv4 address only.
+func isAnyHost(host string) bool {
+	switch strings.Trim(host, "[]") {
+	case "", "::":
+		return true
+	}
 	return false
 }
+
+func isWildcardHost(host string) bool {
+	return isAnyHost(host) || host == "0.0.0.0"
+}
+
+// ipString formats an address with its zone, which link-local IPv6
+// addresses need to be reached.
+func ipString(ip net.IP, zone string) string {
+	if zone != "" && ip.To4() == nil {
+		return ip.String() + "%" + zone
+	}
+	return ip.String()
+}
@@ -3,9 +3,24 @@
 package test
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	_ "image/jpeg"
+	"image/png"
 	"io"
+	"maps"
+	"math"
 	"mime/multipart"
 	"net"
 	"net/http"
@@ -14,14 +29,20 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 const (
 	serverPort    = "45678"
-	bindHost      = "0.0.0.0"   // Must be 0.0.0.0 to enable Discovery service
+	discoveryPort = "45690"
+	bindHost      = "::"        // Every address, which also enables Discovery
+	bindHost4     = "0.0.0.0"   // Every IPv4 address only
 	clientHost    = "127.0.0.1" // We connect via loopback
 	serverURL     = "http://" + clientHost + ":" + serverPort
 	testPassword  = "testsecret"
@@ -59,10 +80,36 @@ func TestMain(m *testing.M) {
 
 // TestAppSuite runs the server once and executes all sub-tests against it
 func TestAppSuite(t *testing.T) {
+	// Seed a gazetteer so the place index has something to search
+	sysDir := filepath.Join(testRootFiles, "sys")
+	os.MkdirAll(sysDir, 0755)
+	gazetteer := "name,lat,lon,kind\nSpringfield,39.7817,-89.6501,city\nShelbyville,39.4064,-88.7901,town\nNorth Haverbrook,40.1,-89.1,town\n"
+	if err := os.WriteFile(filepath.Join(sysDir, "gazetteer.csv"), []byte(gazetteer), 0644); err != nil {
+		t.Fatalf("Failed to write gazetteer: %v", err)
+	}
+
+	// Seed a vector tile archive, with a feature whose tags point past the
+	// end of the key table, to exercise the tile decoder
+	if err := writePMTiles(filepath.Join(testRootFiles, "maps", "places.pmtiles"), placesTile()); err != nil {
+		t.Fatalf("Failed to write tiles: %v", err)
+	}
+
+	// Seed a road extract where the fastest way is the longer one
+	if err := writeOSMPBF(filepath.Join(testRootFiles, "maps", "roads.osm.pbf")); err != nil {
+		t.Fatalf("Failed to write roads: %v", err)
+	}
+
+	// Seed a legacy JSONL BBS that must be migrated to sqlite on start
+	legacyBBS := `{"message":"Legacy notice about the generator","time":"2024-01-01 10:00:00"}` + "\n"
+	if err := os.WriteFile(filepath.Join(sysDir, "bbs.db"), []byte(legacyBBS), 0644); err != nil {
+		t.Fatalf("Failed to write legacy BBS: %v", err)
+	}
+
 	// Start the server in the background
 	cmd := exec.Command("./"+buildName,
 		"--web-port", serverPort,
-		"--web-host", bindHost, // 0.0.0.0 allows discovery to start
+		"--web-host", bindHost, // :: allows discovery to start
+		"--discovery-port", discoveryPort,
 		"--root", testRootFiles,
 		"--password", testPassword,
 	)
@@ -94,7 +141,7 @@ func TestAppSuite(t *testing.T) {
 	// 2. check unauthorized access
 	t.Run("UnauthorizedAccess", func(t *testing.T) { testUnauthorizedAccess(t) })
 	
-	// 3. check udp discovery (requires server running on 0.0.0.0)
+	// 3. check udp discovery (requires server running on a wildcard address)
 	t.Run("DiscoveryUDP", func(t *testing.T) { testDiscoveryUDP(t) })
 	
 	// 4. login (persists cookie in jar)
@@ -105,6 +152,81 @@ func TestAppSuite(t *testing.T) {
 	
 	// 6. bbs posting (requires login)
 	t.Run("BBSFunctionality", func(t *testing.T) { testBBSFunctionality(t, client) })
+
+	// 7. bbs topics, replies and JSON API (requires login)
+	t.Run("BBSThreads", func(t *testing.T) { testBBSThreads(t, client) })
+
+	// 8. bbs migration from JSONL and full text search
+	t.Run("BBSSearch", func(t *testing.T) { testBBSSearch(t, client) })
+
+	// 9. offline place search (gazetteer indexed in background)
+	t.Run("MapSearch", func(t *testing.T) { testMapSearch(t, client) })
+
+	// 10. bbs attachments stored in the file tree with thumbnails
+	t.Run("BBSAttachments", func(t *testing.T) { testBBSAttachments(t, client) })
+
+	// 11. bbs replication feed with per-origin sequence filtering
+	t.Run("BBSSync", func(t *testing.T) { testBBSSync(t, client) })
+
+	// 12. signed store-and-forward bundles
+	t.Run("Bundles", func(t *testing.T) { testBundles(t, client) })
+
+	// 13. room chat persistence, replay on connect and history paging
+	t.Run("ChatHistory", func(t *testing.T) { testChatHistory(t, client) })
+
+	// 14. named rooms with isolated broadcast, listing and passwords
+	t.Run("NamedRooms", func(t *testing.T) { testNamedRooms(t, client) })
+
+	// 15. room presence roster, speaking indicators and status counts
+	t.Run("RoomPresence", func(t *testing.T) { testRoomPresence(t, client) })
+
+	// 16. server-side audio mixing without the listener's own voice
+	t.Run("AudioMixing", func(t *testing.T) { testAudioMixing(t) })
+
+	// 17. per-client codec negotiation with transcoding between adpcm and pcm
+	t.Run("AudioCodecs", func(t *testing.T) { testAudioCodecs(t) })
+
+	// 18. push-to-talk floor control with queue and max talk time
+	t.Run("PushToTalk", func(t *testing.T) { testPushToTalk(t, client) })
+
+	// 19. admin controlled room recording with metadata sidecar
+	t.Run("RoomRecording", func(t *testing.T) { testRoomRecording(t, client) })
+
+	// 20. webrtc signaling relayed between peers of the same room
+	t.Run("WebRTCSignaling", func(t *testing.T) { testWebRTCSignaling(t) })
+
+	// 21. private messages by id or nickname with offline delivery
+	t.Run("DirectMessages", func(t *testing.T) { testDirectMessages(t) })
+
+	// 22. origin checks, rate limits, kick/ban and optional room login
+	t.Run("RoomGuard", func(t *testing.T) { testRoomGuard(t, client) })
+
+	// 23. file listing for peers and signed offers pulled with resume
+	t.Run("PeerTransfer", func(t *testing.T) { testPeerTransfer(t, client) })
+
+	// 24. folder sync manifests and modes
+	t.Run("FolderSync", func(t *testing.T) { testFolderSync(t) })
+
+	// 25. signed announcements, nonces and mesh keys
+	t.Run("SignedDiscovery", func(t *testing.T) { testSignedDiscovery(t) })
+
+	// 26. announcements carry port, tls fingerprint, features, storage and users
+	t.Run("DiscoveryAnnouncements", func(t *testing.T) { testDiscoveryAnnouncements(t) })
+
+	// 27. mDNS/DNS-SD advertisement answered to legacy unicast queries
+	t.Run("MDNS", func(t *testing.T) { testMDNS(t) })
+
+	// 28. routing table and hop-limited relay
+	t.Run("MeshRelay", func(t *testing.T) { testMeshRelay(t, client) })
+
+	// 29. discovery on a custom port through configured peers, and a relay across two hops
+	t.Run("MeshDiscovery", func(t *testing.T) { testMeshDiscovery(t) })
+
+	// 30. dual-stack web server, IPv6 addresses in status and discovery over IPv6
+	t.Run("IPv6", func(t *testing.T) { testIPv6(t) })
+
+	// 31. offline routing on a graph built from an .osm.pbf extract
+	t.Run("MapRoute", func(t *testing.T) { testMapRoute(t, client) })
 }
 
 func waitForServer(t *testing.T) bool {
@@ -225,7 +347,7 @@ func testLoginFlow(t *testing.T, client *http.Client) {
 
 func testDiscoveryUDP(t *testing.T) {
 	// Send "TAZ_DISCOVER" to UDP port
-	addr, err := net.ResolveUDPAddr("udp", clientHost+":"+serverPort)
+	addr, err := net.ResolveUDPAddr("udp", clientHost+":"+discoveryPort)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -238,7 +360,7 @@ func testDiscoveryUDP(t *testing.T) {
 
 	conn.SetDeadline(time.Now().Add(2 * time.Second))
 	
-	msg := []byte("TAZ_DISCOVER")
+	msg := []byte("TAZ_DISCOVER|e2enonce")
 	_, err = conn.Write(msg)
 	if err != nil {
 		t.Fatal(err)
@@ -252,10 +374,24 @@ func testDiscoveryUDP(t *testing.T) {
 	}
 
 	response := string(buf[:n])
-	// Expected format: TAZ_IDENT|<Name>|<Version>
+	// Expected format: TAZ_IDENT|<Name>|<Version>|<node>|<key>|<nonce>|<announcement>|<mac>|<signature>
 	if !strings.HasPrefix(response, "TAZ_IDENT|") {
 		t.Errorf("Invalid discovery response: %s", response)
 	}
+	if !verifyIdent(response, "e2enonce") {
+		t.Errorf("Discovery response is not signed for our nonce: %s", response)
+	}
+}
+
+func verifyIdent(msg, nonce string) bool {
+	parts := strings.Split(msg, "|")
+	if len(parts) != 9 || parts[5] != nonce {
+		return false
+	}
+	pub, err := hex.DecodeString(parts[4])
+	sig, serr := hex.DecodeString(parts[8])
+	return err == nil && serr == nil && len(pub) == ed25519.PublicKeySize &&
+		ed25519.Verify(ed25519.PublicKey(pub), []byte(strings.Join(parts[:8], "|")), sig)
 }
 
 func testFileUpload(t *testing.T, client *http.Client) {
@@ -327,3 +463,2371 @@ func testBBSFunctionality(t *testing.T, client *http.Client) {
 		t.Errorf("BBS did not contain the posted message. Body snippet: %s", bodyString[:200])
 	}
 }
+
+func testBBSThreads(t *testing.T, client *http.Client) {
+	// Create a topic on a named board through the JSON API
+	payload := `{"board":"ops","title":"Water point","message":"Where is the water?","author":"tester"}`
+	resp, err := client.Post(serverURL+"/bbs/api/messages", "application/json", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var topic struct {
+		ID      int64  `json:"id"`
+		Board   string `json:"board"`
+		Author  string `json:"author"`
+		Owner   string `json:"owner"`
+		CanEdit bool   `json:"can_edit"`
+	}
+	json.NewDecoder(resp.Body).Decode(&topic)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+	}
+	if topic.ID == 0 || topic.Board != "ops" || topic.Author != "tester" || !topic.CanEdit || topic.Owner != "" {
+		t.Fatalf("Unexpected topic: %+v", topic)
+	}
+
+	// Reply through the HTML form
+	form := url.Values{}
+	form.Set("parent_id", fmt.Sprint(topic.ID))
+	form.Set("message", "Behind the school")
+	resp, err = client.PostForm(serverURL+"/bbs", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = client.Get(fmt.Sprintf("%s/bbs/api/topics/%d", serverURL, topic.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var thread struct {
+		Replies []struct {
+			ID      int64  `json:"id"`
+			Message string `json:"message"`
+			Author  string `json:"author"`
+		} `json:"replies"`
+	}
+	json.NewDecoder(resp.Body).Decode(&thread)
+	resp.Body.Close()
+	if len(thread.Replies) != 1 || thread.Replies[0].Message != "Behind the school" || thread.Replies[0].Author != "tester" {
+		t.Fatalf("Unexpected thread replies: %+v", thread.Replies)
+	}
+
+	// Anonymous clients cannot modify messages when a password is set
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/bbs/api/messages/%d", serverURL, thread.Replies[0].ID), nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for anonymous delete, got %d", resp.StatusCode)
+	}
+
+	// Deleting the topic removes its replies
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("%s/bbs/api/messages/%d", serverURL, topic.ID), nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for topic delete, got %d", resp.StatusCode)
+	}
+	resp, err = client.Get(fmt.Sprintf("%s/bbs/api/topics/%d", serverURL, thread.Replies[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected reply to be gone with its topic, got %d", resp.StatusCode)
+	}
+}
+
+func testBBSSearch(t *testing.T, client *http.Client) {
+	resp, err := client.Get(serverURL + "/bbs/api/search?q=generat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var results []struct {
+		Message string `json:"message"`
+		Board   string `json:"board"`
+	}
+	json.NewDecoder(resp.Body).Decode(&results)
+	if len(results) != 1 || !strings.Contains(results[0].Message, "Legacy notice") || results[0].Board != "general" {
+		t.Errorf("Legacy message not found after migration: %+v", results)
+	}
+
+	if _, err := os.Stat(filepath.Join(testRootFiles, "sys", "bbs.db.jsonl")); err != nil {
+		t.Errorf("Legacy BBS backup missing: %v", err)
+	}
+}
+
+func testMapSearch(t *testing.T, client *http.Client) {
+	search := func(query, want string) string {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			resp, err := client.Get(serverURL + "/map/search?q=" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+			}
+			if strings.Contains(string(body), want) {
+				return string(body)
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		return ""
+	}
+
+	body := search("spring", "Springfield")
+	if body == "" {
+		t.Error("Place search never returned the gazetteer entry")
+	} else if strings.Contains(body, "Shelbyville") {
+		t.Errorf("Search returned unrelated place: %s", body)
+	}
+
+	if search("haver", "North Haverbrook") == "" {
+		t.Error("Place search did not match a later word of the name")
+	}
+
+	body = search("ogden", "Ogdenville")
+	if body == "" {
+		t.Fatal("Place search never returned the tile entry")
+	}
+	var places []struct {
+		Name string  `json:"name"`
+		Kind string  `json:"kind"`
+		Lat  float64 `json:"lat"`
+		Lon  float64 `json:"lon"`
+	}
+	json.Unmarshal([]byte(body), &places)
+	if len(places) != 1 || places[0].Kind != "town" || math.Abs(places[0].Lat) > 0.01 || math.Abs(places[0].Lon) > 0.01 {
+		t.Errorf("Unexpected tile place: %s", body)
+	}
+}
+
+func pbVarint(field int, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(field)<<3), v)
+}
+
+func pbBytes(field int, data []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func pbPacked(field int, values ...uint64) []byte {
+	var data []byte
+	for _, v := range values {
+		data = binary.AppendUvarint(data, v)
+	}
+	return pbBytes(field, data)
+}
+
+// placesTile is a z0 vector tile with a town in the middle of the map and a
+// nameless feature whose tag index does not fit in an int.
+func placesTile() []byte {
+	point := pbPacked(4, 9, 4096, 4096)
+	var layer []byte
+	layer = append(layer, pbVarint(15, 2)...)
+	layer = append(layer, pbBytes(1, []byte("places"))...)
+	layer = append(layer, pbBytes(2, slices.Concat(pbPacked(2, 0, 0, 1, 1), pbVarint(3, 1), point))...)
+	layer = append(layer, pbBytes(2, slices.Concat(pbPacked(2, 1<<63, 0), pbVarint(3, 1), point))...)
+	layer = append(layer, pbBytes(3, []byte("name"))...)
+	layer = append(layer, pbBytes(3, []byte("kind"))...)
+	layer = append(layer, pbBytes(4, pbBytes(1, []byte("Ogdenville")))...)
+	layer = append(layer, pbBytes(4, pbBytes(1, []byte("town")))...)
+	layer = append(layer, pbVarint(5, 4096)...)
+	return pbBytes(3, layer)
+}
+
+// writePMTiles stores tile as the only tile of an uncompressed z0 archive.
+func writePMTiles(path string, tile []byte) error {
+	root := slices.Concat(binary.AppendUvarint(nil, 1), []byte{0, 1}, binary.AppendUvarint(nil, uint64(len(tile))), []byte{1})
+	header := make([]byte, 127)
+	copy(header, "PMTiles")
+	header[7] = 3
+	binary.LittleEndian.PutUint64(header[8:], 127)
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(root)))
+	binary.LittleEndian.PutUint64(header[40:], uint64(127+len(root)))
+	binary.LittleEndian.PutUint64(header[56:], uint64(127+len(root)))
+	binary.LittleEndian.PutUint64(header[64:], uint64(len(tile)))
+	header[97], header[98], header[99] = 1, 1, 1
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, slices.Concat(header, root, tile), 0644)
+}
+
+func testBBSAttachments(t *testing.T, client *http.Client) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("title", "Site photos")
+	writer.WriteField("message", "Pictures of the water point")
+
+	part, _ := writer.CreateFormFile("attachments", "photo.png")
+	png.Encode(part, image.NewRGBA(image.Rect(0, 0, 400, 300)))
+	part, _ = writer.CreateFormFile("attachments", "notes.txt")
+	part.Write([]byte("bring buckets"))
+	part, _ = writer.CreateFormFile("attachments", "notes.txt")
+	part.Write([]byte("and ropes"))
+	// A tiny PNG declaring a 100000x100000 image
+	var bomb bytes.Buffer
+	png.Encode(&bomb, image.NewGray(image.Rect(0, 0, 1, 1)))
+	header := bomb.Bytes()
+	binary.BigEndian.PutUint32(header[16:], 100000)
+	binary.BigEndian.PutUint32(header[20:], 100000)
+	binary.BigEndian.PutUint32(header[29:], crc32.ChecksumIEEE(header[12:29]))
+	part, _ = writer.CreateFormFile("attachments", "bomb.png")
+	part.Write(header)
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", serverURL+"/bbs/api/messages", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg struct {
+		ID          int64 `json:"id"`
+		Attachments []struct {
+			Name     string `json:"name"`
+			URL      string `json:"url"`
+			ThumbURL string `json:"thumb_url"`
+		} `json:"attachments"`
+	}
+	json.NewDecoder(resp.Body).Decode(&msg)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || len(msg.Attachments) != 4 {
+		t.Fatalf("Unexpected attachment post (status %d): %+v", resp.StatusCode, msg)
+	}
+	if msg.Attachments[0].ThumbURL == "" || msg.Attachments[1].ThumbURL != "" {
+		t.Errorf("Expected a thumbnail only for the image: %+v", msg.Attachments)
+	}
+	if msg.Attachments[2].Name != "notes-2.txt" {
+		t.Errorf("Expected a unique name for the second notes.txt: %+v", msg.Attachments[2])
+	}
+	resp, err = client.Get(serverURL + msg.Attachments[3].ThumbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected no thumbnail for an oversized image, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.Get(serverURL + msg.Attachments[0].ThumbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb, _, err := image.Decode(resp.Body)
+	resp.Body.Close()
+	if err != nil || thumb.Bounds().Dx() > 240 {
+		t.Errorf("Invalid thumbnail: %v", err)
+	}
+
+	resp, err = client.Get(serverURL + msg.Attachments[1].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(content) != "bring buckets" {
+		t.Errorf("Attachment download mismatch: %q", string(content))
+	}
+	resp, err = client.Get(serverURL + msg.Attachments[2].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(content) != "and ropes" {
+		t.Errorf("Same-name attachment overwritten: %q", string(content))
+	}
+
+	resp, err = client.Get(serverURL + "/bbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), msg.Attachments[0].ThumbURL) || !strings.Contains(string(page), "notes.txt") {
+		t.Error("BBS page does not render attachments")
+	}
+
+	dir := filepath.Join(testRootFiles, "bbs-attachments", fmt.Sprint(msg.ID))
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("Attachment directory missing: %v", err)
+	}
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("%s/bbs/api/messages/%d", serverURL, msg.ID), nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("Attachment directory was not removed with the message")
+	}
+}
+
+func testBBSSync(t *testing.T, client *http.Client) {
+	type batch struct {
+		Node     string `json:"node"`
+		Messages []struct {
+			UID       string `json:"uid"`
+			Origin    string `json:"origin"`
+			Seq       int64  `json:"seq"`
+			ParentUID string `json:"parent_uid"`
+			Owner     string `json:"owner"`
+			Board     string `json:"board"`
+			Title     string `json:"title"`
+			Author    string `json:"author"`
+			Message   string `json:"message"`
+			CreatedAt string `json:"time"`
+			UpdatedAt string `json:"updated"`
+			Deleted   bool   `json:"deleted"`
+			Key       string `json:"key"`
+			Signature string `json:"signature"`
+		} `json:"messages"`
+	}
+	fetch := func(since string) batch {
+		resp, err := client.Get(serverURL + "/bbs/api/sync?since=" + url.QueryEscape(since))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		var b batch
+		json.NewDecoder(resp.Body).Decode(&b)
+		return b
+	}
+
+	all := fetch("")
+	if all.Node == "" || len(all.Messages) == 0 {
+		t.Fatalf("Unexpected sync feed: %+v", all)
+	}
+	seen := make(map[string]bool)
+	var last int64
+	for _, m := range all.Messages {
+		if m.UID == "" || m.Origin != all.Node || m.Seq <= last || m.Owner != "" {
+			t.Fatalf("Unexpected sync message: %+v", m)
+		}
+		if m.ParentUID != "" && !seen[m.ParentUID] {
+			t.Errorf("Reply %s sent before its topic %s", m.UID, m.ParentUID)
+		}
+		seen[m.UID] = true
+		last = m.Seq
+	}
+
+	if rest := fetch(fmt.Sprintf("%s:%d", all.Node, last-1)); len(rest.Messages) != 1 || rest.Messages[0].Seq != last {
+		t.Errorf("Expected only the newest message after seq %d, got %+v", last-1, rest.Messages)
+	}
+
+	// Edits and deletions of our own messages reach the feed under a new
+	// seq, signed by this node
+	resp, err := client.Post(serverURL+"/bbs/api/messages", "application/json", strings.NewReader(`{"board":"sync","title":"Draft","message":"first words"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/bbs/api/messages/%d", serverURL, created.ID), strings.NewReader(`{"title":"Final","message":"second words"}`))
+	if resp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	edited := fetch(fmt.Sprintf("%s:%d", all.Node, last))
+	if len(edited.Messages) != 1 || edited.Messages[0].Message != "second words" || edited.Messages[0].Seq <= last+1 {
+		t.Fatalf("Expected the edit under a new seq, got %+v", edited.Messages)
+	}
+	m := edited.Messages[0]
+	payload, _ := json.Marshal([]any{"TAZ_BBS", m.UID, m.Origin, m.Seq, m.ParentUID, m.Board, m.Title, m.Author, m.Message, m.CreatedAt, m.UpdatedAt, m.Deleted})
+	pub, _ := hex.DecodeString(m.Key)
+	sig, _ := hex.DecodeString(m.Signature)
+	if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, payload, sig) {
+		t.Errorf("Invalid signature on %+v", m)
+	}
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("%s/bbs/api/messages/%d", serverURL, created.ID), nil)
+	if resp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gone := fetch(fmt.Sprintf("%s:%d", all.Node, m.Seq)); len(gone.Messages) != 1 || gone.Messages[0].UID != m.UID || !gone.Messages[0].Deleted {
+		t.Errorf("Expected a tombstone for %s, got %+v", m.UID, gone.Messages)
+	}
+
+	// Cursors of a peer are bounded and checked
+	resp, err = client.Get(serverURL + "/bbs/api/sync?since=" + url.QueryEscape(strings.Repeat("x:1,", 5000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected malformed cursors to be ignored, got %d", resp.StatusCode)
+	}
+}
+
+func testBundles(t *testing.T, client *http.Client) {
+	folder := filepath.Join(testRootFiles, "reports")
+	os.MkdirAll(folder, 0755)
+	os.WriteFile(filepath.Join(folder, "week1.txt"), []byte("all quiet"), 0644)
+
+	post := func(values url.Values) *url.URL {
+		resp, err := client.PostForm(serverURL+"/", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Request.URL
+	}
+
+	result := post(url.Values{"action": {"bundle"}, "path": {"."}, "item": {"reports"}})
+	if result.Query().Get("err") != "" {
+		t.Fatalf("Bundle export failed: %s", result.Query().Get("err"))
+	}
+	bundles, _ := filepath.Glob(filepath.Join(testRootFiles, "bundles", "*.tazbundle"))
+	if len(bundles) != 1 {
+		t.Fatalf("Expected one bundle in the file tree, found %v", bundles)
+	}
+	item := "bundles/" + filepath.Base(bundles[0])
+
+	// Importing on the node that produced it changes nothing
+	result = post(url.Values{"action": {"import_bundle"}, "path": {"."}, "item": {item}})
+	if msg := result.Query().Get("msg"); !strings.Contains(msg, "0 new messages, 0 new files") {
+		t.Errorf("Expected an idempotent import, got msg=%q err=%q", msg, result.Query().Get("err"))
+	}
+
+	// Missing files are restored from the bundle
+	os.Remove(filepath.Join(folder, "week1.txt"))
+	result = post(url.Values{"action": {"import_bundle"}, "path": {"."}, "item": {item}})
+	if msg := result.Query().Get("msg"); !strings.Contains(msg, "1 new files") {
+		t.Errorf("Expected one restored file, got msg=%q err=%q", msg, result.Query().Get("err"))
+	}
+	if content, _ := os.ReadFile(filepath.Join(folder, "week1.txt")); string(content) != "all quiet" {
+		t.Errorf("Restored file content mismatch: %q", string(content))
+	}
+
+	// A changed local file is kept, and so is a changed conflict copy
+	os.WriteFile(filepath.Join(folder, "week1.txt"), []byte("storm"), 0644)
+	for i, want := range []string{"week1.*.txt", "week1.*-2.txt"} {
+		result = post(url.Values{"action": {"import_bundle"}, "path": {"."}, "item": {item}})
+		copies, _ := filepath.Glob(filepath.Join(folder, want))
+		if msg := result.Query().Get("msg"); !strings.Contains(msg, "1 new files") || len(copies) != 1 {
+			t.Fatalf("Expected conflict copy %d, got msg=%q err=%q copies=%v", i+1, msg, result.Query().Get("err"), copies)
+		}
+		if content, _ := os.ReadFile(copies[0]); string(content) != "all quiet" {
+			t.Errorf("Conflict copy content mismatch: %q", content)
+		}
+		os.WriteFile(copies[0], []byte("edited copy"), 0644)
+	}
+	if content, _ := os.ReadFile(filepath.Join(folder, "week1.txt")); string(content) != "storm" {
+		t.Errorf("Local file overwritten: %q", content)
+	}
+
+	// A bundle with a forged manifest is rejected
+	forged, _ := os.Create(filepath.Join(testRootFiles, "bundles", "forged.tazbundle"))
+	zw := zip.NewWriter(forged)
+	w, _ := zw.Create("manifest.json")
+	w.Write([]byte(`{"version":1,"node":"x","public_key":"00","entries":[]}`))
+	w, _ = zw.Create("manifest.sig")
+	w.Write([]byte("00"))
+	zw.Close()
+	forged.Close()
+	result = post(url.Values{"action": {"import_bundle"}, "path": {"."}, "item": {"bundles/forged.tazbundle"}})
+	if !strings.Contains(result.Query().Get("err"), "signature") {
+		t.Errorf("Expected forged bundle to be rejected, got msg=%q err=%q", result.Query().Get("msg"), result.Query().Get("err"))
+	}
+
+	// A bundle from another node needs a trusted key; a reply listed before
+	// its topic still gets in, one whose topic is missing holds its origin
+	// back, and one its origin did not sign is dropped
+	pub, key, _ := ed25519.GenerateKey(nil)
+	a, b, c, d := strings.Repeat("a", 16), strings.Repeat("b", 16), strings.Repeat("c", 16), strings.Repeat("d", 16)
+	signed := func(m map[string]any) map[string]any {
+		opub, okey, _ := ed25519.GenerateKey(nil)
+		str := func(k string) string { v, _ := m[k].(string); return v }
+		payload, _ := json.Marshal([]any{"TAZ_BBS", m["uid"], m["origin"], m["seq"], str("parent_uid"), str("board"), str("title"), str("author"), str("message"), str("time"), str("updated"), false})
+		m["key"] = hex.EncodeToString(opub)
+		m["signature"] = hex.EncodeToString(ed25519.Sign(okey, payload))
+		return m
+	}
+	forgedReply := signed(map[string]any{"uid": d + "-99", "origin": d, "seq": 99, "board": "general", "author": "eve", "message": "forged", "time": "2026-01-01 10:00:04"})
+	forgedReply["message"] = "tampered"
+	manifest, _ := json.Marshal(map[string]any{
+		"version": 1, "node": "carrier", "name": "carrier", "public_key": hex.EncodeToString(pub),
+		"created": "2026-01-01 10:00:00", "entries": []any{},
+		"cursors": map[string]int{a: 1, b: 1, c: 1},
+		"messages": []map[string]any{
+			signed(map[string]any{"uid": a + "-1", "origin": a, "seq": 1, "parent_uid": b + "-1", "board": "general", "author": "ann", "message": "reply first", "time": "2026-01-01 10:00:02"}),
+			signed(map[string]any{"uid": b + "-1", "origin": b, "seq": 1, "board": "general", "title": "Carried", "author": "bob", "message": "topic later", "time": "2026-01-01 10:00:01"}),
+			signed(map[string]any{"uid": c + "-1", "origin": c, "seq": 1, "parent_uid": "9999999999999999-9", "board": "general", "author": "cid", "message": "lost reply", "time": "2026-01-01 10:00:03"}),
+			forgedReply,
+		},
+	})
+	carried, _ := os.Create(filepath.Join(testRootFiles, "bundles", "carried.tazbundle"))
+	zw = zip.NewWriter(carried)
+	w, _ = zw.Create("manifest.json")
+	w.Write(manifest)
+	w, _ = zw.Create("manifest.sig")
+	w.Write([]byte(hex.EncodeToString(ed25519.Sign(key, manifest))))
+	zw.Close()
+	carried.Close()
+	result = post(url.Values{"action": {"import_bundle"}, "path": {"."}, "item": {"bundles/carried.tazbundle"}})
+	if !strings.Contains(result.Query().Get("err"), "untrusted") {
+		t.Errorf("Expected a bundle from an unknown key to be rejected, got msg=%q err=%q", result.Query().Get("msg"), result.Query().Get("err"))
+	}
+	trusted := filepath.Join(testRootFiles, "sys", "trusted_keys")
+	os.WriteFile(trusted, []byte(hex.EncodeToString(pub)+"\n"), 0644)
+	defer os.Remove(trusted)
+	result = post(url.Values{"action": {"import_bundle"}, "path": {"."}, "item": {"bundles/carried.tazbundle"}})
+	if msg := result.Query().Get("msg"); !strings.Contains(msg, "2 new messages") {
+		t.Errorf("Expected two carried messages, got msg=%q err=%q", msg, result.Query().Get("err"))
+	}
+	resp, err := client.Get(serverURL + "/bbs/api/sync?since=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch struct {
+		Messages []struct {
+			UID    string `json:"uid"`
+			Origin string `json:"origin"`
+		} `json:"messages"`
+	}
+	json.NewDecoder(resp.Body).Decode(&batch)
+	resp.Body.Close()
+	var relayed []string
+	for _, m := range batch.Messages {
+		switch m.Origin {
+		case a, b, c, d:
+			relayed = append(relayed, m.UID)
+		}
+	}
+	if strings.Join(relayed, ",") != a+"-1,"+b+"-1" {
+		t.Errorf("Expected only the vouched carried messages in origin order, got %v", relayed)
+	}
+}
+
+func testChatHistory(t *testing.T, client *http.Client) {
+	wsURL := "ws://" + clientHost + ":" + serverPort + "/room"
+	sender, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","name":"alice"}`))
+	if _, err := readFrame(sender, `"name":"alice"`); err != nil {
+		t.Fatal(err)
+	}
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"sender":"alice","message":"alice joined","type":"system"}`))
+	// The sender named in the frame is ignored in favour of the joined name
+	for i := 1; i <= 3; i++ {
+		sender.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"sender":"mallory","message":"note %d","type":"chat"}`, i)))
+	}
+	closeGracefully(sender)
+
+	type chatPage struct {
+		Messages []struct {
+			ID      int64  `json:"id"`
+			Sender  string `json:"sender"`
+			Message string `json:"message"`
+			Time    int64  `json:"time"`
+		} `json:"messages"`
+		HasMore bool `json:"has_more"`
+	}
+	var page chatPage
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(serverURL + "/room/history?limit=2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if len(page.Messages) == 2 && page.Messages[1].Message == "note 3" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(page.Messages) != 2 || page.Messages[0].Message != "note 2" || page.Messages[1].Message != "note 3" || !page.HasMore || page.Messages[1].Time == 0 || page.Messages[1].Sender != "alice" {
+		t.Fatalf("Unexpected history page: %+v", page)
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s/room/history?before=%d", serverURL, page.Messages[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var older chatPage
+	json.NewDecoder(resp.Body).Decode(&older)
+	resp.Body.Close()
+	if len(older.Messages) != 1 || older.Messages[0].Message != "note 1" || older.HasMore {
+		t.Errorf("System messages must not be stored, got older page: %+v", older)
+	}
+
+	// A late joiner gets the stored messages replayed
+	late, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var replayed []string
+	for len(replayed) < 3 {
+		_, data, err := late.ReadMessage()
+		if err != nil {
+			t.Fatalf("Replay incomplete after %v: %v", replayed, err)
+		}
+		var msg struct {
+			Message string `json:"message"`
+			History bool   `json:"history"`
+		}
+		json.Unmarshal(data, &msg)
+		if msg.History {
+			replayed = append(replayed, msg.Message)
+		}
+	}
+	if strings.Join(replayed, ",") != "note 1,note 2,note 3" {
+		t.Errorf("Unexpected replay order: %v", replayed)
+	}
+}
+
+func testNamedRooms(t *testing.T, client *http.Client) {
+	wsBase := "ws://" + clientHost + ":" + serverPort + "/room"
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsBase+query, nil)
+		if err != nil {
+			t.Fatalf("Dial %s failed: %v", query, err)
+		}
+		return conn
+	}
+	opsA, opsB, lobby := dial("?name=ops"), dial("?name=ops"), dial("")
+	defer opsA.Close()
+	defer opsB.Close()
+	defer lobby.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := client.Get(serverURL + "/room/rooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rooms []struct {
+		Name         string `json:"name"`
+		Participants int    `json:"participants"`
+		Protected    bool   `json:"protected"`
+	}
+	json.NewDecoder(resp.Body).Decode(&rooms)
+	resp.Body.Close()
+	counts := map[string]int{}
+	for _, r := range rooms {
+		counts[r.Name] = r.Participants
+	}
+	if len(rooms) == 0 || rooms[0].Name != "main" || counts["ops"] != 2 || counts["main"] != 1 {
+		t.Errorf("Unexpected room listing: %+v", rooms)
+	}
+
+	opsA.WriteMessage(websocket.TextMessage, []byte(`{"sender":"a","message":"ops only","type":"chat"}`))
+	if data, err := readFrame(opsB, "ops only"); err != nil {
+		t.Errorf("Room member did not receive the message: %v %s", err, data)
+	}
+	lobby.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		_, data, err := lobby.ReadMessage()
+		if err != nil {
+			break
+		}
+		if strings.Contains(string(data), "ops only") {
+			t.Error("Message leaked into the default room")
+		}
+	}
+
+	// Protected room
+	resp, err = client.Post(serverURL+"/room/rooms", "application/json", strings.NewReader(`{"name":"Medics","password":"pw"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Room creation failed with %d", resp.StatusCode)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsBase+"?name=medics", nil); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected protected room to reject a client without password")
+	}
+	if _, _, err := websocket.DefaultDialer.Dial(wsBase+"?name=medics&password=pw", nil); err == nil {
+		t.Error("Expected the room password in the URL to be ignored")
+	}
+	resp, err = client.Post(serverURL+"/room/unlock", "application/json", strings.NewReader(`{"name":"medics","password":"nope"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 unlocking with a wrong password, got %d", resp.StatusCode)
+	}
+	resp, err = client.Post(serverURL+"/room/unlock", "application/json", strings.NewReader(`{"name":"medics","password":"pw"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Room unlock failed with %d", resp.StatusCode)
+	}
+	medic, _, err := (&websocket.Dialer{Jar: client.Jar}).Dial(wsBase+"?name=medics", nil)
+	if err != nil {
+		t.Fatalf("Dial with the room cookie failed: %v", err)
+	}
+	medic.Close()
+
+	resp, err = http.Post(serverURL+"/room/rooms", "application/json", strings.NewReader(`{"name":"rogue"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 creating a room anonymously, got %d", resp.StatusCode)
+	}
+}
+
+func closeGracefully(conn *websocket.Conn) {
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	conn.Close()
+}
+
+func pcmFrame(value float32, samples int) []byte {
+	data := make([]byte, samples*4)
+	for i := 0; i < samples; i++ {
+		binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(value))
+	}
+	return data
+}
+
+func readFrame(conn *websocket.Conn, substr string) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil || strings.Contains(string(data), substr) {
+			return data, err
+		}
+	}
+}
+
+func testRoomPresence(t *testing.T, client *http.Client) {
+	wsURL := "ws://" + clientHost + ":" + serverPort + "/room?name=presence"
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if _, err := readFrame(alice, `"welcome"`); err != nil {
+		t.Fatalf("No welcome frame: %v", err)
+	}
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","name":"alice","muted":true}`))
+	if _, err := readFrame(alice, `"name":"alice","muted":true`); err != nil {
+		t.Fatalf("Roster did not include alice: %v", err)
+	}
+
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","name":"bob"}`))
+	if data, err := readFrame(alice, `"event":"join"`); err != nil || !strings.Contains(string(data), "bob") {
+		t.Errorf("Expected join event for bob: %v %s", err, data)
+	}
+
+	resp, err := client.Get(serverURL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status struct {
+		Participants int            `json:"room_participants"`
+		Rooms        map[string]int `json:"rooms"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Rooms["presence"] != 2 || status.Participants < 2 {
+		t.Errorf("Unexpected status counts: %+v", status)
+	}
+
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"nick","name":"robert"}`))
+	if _, err := readFrame(alice, `"previous":"bob"`); err != nil {
+		t.Errorf("Expected nick event: %v", err)
+	}
+
+	// Binary frames are still audio and flag the sender as speaking
+	bob.WriteMessage(websocket.BinaryMessage, pcmFrame(0.1, 480))
+	if data, err := readFrame(alice, `"name":"robert","muted":false,"speaking":true`); err != nil {
+		t.Errorf("Expected speaking indicator: %v %s", err, data)
+	}
+	alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		msgType, data, err := alice.ReadMessage()
+		if err != nil {
+			t.Fatalf("Audio frame not relayed: %v", err)
+		}
+		if msgType == websocket.BinaryMessage {
+			if len(data) != 960*4 {
+				t.Errorf("Unexpected audio frame size: %d", len(data))
+			}
+			break
+		}
+	}
+	if _, err := readFrame(alice, `"name":"robert","muted":false,"speaking":false`); err != nil {
+		t.Errorf("Speaking indicator did not clear: %v", err)
+	}
+
+	bob.Close()
+	if data, err := readFrame(alice, `"event":"leave"`); err != nil || !strings.Contains(string(data), "robert") {
+		t.Errorf("Expected leave event: %v %s", err, data)
+	}
+}
+
+func testAudioMixing(t *testing.T) {
+	wsURL := "ws://" + clientHost + ":" + serverPort + "/room?name=mixing"
+	var conns []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	a, b := conns[0], conns[1]
+	time.Sleep(100 * time.Millisecond)
+
+	// 200ms of constant audio from two speakers
+	a.WriteMessage(websocket.BinaryMessage, pcmFrame(0.25, 9600))
+	b.WriteMessage(websocket.BinaryMessage, pcmFrame(0.5, 9600))
+
+	levels := func(conn *websocket.Conn) map[float32]bool {
+		seen := map[float32]bool{}
+		conn.SetReadDeadline(time.Now().Add(600 * time.Millisecond))
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return seen
+			}
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+			if len(data) != 960*4 {
+				t.Errorf("Unexpected mixed frame size: %d", len(data))
+			}
+			seen[math.Float32frombits(binary.LittleEndian.Uint32(data))] = true
+		}
+	}
+	results := make([]map[float32]bool, 3)
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn *websocket.Conn) {
+			defer wg.Done()
+			results[i] = levels(conn)
+		}(i, conn)
+	}
+	wg.Wait()
+
+	if !results[2][0.75] {
+		t.Errorf("Listener did not receive the mix of both speakers: %v", results[2])
+	}
+	if !results[0][0.5] || results[0][0.25] || results[0][0.75] {
+		t.Errorf("Speaker A should only hear B: %v", results[0])
+	}
+	if !results[1][0.25] || results[1][0.5] || results[1][0.75] {
+		t.Errorf("Speaker B should only hear A: %v", results[1])
+	}
+}
+
+func testAudioCodecs(t *testing.T) {
+	wsURL := "ws://" + clientHost + ":" + serverPort + "/room?name=codecs"
+	compact, _, err := websocket.DefaultDialer.Dial(wsURL+"&codec=opus,adpcm", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compact.Close()
+	legacy, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+
+	for conn, codec := range map[*websocket.Conn]string{compact: "adpcm", legacy: "pcm"} {
+		if data, err := readFrame(conn, `"welcome"`); err != nil || !strings.Contains(string(data), `"codec":"`+codec+`"`) {
+			t.Errorf("Expected %s to be negotiated: %v %s", codec, err, data)
+		}
+	}
+
+	// 200ms of adpcm holding a constant level: predictor 8192, step index 0, zero deltas
+	frame := make([]byte, 4+1600)
+	binary.LittleEndian.PutUint16(frame, 8192)
+	compact.WriteMessage(websocket.BinaryMessage, frame)
+	legacy.WriteMessage(websocket.BinaryMessage, pcmFrame(0.5, 9600))
+
+	audio := func(conn *websocket.Conn) []byte {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("No audio received: %v", err)
+			}
+			if msgType == websocket.BinaryMessage {
+				return data
+			}
+		}
+	}
+
+	pcm := audio(legacy)
+	if len(pcm) != 960*4 {
+		t.Fatalf("Expected a pcm frame for the legacy client, got %d bytes", len(pcm))
+	}
+	if level := math.Float32frombits(binary.LittleEndian.Uint32(pcm)); math.Abs(float64(level)-0.25) > 0.01 {
+		t.Errorf("Transcoded level mismatch: %v", level)
+	}
+
+	adpcm := audio(compact)
+	if len(adpcm) != 4+160 {
+		t.Fatalf("Expected a compact adpcm frame, got %d bytes", len(adpcm))
+	}
+	if predictor := int16(binary.LittleEndian.Uint16(adpcm)); math.Abs(float64(predictor)/32767-0.5) > 0.01 {
+		t.Errorf("Encoded level mismatch: %v", predictor)
+	}
+}
+
+func testPushToTalk(t *testing.T, client *http.Client) {
+	resp, err := client.Post(serverURL+"/room/rooms", "application/json", strings.NewReader(`{"name":"radio","ptt":true,"talk_time":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Room setup failed with %d", resp.StatusCode)
+	}
+
+	type floorFrame struct {
+		Type   string  `json:"type"`
+		Mode   string  `json:"mode"`
+		Holder int64   `json:"holder"`
+		Queue  []int64 `json:"queue"`
+	}
+	wsURL := "ws://" + clientHost + ":" + serverPort + "/room?name=radio"
+	ids := map[*websocket.Conn]int64{}
+	var conns []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		data, err := readFrame(conn, `"welcome"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var welcome struct {
+			ID int64 `json:"id"`
+		}
+		json.Unmarshal(data, &welcome)
+		ids[conn] = welcome.ID
+		if data, err := readFrame(conn, `"type":"floor"`); err != nil || !strings.Contains(string(data), `"mode":"ptt"`) {
+			t.Fatalf("Expected ptt floor state on join: %v %s", err, data)
+		}
+		conns = append(conns, conn)
+	}
+	alice, bob, listener := conns[0], conns[1], conns[2]
+
+	nextFloor := func() floorFrame {
+		data, err := readFrame(listener, `"type":"floor"`)
+		if err != nil {
+			t.Fatalf("No floor update: %v", err)
+		}
+		var f floorFrame
+		json.Unmarshal(data, &f)
+		return f
+	}
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"talk"}`))
+	if f := nextFloor(); f.Holder != ids[alice] {
+		t.Errorf("Expected alice to hold the floor: %+v", f)
+	}
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"talk"}`))
+	if f := nextFloor(); f.Holder != ids[alice] || len(f.Queue) != 1 || f.Queue[0] != ids[bob] {
+		t.Errorf("Expected bob to be queued: %+v", f)
+	}
+
+	// Only the floor holder reaches the room
+	bob.WriteMessage(websocket.BinaryMessage, pcmFrame(0.5, 4800))
+	alice.WriteMessage(websocket.BinaryMessage, pcmFrame(0.25, 4800))
+	listener.SetReadDeadline(time.Now().Add(3 * time.Second))
+	heard := map[float32]bool{}
+	var expired floorFrame
+	for expired.Type == "" {
+		msgType, data, err := listener.ReadMessage()
+		if err != nil {
+			t.Fatalf("Floor never expired: %v", err)
+		}
+		if msgType == websocket.BinaryMessage {
+			heard[math.Float32frombits(binary.LittleEndian.Uint32(data))] = true
+		} else if strings.Contains(string(data), `"type":"floor"`) {
+			json.Unmarshal(data, &expired)
+		}
+	}
+	if !heard[0.25] || heard[0.5] || heard[0.75] {
+		t.Errorf("Expected only the floor holder to be heard: %v", heard)
+	}
+
+	// The floor passes to the queue when the talk time runs out
+	if expired.Holder != ids[bob] || len(expired.Queue) != 0 {
+		t.Errorf("Expected floor to pass to bob after the talk time: %+v", expired)
+	}
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"release"}`))
+	if f := nextFloor(); f.Holder != 0 {
+		t.Errorf("Expected a free floor after release: %+v", f)
+	}
+
+	// Back to an open room
+	resp, err = client.Post(serverURL+"/room/rooms", "application/json", strings.NewReader(`{"name":"radio"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if f := nextFloor(); f.Mode != "open" {
+		t.Errorf("Expected open mode after disabling ptt: %+v", f)
+	}
+}
+
+func testRoomRecording(t *testing.T, client *http.Client) {
+	wsURL := "ws://" + clientHost + ":" + serverPort + "/room?name=debrief"
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","name":"alice"}`))
+	if _, err := readFrame(alice, `"name":"alice"`); err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(c *http.Client, action string) (*http.Response, map[string]interface{}) {
+		resp, err := c.Post(serverURL+"/room/record", "application/json", strings.NewReader(`{"name":"debrief","action":"`+action+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body
+	}
+
+	if resp, _ := record(http.DefaultClient, "start"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for anonymous recording, got %d", resp.StatusCode)
+	}
+	resp, started := record(client, "start")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Recording start failed with %d: %v", resp.StatusCode, started)
+	}
+	if data, err := readFrame(alice, `"type":"recording"`); err != nil || !strings.Contains(string(data), `"active":true`) {
+		t.Errorf("Expected recording indicator: %v %s", err, data)
+	}
+
+	alice.WriteMessage(websocket.BinaryMessage, pcmFrame(0.5, 9600))
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","name":"bob"}`))
+	if _, err := readFrame(alice, `"event":"join"`); err != nil {
+		t.Fatal(err)
+	}
+	closeGracefully(bob)
+	if _, err := readFrame(alice, `"event":"leave"`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	resp, stopped := record(client, "stop")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Recording stop failed with %d: %v", resp.StatusCode, stopped)
+	}
+	if resp, _ := record(client, "stop"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 stopping an idle recorder, got %d", resp.StatusCode)
+	}
+
+	file, _ := stopped["file"].(string)
+	if !strings.HasPrefix(file, "recordings/debrief-") || !strings.HasSuffix(file, ".wav") {
+		t.Fatalf("Unexpected recording path %q", file)
+	}
+	wav, err := os.ReadFile(filepath.Join(testRootFiles, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wav) <= 44 || string(wav[:4]) != "RIFF" || string(wav[8:12]) != "WAVE" || binary.LittleEndian.Uint32(wav[24:]) != 16000 {
+		t.Fatalf("Invalid WAV header: %q", wav[:min(len(wav), 44)])
+	}
+	if int(binary.LittleEndian.Uint32(wav[40:])) != len(wav)-44 {
+		t.Errorf("WAV data size %d does not match file size %d", binary.LittleEndian.Uint32(wav[40:]), len(wav))
+	}
+	found := false
+	for i := 44; i+1 < len(wav); i += 2 {
+		if v := int16(binary.LittleEndian.Uint16(wav[i:])); v > 16000 && v < 16700 {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("Recorded audio does not contain the spoken level")
+	}
+
+	var meta struct {
+		Room         string   `json:"room"`
+		Duration     float64  `json:"duration"`
+		Participants []string `json:"participants"`
+		Events       []struct {
+			Event string `json:"event"`
+			Name  string `json:"name"`
+		} `json:"events"`
+	}
+	data, err := os.ReadFile(filepath.Join(testRootFiles, strings.TrimSuffix(file, ".wav")+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(data, &meta)
+	if meta.Room != "debrief" || meta.Duration <= 0 || strings.Join(meta.Participants, ",") != "alice,bob" {
+		t.Errorf("Unexpected recording metadata: %s", data)
+	}
+	if len(meta.Events) != 2 || meta.Events[0].Event != "join" || meta.Events[1].Event != "leave" || meta.Events[1].Name != "bob" {
+		t.Errorf("Unexpected recording events: %s", data)
+	}
+
+	// Recordings started within the same second keep separate files
+	var files []string
+	for i := 0; i < 2; i++ {
+		if resp, body := record(client, "start"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Recording restart failed with %d: %v", resp.StatusCode, body)
+		}
+		resp, body := record(client, "stop")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Recording stop failed with %d: %v", resp.StatusCode, body)
+		}
+		name, _ := body["file"].(string)
+		if _, err := os.Stat(filepath.Join(testRootFiles, name)); err != nil {
+			t.Errorf("Recording %q missing: %v", name, err)
+		}
+		files = append(files, name)
+	}
+	if files[0] == files[1] || files[0] == file {
+		t.Errorf("Recordings share a file: %v after %s", files, file)
+	}
+}
+
+func testWebRTCSignaling(t *testing.T) {
+	base := "ws://" + clientHost + ":" + serverPort + "/room?name="
+	dial := func(room string) (*websocket.Conn, int64) {
+		conn, _, err := websocket.DefaultDialer.Dial(base+room, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := readFrame(conn, `"welcome"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var welcome struct {
+			ID int64 `json:"id"`
+		}
+		json.Unmarshal(data, &welcome)
+		return conn, welcome.ID
+	}
+	caller, callerID := dial("signals")
+	defer caller.Close()
+	callee, calleeID := dial("signals")
+	defer callee.Close()
+	outsider, outsiderID := dial("elsewhere")
+	defer outsider.Close()
+
+	type signal struct {
+		From int64           `json:"from"`
+		To   int64           `json:"to"`
+		Kind string          `json:"kind"`
+		Data json.RawMessage `json:"data"`
+	}
+	next := func(conn *websocket.Conn) signal {
+		data, err := readFrame(conn, `"type":"signal"`)
+		if err != nil {
+			t.Fatalf("No signal received: %v", err)
+		}
+		var s signal
+		json.Unmarshal(data, &s)
+		return s
+	}
+
+	caller.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"type":"signal","to":%d,"kind":"offer","data":{"type":"offer","sdp":"v=0"}}`, calleeID)))
+	if s := next(callee); s.From != callerID || s.Kind != "offer" || !strings.Contains(string(s.Data), `"sdp":"v=0"`) {
+		t.Errorf("Unexpected offer relay: %+v", s)
+	}
+	callee.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"type":"signal","to":%d,"kind":"answer","data":{"type":"answer","sdp":"v=0"}}`, callerID)))
+	if s := next(caller); s.From != calleeID || s.Kind != "answer" {
+		t.Errorf("Unexpected answer relay: %+v", s)
+	}
+
+	// Peers in other rooms cannot be reached
+	caller.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"type":"signal","to":%d,"kind":"offer","data":{}}`, outsiderID)))
+	if s := next(caller); s.Kind != "unavailable" || s.From != outsiderID {
+		t.Errorf("Expected unavailable for a peer in another room: %+v", s)
+	}
+}
+
+func testDirectMessages(t *testing.T) {
+	base := "ws://" + clientHost + ":" + serverPort + "/room?name="
+	dial := func(dialer *websocket.Dialer, room, name string) (*websocket.Conn, int64) {
+		conn, _, err := dialer.Dial(base+room, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := readFrame(conn, `"welcome"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var welcome struct {
+			ID int64 `json:"id"`
+		}
+		json.Unmarshal(data, &welcome)
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","name":"`+name+`"}`))
+		if _, err := readFrame(conn, `"name":"`+name+`"`); err != nil {
+			t.Fatal(err)
+		}
+		return conn, welcome.ID
+	}
+	join := func(room, name string) (*websocket.Conn, int64) {
+		return dial(websocket.DefaultDialer, room, name)
+	}
+	type dm struct {
+		From      string `json:"from"`
+		To        string `json:"to"`
+		Message   string `json:"message"`
+		Delivered bool   `json:"delivered"`
+		Offline   bool   `json:"offline"`
+		Echo      bool   `json:"echo"`
+		Error     string `json:"error"`
+	}
+	next := func(conn *websocket.Conn) dm {
+		data, err := readFrame(conn, `"type":"dm"`)
+		if err != nil {
+			t.Fatalf("No direct message received: %v", err)
+		}
+		var m dm
+		json.Unmarshal(data, &m)
+		return m
+	}
+
+	alice, aliceID := join("dm-one", "alice")
+	defer alice.Close()
+	bob, _ := join("dm-two", "bob")
+	defer bob.Close()
+
+	// By nickname, across rooms
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"dm","recipient":"Bob","message":"psst"}`))
+	if m := next(bob); m.From != "alice" || m.Message != "psst" || m.Echo {
+		t.Errorf("Unexpected direct message: %+v", m)
+	}
+	if m := next(alice); !m.Echo || !m.Delivered || m.To != "bob" {
+		t.Errorf("Unexpected echo: %+v", m)
+	}
+
+	// By participant id
+	bob.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"type":"dm","to":%d,"message":"got it"}`, aliceID)))
+	if m := next(alice); m.From != "bob" || m.Message != "got it" {
+		t.Errorf("Unexpected reply: %+v", m)
+	}
+	next(bob)
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"dm","to":999999,"message":"anyone?"}`))
+	if m := next(bob); m.Error == "" {
+		t.Errorf("Expected an error for an unknown participant: %+v", m)
+	}
+
+	// Offline delivery on reconnect from the same browser, exactly once
+	jar, _ := cookiejar.New(nil)
+	carolDialer := &websocket.Dialer{Jar: jar}
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"dm","recipient":"carol","message":"call me"}`))
+	if m := next(alice); !m.Echo || m.Delivered {
+		t.Errorf("Expected an undelivered echo: %+v", m)
+	}
+	time.Sleep(200 * time.Millisecond)
+	carol, _ := dial(carolDialer, "dm-one", "carol")
+	if m := next(carol); m.From != "alice" || m.Message != "call me" || !m.Offline {
+		t.Errorf("Expected offline delivery: %+v", m)
+	}
+	closeGracefully(carol)
+	time.Sleep(200 * time.Millisecond)
+
+	// Taking the nickname from another browser does not reveal what was sent before
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"dm","recipient":"carol","message":"second"}`))
+	next(alice)
+	time.Sleep(200 * time.Millisecond)
+	impostor, _ := join("dm-one", "carol")
+	if data, err := readFrame(impostor, `"type":"dm"`); err == nil {
+		t.Errorf("Offline message delivered to another browser: %s", data)
+	}
+	closeGracefully(impostor)
+	time.Sleep(200 * time.Millisecond)
+
+	// Nor does it receive what is sent to the nickname afterwards
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"dm","recipient":"carol","message":"third"}`))
+	next(alice)
+	time.Sleep(200 * time.Millisecond)
+
+	carol, _ = dial(carolDialer, "dm-one", "carol")
+	defer carol.Close()
+	if m := next(carol); m.Message != "second" || !m.Offline {
+		t.Errorf("Expected the second offline message: %+v", m)
+	}
+	if m := next(carol); m.Message != "third" || !m.Offline {
+		t.Errorf("Expected the third offline message: %+v", m)
+	}
+	if data, err := readFrame(carol, `"type":"dm"`); err == nil {
+		t.Errorf("Offline message delivered twice: %s", data)
+	}
+}
+
+func testRoomGuard(t *testing.T, client *http.Client) {
+	wsURL := "ws://" + clientHost + ":" + serverPort + "/room?name=guarded"
+
+	// Cross-site pages cannot open the room
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://evil.example"}}); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected a foreign origin to be rejected")
+	}
+	same, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {serverURL}})
+	if err != nil {
+		t.Fatalf("Same origin rejected: %v", err)
+	}
+	defer same.Close()
+
+	closedByServer := func(conn *websocket.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				var netErr net.Error
+				return !(errors.As(err, &netErr) && netErr.Timeout())
+			}
+		}
+	}
+
+	// Flooding control frames gets the client disconnected
+	flooder, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if flooder.WriteMessage(websocket.TextMessage, []byte(`{"type":"mute","muted":true}`)) != nil {
+			break
+		}
+	}
+	if !closedByServer(flooder) {
+		t.Error("Expected the flooding client to be disconnected")
+	}
+	flooder.Close()
+
+	// Oversized frames are refused
+	big, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big.WriteMessage(websocket.BinaryMessage, make([]byte, 128<<10))
+	if !closedByServer(big) {
+		t.Error("Expected an oversized frame to close the connection")
+	}
+	big.Close()
+
+	// Kick and ban
+	target, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	target.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","name":"troll"}`))
+	if _, err := readFrame(target, `"name":"troll"`); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(serverURL+"/room/kick", "application/json", strings.NewReader(`{"name":"troll"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 kicking anonymously, got %d", resp.StatusCode)
+	}
+	resp, err = client.Post(serverURL+"/room/kick", "application/json", strings.NewReader(`{"name":"troll","ban":60}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Kick failed with %d", resp.StatusCode)
+	}
+	if _, err := readFrame(target, `"type":"kicked"`); err != nil {
+		t.Errorf("Kicked client was not notified: %v", err)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected a banned address to be refused")
+	}
+	req, _ := http.NewRequest("DELETE", serverURL+"/room/bans?ip="+clientHost, nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Unbanned address still refused: %v", err)
+	}
+	back.Close()
+
+	resp, err = client.Get(serverURL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status struct {
+		Metrics map[string]int64 `json:"room_metrics"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Metrics["rate_limited"] < 200 || status.Metrics["rejected_origins"] < 1 || status.Metrics["kicked"] < 1 || status.Metrics["rejected_banned"] < 1 {
+		t.Errorf("Unexpected room metrics: %v", status.Metrics)
+	}
+
+	// A second node started with --room-auth requires a login for the room
+	authRoot := testRootFiles + "_auth"
+	defer os.RemoveAll(authRoot)
+	authPort := "45679"
+	cmd := exec.Command("./"+buildName, "--web-port", authPort, "--web-host", clientHost, "--root", authRoot, "--password", testPassword, "--room-auth")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	authURL := "http://" + clientHost + ":" + authPort
+	var ready bool
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if resp, err := http.Get(authURL + "/status"); err == nil {
+			resp.Body.Close()
+			ready = true
+			break
+		}
+	}
+	if !ready {
+		t.Fatal("Room auth node did not start")
+	}
+	authWS := "ws://" + clientHost + ":" + authPort + "/room"
+	if _, resp, err := websocket.DefaultDialer.Dial(authWS, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected the room to require a login")
+	}
+	jar, _ := cookiejar.New(nil)
+	authClient := &http.Client{Jar: jar}
+	resp, err = authClient.PostForm(authURL+"/login", url.Values{"password": {testPassword}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	u, _ := url.Parse(authURL)
+	header := http.Header{}
+	for _, c := range jar.Cookies(u) {
+		header.Add("Cookie", c.Name+"="+c.Value)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(authWS, header)
+	if err != nil {
+		t.Fatalf("Logged in client refused: %v", err)
+	}
+	if data, err := readFrame(conn, `"welcome"`); err != nil || !strings.Contains(string(data), `"admin":true`) {
+		t.Errorf("Expected an admin welcome: %v %s", err, data)
+	}
+	conn.Close()
+}
+
+func testPeerTransfer(t *testing.T, client *http.Client) {
+	shared := filepath.Join(testRootFiles, "peerdata")
+	os.MkdirAll(filepath.Join(shared, "sub"), 0755)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	os.WriteFile(filepath.Join(shared, "big.bin"), big, 0644)
+	os.WriteFile(filepath.Join(shared, "sub", "note.txt"), []byte("hello peer"), 0644)
+	os.WriteFile(filepath.Join(shared, "sub", "todo.txt"), []byte("buy rice"), 0644)
+
+	var listing struct {
+		Path    string `json:"path"`
+		Entries []struct {
+			Path  string `json:"path"`
+			IsDir bool   `json:"is_dir"`
+			Size  int64  `json:"size"`
+		} `json:"entries"`
+	}
+	resp, err := http.Get(serverURL + "/peer/api/files?path=peerdata&recursive=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&listing)
+	resp.Body.Close()
+	if len(listing.Entries) != 3 {
+		t.Fatalf("Expected 3 shared files, got %+v", listing)
+	}
+	resp, _ = http.Get(serverURL + "/peer/api/files?path=sys")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the sys directory to be hidden, got %d", resp.StatusCode)
+	}
+	resp, _ = http.Get(serverURL + "/peer/browse?peer=192.0.2.1")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected browsing an unknown peer to be refused, got %d", resp.StatusCode)
+	}
+	resp, _ = http.Post(serverURL+"/peer/transfers", "application/json", strings.NewReader(`{"action":"pull","peer":"192.0.2.1","path":"x"}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous transfers to be refused, got %d", resp.StatusCode)
+	}
+
+	// A second node accepts a signed offer from a trusted key and pulls the
+	// folder, resuming the half-downloaded file it already has, starting over
+	// a partial file of another version and keeping its own copy of a file.
+	peerRoot := testRootFiles + "_peer"
+	defer os.RemoveAll(peerRoot)
+	incoming := filepath.Join(peerRoot, "incoming", "peerdata")
+	os.MkdirAll(filepath.Join(incoming, "sub"), 0755)
+	os.WriteFile(filepath.Join(incoming, "big.bin.part"), big[:len(big)/2], 0644)
+	if info, err := os.Stat(filepath.Join(shared, "big.bin")); err == nil {
+		os.Chtimes(filepath.Join(incoming, "big.bin.part"), info.ModTime(), info.ModTime())
+	}
+	os.WriteFile(filepath.Join(incoming, "sub", "note.txt.part"), []byte("stale"), 0644)
+	os.Chtimes(filepath.Join(incoming, "sub", "note.txt.part"), time.Unix(1e9, 0), time.Unix(1e9, 0))
+	os.WriteFile(filepath.Join(incoming, "sub", "todo.txt"), []byte("buy soap"), 0644)
+	peerPort := "45680"
+	cmd := exec.Command("./"+buildName, "--web-port", peerPort, "--web-host", clientHost, "--root", peerRoot)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	peerURL := "http://" + clientHost + ":" + peerPort
+	var ready bool
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if resp, err := http.Get(peerURL + "/status"); err == nil {
+			resp.Body.Close()
+			ready = true
+			break
+		}
+	}
+	if !ready {
+		t.Fatal("Peer node did not start")
+	}
+
+	seed, err := os.ReadFile(filepath.Join(testRootFiles, "sys", "node.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := hex.DecodeString(strings.TrimSpace(string(seed)))
+	key := ed25519.NewKeyFromSeed(raw)
+	pub := hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	node, _ := os.ReadFile(filepath.Join(testRootFiles, "sys", "node.id"))
+	target, _ := os.ReadFile(filepath.Join(peerRoot, "sys", "node.id"))
+	offer := func(sign bool, nonce string) *http.Response {
+		now := time.Now().Unix()
+		payload := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%d\n%s\n%s\n%s", bytes.TrimSpace(node), pub, serverPort, "peerdata", "incoming", now, bytes.TrimSpace(target), clientHost, nonce)
+		sig := hex.EncodeToString(ed25519.Sign(key, []byte(payload)))
+		if !sign {
+			sig = strings.Repeat("00", ed25519.SignatureSize)
+		}
+		body := fmt.Sprintf(`{"node":%q,"name":"test","public_key":%q,"port":%s,"path":"peerdata","dest":"incoming","time":%d,"target":%q,"source":%q,"nonce":%q,"signature":%q}`,
+			bytes.TrimSpace(node), pub, serverPort, now, bytes.TrimSpace(target), clientHost, nonce, sig)
+		resp, err := http.Post(peerURL+"/peer/api/offer", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp = offer(false, "00112233445566778899aabbccddeeff")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected an unsigned offer to be refused, got %d", resp.StatusCode)
+	}
+	resp = offer(true, "00112233445566778899aabbccddeeff")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected an offer from an untrusted key to be refused, got %d", resp.StatusCode)
+	}
+	os.WriteFile(filepath.Join(peerRoot, "sys", "trusted_keys"), []byte(pub+"\n"), 0644)
+	resp = offer(true, "0123456789abcdef0123456789abcdef")
+	var job struct {
+		ID        string `json:"id"`
+		State     string `json:"state"`
+		Files     int    `json:"files"`
+		FilesDone int    `json:"files_done"`
+		Bytes     int64  `json:"bytes"`
+		Total     int64  `json:"total"`
+		Conflicts int    `json:"conflicts"`
+		Error     string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || job.ID == "" {
+		t.Fatalf("Offer refused: %d %+v", resp.StatusCode, job)
+	}
+	resp = offer(true, "0123456789abcdef0123456789abcdef")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a replayed offer to be refused, got %d", resp.StatusCode)
+	}
+	for deadline := time.Now().Add(10 * time.Second); job.State == "running" && time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		resp, err := http.Get(peerURL + "/peer/api/transfer?id=" + job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+	}
+	if job.State != "done" || job.FilesDone != 3 || job.Bytes != job.Total || job.Conflicts != 1 {
+		t.Fatalf("Transfer did not complete: %+v", job)
+	}
+	got, err := os.ReadFile(filepath.Join(incoming, "big.bin"))
+	if err != nil || !bytes.Equal(got, big) {
+		t.Errorf("Resumed file differs from the original (%d bytes, %v)", len(got), err)
+	}
+	if _, err := os.Stat(filepath.Join(incoming, "big.bin.part")); !os.IsNotExist(err) {
+		t.Error("Expected the partial file to be renamed")
+	}
+	if note, _ := os.ReadFile(filepath.Join(incoming, "sub", "note.txt")); string(note) != "hello peer" {
+		t.Errorf("Unexpected nested file: %q", note)
+	}
+	if todo, _ := os.ReadFile(filepath.Join(incoming, "sub", "todo.txt")); string(todo) != "buy soap" {
+		t.Errorf("Local file overwritten: %q", todo)
+	}
+	if copies, _ := filepath.Glob(filepath.Join(incoming, "sub", "todo.*.txt")); len(copies) != 1 {
+		t.Errorf("Expected one conflict copy, got %v", copies)
+	} else if todo, _ := os.ReadFile(copies[0]); string(todo) != "buy rice" {
+		t.Errorf("Unexpected conflict copy: %q", todo)
+	}
+}
+
+func testFolderSync(t *testing.T) {
+	syncRoot := testRootFiles + "_sync"
+	defer os.RemoveAll(syncRoot)
+	os.MkdirAll(filepath.Join(syncRoot, "shared", "docs"), 0755)
+	os.WriteFile(filepath.Join(syncRoot, "shared", "docs", "plan.txt"), []byte("meet at noon"), 0644)
+	os.MkdirAll(filepath.Join(syncRoot, "archive"), 0755)
+	os.WriteFile(filepath.Join(syncRoot, "archive", "extra.txt"), []byte("only here"), 0644)
+	syncPort := "45681"
+	cmd := exec.Command("./"+buildName, "--web-port", syncPort, "--web-host", clientHost, "--root", syncRoot,
+		"--sync", "shared", "--sync", "archive:mirror", "--sync", "sys:two-way", "--mdns-name", "off",
+		"--discovery", "on", "--discovery-port", "45694", "--discovery-peer", clientHost+":45695", "--discovery-peer", clientHost+":45696", "--discovery-peer", clientHost+":45697")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	syncURL := "http://" + clientHost + ":" + syncPort
+	var ready bool
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if resp, err := http.Get(syncURL + "/status"); err == nil {
+			resp.Body.Close()
+			ready = true
+			break
+		}
+	}
+	if !ready {
+		t.Fatal("Sync node did not start")
+	}
+
+	resp, err := http.Get(syncURL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status struct {
+		Sync map[string]string `json:"sync_folders"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if len(status.Sync) != 2 || status.Sync["shared"] != "two-way" || status.Sync["archive"] != "mirror" {
+		t.Errorf("Unexpected sync folders: %v", status.Sync)
+	}
+	if _, err := os.Stat(filepath.Join(syncRoot, "archive")); err != nil {
+		t.Error("Expected the mirror folder to be created")
+	}
+
+	resp, err = http.Get(syncURL + "/sync/api/manifest?folder=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest struct {
+		Node    string `json:"node"`
+		Entries []struct {
+			Path   string `json:"path"`
+			Size   int64  `json:"size"`
+			SHA256 string `json:"sha256"`
+		} `json:"entries"`
+	}
+	json.NewDecoder(resp.Body).Decode(&manifest)
+	resp.Body.Close()
+	if manifest.Node == "" || len(manifest.Entries) != 1 {
+		t.Fatalf("Unexpected manifest: %+v", manifest)
+	}
+	if e := manifest.Entries[0]; e.Path != "shared/docs/plan.txt" || e.Size != 12 || e.SHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte("meet at noon"))) {
+		t.Errorf("Unexpected manifest entry: %+v", e)
+	}
+	for _, folder := range []string{"archive", "other", "sys"} {
+		resp, _ := http.Get(syncURL + "/sync/api/manifest?folder=" + folder)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected %s not to be shared, got %d", folder, resp.StatusCode)
+		}
+	}
+	resp, _ = http.Post(syncURL+"/sync/run", "application/json", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected a manual sync pass to start, got %d", resp.StatusCode)
+	}
+
+	// The mirror follows only one of two trusted sources, ignores an
+	// untrusted node with a lower id and drops its own extras
+	sources := map[string]string{}
+	var trusted []string
+	for i, port := range []string{"45685", "45686", "45687"} {
+		root := fmt.Sprintf("%s_src%d", testRootFiles, i)
+		defer os.RemoveAll(root)
+		os.MkdirAll(filepath.Join(root, "archive"), 0755)
+		os.MkdirAll(filepath.Join(root, "sys"), 0755)
+		os.WriteFile(filepath.Join(root, "archive", "report.txt"), []byte(fmt.Sprintf("source %d", i)), 0644)
+		pub, key, _ := ed25519.GenerateKey(nil)
+		os.WriteFile(filepath.Join(root, "sys", "node.key"), []byte(hex.EncodeToString(key.Seed())), 0644)
+		if i == 2 {
+			os.WriteFile(filepath.Join(root, "sys", "node.id"), []byte("0000000000000000"), 0644)
+		} else {
+			trusted = append(trusted, hex.EncodeToString(pub))
+		}
+		src := exec.Command("./"+buildName, "--web-port", port, "--web-host", clientHost, "--root", root,
+			"--sync", "archive:send", "--mdns-name", "off",
+			"--discovery", "on", "--discovery-port", fmt.Sprint(45695+i), "--discovery-peer", clientHost+":45694")
+		if err := src.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer src.Process.Kill()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			var node struct {
+				Node string `json:"node"`
+			}
+			if resp, err := http.Get("http://" + clientHost + ":" + port + "/status"); err == nil {
+				json.NewDecoder(resp.Body).Decode(&node)
+				resp.Body.Close()
+				if i < 2 {
+					sources[node.Node] = fmt.Sprintf("source %d", i)
+				}
+				break
+			}
+		}
+	}
+	if len(sources) != 2 {
+		t.Fatalf("Source nodes did not start: %v", sources)
+	}
+	os.WriteFile(filepath.Join(syncRoot, "sys", "trusted_keys"), []byte(strings.Join(trusted, "\n")+"\n"), 0644)
+	want := sources[slices.Min(slices.Collect(maps.Keys(sources)))]
+	report := filepath.Join(syncRoot, "archive", "report.txt")
+	extra := filepath.Join(syncRoot, "archive", "extra.txt")
+	mirrored := func() bool {
+		got, _ := os.ReadFile(report)
+		_, err := os.Stat(extra)
+		return string(got) == want && os.IsNotExist(err)
+	}
+	for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline) && !mirrored(); time.Sleep(500 * time.Millisecond) {
+		resp, err := http.Post(syncURL+"/sync/run", "application/json", nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	if !mirrored() {
+		got, _ := os.ReadFile(report)
+		t.Fatalf("Mirror did not follow %q: report %q", want, got)
+	}
+	for i := 0; i < 3; i++ {
+		resp, _ := http.Post(syncURL+"/sync/run", "application/json", nil)
+		resp.Body.Close()
+		time.Sleep(500 * time.Millisecond)
+	}
+	if !mirrored() {
+		got, _ := os.ReadFile(report)
+		t.Errorf("Mirror switched sources: report %q", got)
+	}
+}
+
+func testSignedDiscovery(t *testing.T) {
+	exchange := func(port, msg string) (string, error) {
+		conn, err := net.Dial("udp", clientHost+":"+port)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return "", err
+		}
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		return string(buf[:n]), err
+	}
+
+	// A well signed announcement that answers none of our requests is dropped
+	pub, key, _ := ed25519.GenerateKey(nil)
+	body := strings.Join([]string{"TAZ_IDENT", "impostor", "1.0", "0011223344556677", hex.EncodeToString(pub), "notournonce", "e30", ""}, "|")
+	forged := body + "|" + hex.EncodeToString(ed25519.Sign(key, []byte(body)))
+	conn, err := net.Dial("udp", clientHost+":"+discoveryPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(forged))
+	conn.Write([]byte("TAZ_IDENT|legacy|1.0"))
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	resp, err := http.Get(serverURL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status struct {
+		Discovery []struct {
+			Name string `json:"name"`
+		} `json:"discovery"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	for _, p := range status.Discovery {
+		if p.Name == "impostor" || p.Name == "legacy" {
+			t.Errorf("Unauthenticated announcement was accepted: %+v", status.Discovery)
+		}
+	}
+
+	// A node with a mesh key only answers requests carrying its MAC
+	meshRoot := testRootFiles + "_mesh"
+	defer os.RemoveAll(meshRoot)
+	meshPort, meshDiscovery := "45682", "45691"
+	cmd := exec.Command("./"+buildName, "--web-port", meshPort, "--web-host", bindHost4, "--root", meshRoot, "--mesh-key", "s3cret", "--discovery-port", meshDiscovery)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	var ready bool
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if resp, err := http.Get("http://" + clientHost + ":" + meshPort + "/status"); err == nil {
+			resp.Body.Close()
+			ready = true
+			break
+		}
+	}
+	if !ready {
+		t.Fatal("Mesh node did not start")
+	}
+	// 0.0.0.0 stays on IPv4
+	if conn, err := net.Dial("tcp6", "[::1]:"+meshPort); err == nil {
+		conn.Close()
+		t.Error("Node on 0.0.0.0 also listens on IPv6")
+	}
+	if reply, err := exchange(meshDiscovery, "TAZ_DISCOVER|meshnonce"); err == nil {
+		t.Errorf("Mesh node answered a request without the mesh key: %s", reply)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("TAZ_DISCOVER|meshnonce"))
+	reply, err := exchange(meshDiscovery, "TAZ_DISCOVER|meshnonce|"+hex.EncodeToString(mac.Sum(nil)))
+	if err != nil {
+		t.Fatalf("Mesh node did not answer a keyed request: %v", err)
+	}
+	if !verifyIdent(reply, "meshnonce") || strings.Split(reply, "|")[7] == "" {
+		t.Errorf("Unexpected mesh announcement: %s", reply)
+	}
+}
+
+func testDiscoveryAnnouncements(t *testing.T) {
+	conn, err := net.Dial("udp", clientHost+":"+discoveryPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("TAZ_DISCOVER|announce"))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := string(buf[:n])
+	if !verifyIdent(reply, "announce") {
+		t.Fatalf("Invalid announcement: %s", reply)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.Split(reply, "|")[6])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		Version  int      `json:"v"`
+		Port     int      `json:"port"`
+		TLS      string   `json:"tls"`
+		Features []string `json:"features"`
+		Free     uint64   `json:"free"`
+		Users    *int     `json:"users"`
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 1 || fmt.Sprint(info.Port) != serverPort || len(info.TLS) != 64 || info.Free == 0 || info.Users == nil {
+		t.Errorf("Unexpected announcement: %s", data)
+	}
+	features := strings.Join(info.Features, ",")
+	for _, f := range []string{"files", "room", "bbs"} {
+		if !strings.Contains(features, f) {
+			t.Errorf("Expected feature %s in %v", f, info.Features)
+		}
+	}
+
+	resp, err := http.Get(serverURL + "/static/peers.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Peers page returned %d", resp.StatusCode)
+	}
+}
+
+type mdnsRecord struct {
+	name  string
+	rtype uint16
+	data  []byte
+	msg   []byte
+	off   int
+}
+
+func mdnsName(msg []byte, off int) (string, int) {
+	var labels []string
+	end := -1
+	for jumps := 0; off < len(msg) && jumps < 32; jumps++ {
+		n := int(msg[off])
+		if n == 0 {
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end
+		}
+		if n&0xc0 == 0xc0 {
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			continue
+		}
+		if off+1+n > len(msg) {
+			break
+		}
+		labels = append(labels, string(msg[off+1:off+1+n]))
+		off += 1 + n
+	}
+	return "", len(msg)
+}
+
+// mdnsQuery sends a legacy unicast question to the mDNS group and returns the
+// records of every answer that arrives within the timeout.
+func mdnsQuery(t *testing.T, name string, qtype uint16) []mdnsRecord {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	q := []byte{0x12, 0x34, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	q = binary.BigEndian.AppendUint16(q, 1)
+
+	dest := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	if _, err := conn.WriteToUDP(q, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []mdnsRecord
+	buf := make([]byte, 9000)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return records
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		if n < 12 || binary.BigEndian.Uint16(msg) != 0x1234 || msg[2]&0x80 == 0 {
+			continue
+		}
+		off := 12
+		for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+			_, off = mdnsName(msg, off)
+			off += 4
+		}
+		count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+		for i := 0; i < count && off+10 <= n; i++ {
+			r := mdnsRecord{msg: msg}
+			r.name, off = mdnsName(msg, off)
+			if off+10 > n {
+				break
+			}
+			r.rtype = binary.BigEndian.Uint16(msg[off:])
+			size := int(binary.BigEndian.Uint16(msg[off+8:]))
+			r.off = off + 10
+			if r.off+size > n {
+				break
+			}
+			r.data = msg[r.off : r.off+size]
+			records = append(records, r)
+			off = r.off + size
+		}
+	}
+}
+
+func testMDNS(t *testing.T) {
+	resp, err := http.Get(serverURL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status struct {
+		Node string `json:"node"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+
+	// Other nodes started by earlier tests may answer too; pick ours by TXT.
+	instance := ""
+	records := mdnsQuery(t, "_taz._tcp.local", 12)
+	for _, r := range records {
+		if r.rtype == 16 && bytes.Contains(r.data, []byte("node="+status.Node)) {
+			instance = r.name
+		}
+	}
+	if instance == "" {
+		t.Fatalf("No _taz._tcp.local answer for node %s (%d records)", status.Node, len(records))
+	}
+
+	host := ""
+	for _, r := range records {
+		if r.name == instance && r.rtype == 33 && len(r.data) > 6 {
+			if port := binary.BigEndian.Uint16(r.data[4:]); fmt.Sprint(port) != serverPort {
+				t.Errorf("SRV port %d, expected %s", port, serverPort)
+			}
+			host, _ = mdnsName(r.msg, r.off+6)
+		}
+	}
+	if !strings.HasSuffix(host, ".local") {
+		t.Fatalf("Missing SRV target for %s", instance)
+	}
+
+	found := false
+	for _, r := range mdnsQuery(t, host, 1) {
+		if r.name == host && r.rtype == 1 && len(r.data) == 4 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("No A record for %s", host)
+	}
+
+	services := mdnsQuery(t, "_services._dns-sd._udp.local", 12)
+	enumerated := false
+	for _, r := range services {
+		if name, _ := mdnsName(r.msg, r.off); r.rtype == 12 && name == "_http._tcp.local" {
+			enumerated = true
+		}
+	}
+	if !enumerated {
+		t.Errorf("_http._tcp.local missing from service enumeration")
+	}
+}
+
+func testMeshRelay(t *testing.T, client *http.Client) {
+	get := func(u, hops string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", u, nil)
+		if hops != "" {
+			req.Header.Set("X-Taz-Hops", hops)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, body
+	}
+
+	var status struct {
+		Node   string            `json:"node"`
+		Routes []json.RawMessage `json:"routes"`
+	}
+	_, body := get(serverURL+"/status", "")
+	if err := json.Unmarshal(body, &status); err != nil || status.Routes == nil {
+		t.Fatalf("Expected routes in status: %v %s", err, body)
+	}
+
+	var table struct {
+		Node   string            `json:"node"`
+		Routes []json.RawMessage `json:"routes"`
+	}
+	resp, body := get(serverURL+"/mesh/api/routes", "")
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &table) != nil || table.Node != status.Node || table.Routes == nil {
+		t.Errorf("Unexpected route table: %d %s", resp.StatusCode, body)
+	}
+
+	var relayed struct {
+		Node string `json:"node"`
+	}
+	resp, body = get(serverURL+"/mesh/relay/"+status.Node+"/status", "")
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &relayed) != nil || relayed.Node != status.Node {
+		t.Errorf("Relay to self failed: %d %s", resp.StatusCode, body)
+	}
+
+	// The admin session of the client must not authenticate a relayed request
+	for u, want := range map[string]int{
+		serverURL + "/peer/transfers":                                 http.StatusOK,
+		serverURL + "/mesh/relay/" + status.Node + "/peer/transfers":  http.StatusUnauthorized,
+		serverURL + "/mesh/relay/" + status.Node + "/room/bans":       http.StatusUnauthorized,
+		serverURL + "/mesh/relay/" + status.Node + "/room?name=lobby": http.StatusForbidden,
+	} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: expected %d, got %d", u, want, resp.StatusCode)
+		}
+	}
+
+	if resp, _ = get(serverURL+"/mesh/relay/nowhere/status", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown node, got %d", resp.StatusCode)
+	}
+	if resp, _ = get(serverURL+"/mesh/relay/nowhere/status", "0"); resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("Expected 508 when out of hops, got %d", resp.StatusCode)
+	}
+	if resp, _ = get(serverURL+"/mesh/relay/"+status.Node+"/mesh/relay/nowhere/status", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected nested relay to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func testMeshDiscovery(t *testing.T) {
+	type node struct {
+		Node      string `json:"node"`
+		Discovery []struct {
+			Node string `json:"node"`
+			Port int    `json:"port"`
+		} `json:"discovery"`
+		Routes []struct {
+			Node string `json:"node"`
+			Hops int    `json:"hops"`
+			Via  string `json:"via"`
+		} `json:"routes"`
+	}
+	status := func(base string) (node, error) {
+		var n node
+		resp, err := http.Get(base + "/status")
+		if err != nil {
+			return n, err
+		}
+		defer resp.Body.Close()
+		return n, json.NewDecoder(resp.Body).Decode(&n)
+	}
+	start := func(name, webPort, discovery, peer string) string {
+		root := testRootFiles + "_" + name
+		t.Cleanup(func() { os.RemoveAll(root) })
+		cmd := exec.Command("./"+buildName, "--web-port", webPort, "--web-host", clientHost, "--root", root,
+			"--discovery", "on", "--discovery-port", discovery, "--discovery-peer", clientHost+":"+peer, "--mdns-name", "off")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cmd.Process.Kill() })
+		base := "http://" + clientHost + ":" + webPort
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			if _, err := status(base); err == nil {
+				return base
+			}
+		}
+		t.Fatalf("Node %s did not start", name)
+		return ""
+	}
+
+	self, err := status(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b only knows the main node, c only knows b
+	bURL := start("hop_b", "45683", "45692", discoveryPort)
+	cURL := start("hop_c", "45684", "45693", "45692")
+
+	var b, c node
+	found := false
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline) && !found; time.Sleep(200 * time.Millisecond) {
+		b, _ = status(bURL)
+		for _, p := range b.Discovery {
+			found = found || (p.Node == self.Node && fmt.Sprint(p.Port) == serverPort)
+		}
+	}
+	if !found {
+		t.Fatalf("Node b did not discover the main node on its custom ports: %+v", b.Discovery)
+	}
+
+	routed := false
+	for deadline := time.Now().Add(40 * time.Second); time.Now().Before(deadline) && !routed; time.Sleep(500 * time.Millisecond) {
+		c, _ = status(cURL)
+		for _, r := range c.Routes {
+			routed = routed || (r.Node == self.Node && r.Hops == 2 && r.Via == b.Node)
+		}
+	}
+	if !routed {
+		t.Fatalf("Node c has no two-hop route to the main node: %+v", c.Routes)
+	}
+
+	relayed, err := status(cURL + "/mesh/relay/" + self.Node)
+	if err != nil || relayed.Node != self.Node {
+		t.Errorf("Relay through b failed: %v %+v", err, relayed)
+	}
+
+	resp, err := http.Get(cURL + "/peer/browse?peer=" + self.Node + "&path=.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listing struct {
+		Node    string            `json:"node"`
+		Entries []json.RawMessage `json:"entries"`
+	}
+	json.NewDecoder(resp.Body).Decode(&listing)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || listing.Node != self.Node {
+		t.Errorf("Browsing the main node through the mesh failed: %d %+v", resp.StatusCode, listing)
+	}
+}
+
+func testIPv6(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback not available")
+	} else {
+		ln.Close()
+	}
+
+	resp, err := http.Get("http://[::1]:" + serverPort + "/status")
+	if err != nil {
+		t.Fatalf("Server does not listen on IPv6: %v", err)
+	}
+	var status struct {
+		Node string   `json:"node"`
+		IPs  []string `json:"ips"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	found := false
+	for _, ip := range status.IPs {
+		host, zone, _ := strings.Cut(ip, "%")
+		parsed := net.ParseIP(host)
+		if parsed == nil || (zone != "" && !parsed.IsLinkLocalUnicast()) {
+			t.Errorf("Unexpected address in status: %s", ip)
+		}
+		found = found || host == "::1"
+	}
+	if !found {
+		t.Errorf("Expected ::1 among the serving addresses: %v", status.IPs)
+	}
+
+	conn, err := net.Dial("udp6", "[::1]:"+discoveryPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("TAZ_DISCOVER|v6nonce"))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("No discovery answer over IPv6: %v", err)
+	}
+	if reply := string(buf[:n]); !verifyIdent(reply, "v6nonce") || strings.Split(reply, "|")[3] != status.Node {
+		t.Errorf("Unexpected IPv6 announcement: %s", reply)
+	}
+}
+
+// writeOSMPBF stores three nodes on a line, joined end to end by a 200 km/h
+// road and through the middle one by a 250 km/h road, plus a way whose tag
+// index does not fit in an int.
+func writeOSMPBF(path string) error {
+	zigzag := func(n int64) uint64 { return uint64(n<<1) ^ uint64(n>>63) }
+	var table []byte
+	for _, s := range []string{"", "highway", "primary", "maxspeed", "200", "250"} {
+		table = append(table, pbBytes(1, []byte(s))...)
+	}
+	dense := slices.Concat(
+		pbPacked(1, zigzag(1), zigzag(1), zigzag(1)),
+		pbPacked(8, zigzag(100_000_000), 0, 0),
+		pbPacked(9, zigzag(200_000_000), zigzag(100_000), zigzag(100_000)),
+	)
+	way := func(id uint64, keys, vals []uint64, refs ...uint64) []byte {
+		return pbBytes(3, slices.Concat(pbVarint(1, id), pbPacked(2, keys...), pbPacked(3, vals...), pbPacked(8, refs...)))
+	}
+	group := slices.Concat(
+		pbBytes(2, dense),
+		way(1, []uint64{1, 3}, []uint64{2, 4}, zigzag(1), zigzag(2)),
+		way(2, []uint64{1, 3}, []uint64{2, 5}, zigzag(1), zigzag(1), zigzag(1)),
+		way(3, []uint64{1 << 63}, []uint64{2}, zigzag(1), zigzag(1)),
+	)
+	blob := pbBytes(1, slices.Concat(pbBytes(1, table), pbBytes(2, group)))
+	header := slices.Concat(pbBytes(1, []byte("OSMData")), pbVarint(3, uint64(len(blob))))
+	size := binary.BigEndian.AppendUint32(nil, uint32(len(header)))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, slices.Concat(size, header, blob), 0644)
+}
+
+func testMapRoute(t *testing.T, client *http.Client) {
+	var route struct {
+		Mode     string       `json:"mode"`
+		Distance float64      `json:"distance"`
+		Duration float64      `json:"duration"`
+		Geometry [][2]float64 `json:"coordinates"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(serverURL + "/map/route?from=10,20&to=10,20.02&mode=car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&route)
+			resp.Body.Close()
+			break
+		}
+		resp.Body.Close()
+		time.Sleep(200 * time.Millisecond)
+	}
+	if route.Mode != "car" {
+		t.Fatal("Route never found on the road extract")
+	}
+	// Both roads are as long, so only the faster one through the middle node
+	// is right: a heuristic assuming slower roads would settle for the other.
+	if len(route.Geometry) != 5 || math.Abs(route.Geometry[2][0]-20.01) > 1e-6 {
+		t.Errorf("Expected the route through the middle node: %+v", route.Geometry)
+	}
+	if fast := route.Distance / (250 / 3.6); math.Abs(route.Duration-fast) > 1 {
+		t.Errorf("Expected %.0fs at 250 km/h, got %.0fs", fast, route.Duration)
+	}
+	if _, err := os.Stat(filepath.Join(testRootFiles, "sys", "routing", "maps%2Froads.osm.pbf.graph")); err != nil {
+		t.Errorf("Routing graph not cached under an escaped name: %v", err)
+	}
+}